@@ -0,0 +1,577 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// feltPrime is the order of the Starknet field, 2^251 + 17*2^192 + 1
+var feltPrime, _ = new(big.Int).SetString("800000000000011000000000000000000000000000000000000000000000001", 16)
+
+// abiEntry is one item of a Cairo 1 contract ABI
+type abiEntry struct {
+	Type     string      `json:"type"`
+	Name     string      `json:"name"`
+	Kind     string      `json:"kind,omitempty"`
+	Members  []abiMember `json:"members,omitempty"`
+	Variants []abiMember `json:"variants,omitempty"`
+	Items    []abiEntry  `json:"items,omitempty"`
+}
+
+// abiMember is a struct member, enum variant or event field
+type abiMember struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Kind string `json:"kind,omitempty"` // key, data, nested or flat for events
+}
+
+// ContractABI holds the types and events of one or more Cairo contracts and
+// decodes their events into named fields
+type ContractABI struct {
+	structs map[string][]abiMember
+	enums   map[string][]abiMember
+	// Event definitions by fully qualified name
+	events map[string]abiEntry
+	// Top-level event selectors per contract address ("" for ABIs loaded
+	// without an address), mapping keys[0] to the event type
+	selectors map[string]map[string]string
+	// Dojo model and event tags ("namespace-Name") by selector, from manifests
+	dojoTags map[string]string
+}
+
+// dojoResource is a model or event entry of a Dojo manifest
+type dojoResource struct {
+	Tag      string `json:"tag"`
+	Selector string `json:"selector"`
+}
+
+// DecodedEvent is an event decoded with its ABI
+type DecodedEvent struct {
+	Name   string                 `json:"name"`
+	Fields map[string]interface{} `json:"fields"`
+	// Text of the felt252 fields that hold printable short strings. The ABI
+	// does not tell short strings from numbers, so both forms are passed on.
+	ShortStrings map[string]string `json:"short_strings,omitempty"`
+}
+
+// loadContractABI reads an ABI from a file. It accepts a plain ABI array, a
+// contract class with an "abi" field and Dojo manifests, whose world and
+// contract ABIs are all loaded.
+func loadContractABI(path string) (*ContractABI, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	abi := &ContractABI{
+		structs:   make(map[string][]abiMember),
+		enums:     make(map[string][]abiMember),
+		events:    make(map[string]abiEntry),
+		selectors: make(map[string]map[string]string),
+		dojoTags:  make(map[string]string),
+	}
+
+	var manifest struct {
+		World *struct {
+			Address string          `json:"address"`
+			ABI     json.RawMessage `json:"abi"`
+		} `json:"world"`
+		Contracts []struct {
+			Address string          `json:"address"`
+			ABI     json.RawMessage `json:"abi"`
+		} `json:"contracts"`
+		Models []dojoResource  `json:"models"`
+		Events []dojoResource  `json:"events"`
+		ABI    json.RawMessage `json:"abi"`
+	}
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		// Not an object, so it should be a plain ABI array
+		return abi, abi.add("", raw)
+	}
+
+	if manifest.World != nil {
+		if err := abi.add(manifest.World.Address, manifest.World.ABI); err != nil {
+			return nil, fmt.Errorf("world ABI: %w", err)
+		}
+		for _, contract := range manifest.Contracts {
+			if err := abi.add(contract.Address, contract.ABI); err != nil {
+				return nil, fmt.Errorf("contract %s ABI: %w", contract.Address, err)
+			}
+		}
+		for _, resource := range append(manifest.Models, manifest.Events...) {
+			abi.dojoTags[normalizeFelt(resource.Selector)] = resource.Tag
+		}
+		return abi, nil
+	}
+	if len(manifest.ABI) > 0 {
+		return abi, abi.add("", manifest.ABI)
+	}
+	return nil, fmt.Errorf("no ABI found in %s", path)
+}
+
+// add registers the entries of one contract ABI. Contract classes sometimes
+// carry the ABI as a JSON string rather than an array.
+func (a *ContractABI) add(address string, raw json.RawMessage) error {
+	var encoded string
+	if json.Unmarshal(raw, &encoded) == nil {
+		raw = json.RawMessage(encoded)
+	}
+	var entries []abiEntry
+	if err := json.Unmarshal(raw, &entries); err != nil {
+		return fmt.Errorf("invalid ABI: %w", err)
+	}
+
+	var walk func(entries []abiEntry)
+	walk = func(entries []abiEntry) {
+		for _, entry := range entries {
+			switch entry.Type {
+			case "struct":
+				a.structs[entry.Name] = entry.Members
+			case "enum":
+				a.enums[entry.Name] = entry.Variants
+			case "event":
+				a.events[entry.Name] = entry
+			case "interface":
+				walk(entry.Items)
+			}
+		}
+	}
+	walk(entries)
+
+	// Find the contract's top-level event enum: an event enum no other event
+	// enum refers to. Without one, struct events are keyed by their own name.
+	selectors := make(map[string]string)
+	nested := make(map[string]bool)
+	for _, entry := range entries {
+		if entry.Type == "event" && entry.Kind == "enum" {
+			for _, variant := range entry.Variants {
+				nested[variant.Type] = true
+			}
+		}
+	}
+	found := false
+	for _, entry := range entries {
+		if entry.Type == "event" && entry.Kind == "enum" && !nested[entry.Name] {
+			a.addVariantSelectors(selectors, entry)
+			found = true
+		}
+	}
+	if !found {
+		for _, entry := range entries {
+			if entry.Type == "event" && entry.Kind == "struct" {
+				selectors[starknetKeccak(shortTypeName(entry.Name))] = entry.Name
+			}
+		}
+	}
+
+	address = normalizeFelt(address)
+	if a.selectors[address] == nil {
+		a.selectors[address] = make(map[string]string)
+	}
+	for selector, name := range selectors {
+		a.selectors[address][selector] = name
+	}
+	return nil
+}
+
+// addVariantSelectors maps the selectors of an event enum's variants to their
+// types. Flat variants contribute their own variants' selectors instead.
+func (a *ContractABI) addVariantSelectors(selectors map[string]string, enum abiEntry) {
+	for _, variant := range enum.Variants {
+		if inner, ok := a.events[variant.Type]; ok && variant.Kind == "flat" && inner.Kind == "enum" {
+			a.addVariantSelectors(selectors, inner)
+			continue
+		}
+		selectors[starknetKeccak(variant.Name)] = variant.Type
+	}
+}
+
+// shortTypeName strips the module path from a type name
+func shortTypeName(name string) string {
+	if i := strings.LastIndex(name, "::"); i >= 0 {
+		return name[i+2:]
+	}
+	return name
+}
+
+// DecodeEvent decodes an event emitted by fromAddress. Events of contracts the
+// ABI has no address for are looked up among all loaded contracts.
+func (a *ContractABI) DecodeEvent(fromAddress string, keys, data []string) (*DecodedEvent, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("event has no keys")
+	}
+
+	selector := normalizeFelt(keys[0])
+	name, ok := a.selectors[normalizeFelt(fromAddress)][selector]
+	if !ok {
+		name, ok = a.selectors[normalizeFelt("")][selector]
+	}
+	if !ok {
+		for _, selectors := range a.selectors {
+			if name, ok = selectors[selector]; ok {
+				break
+			}
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("no event with selector %s in the ABI", selector)
+	}
+
+	return a.decodeEventType(name, &feltReader{felts: keys[1:]}, &feltReader{felts: data})
+}
+
+// eventFieldNames lists the fields of the struct event whose selector is
+// given, if the ABI defines one
+func (a *ContractABI) eventFieldNames(selector string) ([]string, bool) {
+	selector = normalizeFelt(selector)
+	for _, selectors := range a.selectors {
+		if name, ok := selectors[selector]; ok {
+			if event := a.events[name]; event.Kind == "struct" {
+				return memberNames(event.Members), true
+			}
+		}
+	}
+	return nil, false
+}
+
+// hasEventSelector reports whether selector is the first key of an event the
+// contract at address emits, rather than the selector of a Dojo model or
+// event. An empty address looks at the events of all loaded contracts.
+func (a *ContractABI) hasEventSelector(address, selector string) bool {
+	selector = normalizeFelt(selector)
+	if _, ok := a.dojoTags[selector]; ok {
+		return false
+	}
+	if address == "" {
+		for _, selectors := range a.selectors {
+			if _, ok := selectors[selector]; ok {
+				return true
+			}
+		}
+		return false
+	}
+	if _, ok := a.selectors[normalizeFelt(address)][selector]; ok {
+		return true
+	}
+	_, ok := a.selectors[normalizeFelt("")][selector]
+	return ok
+}
+
+// memberNames returns the names of struct members or event fields
+func memberNames(members []abiMember) []string {
+	names := make([]string, len(members))
+	for i, member := range members {
+		names[i] = member.Name
+	}
+	return names
+}
+
+// decodeEventType decodes the remaining keys and data as the named event. A
+// nested event enum selects its variant with the next key.
+func (a *ContractABI) decodeEventType(name string, keys, data *feltReader) (*DecodedEvent, error) {
+	event, ok := a.events[name]
+	if !ok {
+		return nil, fmt.Errorf("event %s is not defined in the ABI", name)
+	}
+
+	if event.Kind == "enum" {
+		selector, err := keys.next()
+		if err != nil {
+			return nil, fmt.Errorf("event %s: missing variant key", name)
+		}
+		variants := make(map[string]string)
+		a.addVariantSelectors(variants, event)
+		variant, ok := variants["0x"+selector.Text(16)]
+		if !ok {
+			return nil, fmt.Errorf("event %s has no variant with selector 0x%s", name, selector.Text(16))
+		}
+		return a.decodeEventType(variant, keys, data)
+	}
+
+	decoded := &DecodedEvent{Name: name, Fields: make(map[string]interface{}, len(event.Members))}
+	for _, member := range event.Members {
+		source := data
+		if member.Kind == "key" {
+			source = keys
+		}
+		value, err := a.decodeValue(member.Type, source)
+		if err != nil {
+			return nil, fmt.Errorf("event %s field %s: %w", name, member.Name, err)
+		}
+		decoded.Fields[member.Name] = value
+
+		if felt, ok := value.(string); ok && member.Type == "core::felt252" {
+			if text, ok := decodeShortString(felt); ok {
+				if decoded.ShortStrings == nil {
+					decoded.ShortStrings = make(map[string]string)
+				}
+				decoded.ShortStrings[member.Name] = text
+			}
+		}
+	}
+	if keys.remaining() > 0 || data.remaining() > 0 {
+		return nil, fmt.Errorf("event %s: %d key(s) and %d data felt(s) left over", name, keys.remaining(), data.remaining())
+	}
+	return decoded, nil
+}
+
+// decodeValue reads one value of a Cairo type from the felts. Integers that do
+// not fit in a JSON number exactly are returned as decimal strings, felts and
+// addresses as hex strings.
+func (a *ContractABI) decodeValue(typ string, r *feltReader) (interface{}, error) {
+	typ = strings.TrimPrefix(strings.TrimSpace(typ), "@")
+
+	switch typ {
+	case "()":
+		return nil, nil
+	case "core::felt252", "core::starknet::contract_address::ContractAddress",
+		"core::starknet::class_hash::ClassHash", "core::starknet::eth_address::EthAddress",
+		"core::starknet::storage_access::StorageAddress", "core::bytes_31::bytes31":
+		n, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		return "0x" + n.Text(16), nil
+	case "core::bool":
+		n, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		return n.Sign() != 0, nil
+	case "core::integer::u8", "core::integer::u16", "core::integer::u32":
+		n, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		return n.Uint64(), nil
+	case "core::integer::u64", "core::integer::u128", "core::integer::usize":
+		n, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		return n.String(), nil
+	case "core::integer::i8", "core::integer::i16", "core::integer::i32":
+		n, err := r.nextSigned()
+		if err != nil {
+			return nil, err
+		}
+		return n.Int64(), nil
+	case "core::integer::i64", "core::integer::i128":
+		n, err := r.nextSigned()
+		if err != nil {
+			return nil, err
+		}
+		return n.String(), nil
+	case "core::integer::u256":
+		low, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		high, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).Add(new(big.Int).Lsh(high, 128), low).String(), nil
+	case "core::byte_array::ByteArray":
+		return r.nextByteArray()
+	}
+
+	if inner, ok := genericArgument(typ, "core::array::Array::", "core::array::Span::"); ok {
+		length, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		if !length.IsInt64() || length.Sign() < 0 || length.Int64() > int64(r.remaining()) {
+			return nil, fmt.Errorf("invalid array length %s", length)
+		}
+		values := make([]interface{}, 0, length.Int64())
+		for i := int64(0); i < length.Int64(); i++ {
+			value, err := a.decodeValue(inner, r)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return values, nil
+	}
+	if inner, ok := genericArgument(typ, "core::zeroable::NonZero::", "core::box::Box::"); ok {
+		return a.decodeValue(inner, r)
+	}
+	if strings.HasPrefix(typ, "(") && strings.HasSuffix(typ, ")") {
+		var values []interface{}
+		for _, element := range splitTypeList(typ[1 : len(typ)-1]) {
+			value, err := a.decodeValue(element, r)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return values, nil
+	}
+
+	if members, ok := a.structs[typ]; ok {
+		fields := make(map[string]interface{}, len(members))
+		for _, member := range members {
+			value, err := a.decodeValue(member.Type, r)
+			if err != nil {
+				return nil, fmt.Errorf("%s.%s: %w", shortTypeName(typ), member.Name, err)
+			}
+			fields[member.Name] = value
+		}
+		return fields, nil
+	}
+	if variants, ok := a.enums[typ]; ok {
+		index, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		if !index.IsInt64() || index.Sign() < 0 || index.Int64() >= int64(len(variants)) {
+			return nil, fmt.Errorf("%s has no variant %s", shortTypeName(typ), index)
+		}
+		variant := variants[index.Int64()]
+		if variant.Type == "()" {
+			return variant.Name, nil
+		}
+		value, err := a.decodeValue(variant.Type, r)
+		if err != nil {
+			return nil, fmt.Errorf("%s::%s: %w", shortTypeName(typ), variant.Name, err)
+		}
+		return map[string]interface{}{variant.Name: value}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported type %s", typ)
+}
+
+// genericArgument returns T for types of the form prefix<T>
+func genericArgument(typ string, prefixes ...string) (string, bool) {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(typ, prefix+"<") && strings.HasSuffix(typ, ">") {
+			return typ[len(prefix)+1 : len(typ)-1], true
+		}
+	}
+	return "", false
+}
+
+// splitTypeList splits a comma-separated list of types, ignoring commas nested
+// in generics or tuples
+func splitTypeList(list string) []string {
+	var types []string
+	depth, start := 0, 0
+	for i, c := range list {
+		switch c {
+		case '<', '(':
+			depth++
+		case '>', ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				types = append(types, strings.TrimSpace(list[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	if last := strings.TrimSpace(list[start:]); last != "" {
+		types = append(types, last)
+	}
+	return types
+}
+
+// feltReader consumes a sequence of hex felts
+type feltReader struct {
+	felts []string
+	pos   int
+}
+
+func (r *feltReader) remaining() int {
+	return len(r.felts) - r.pos
+}
+
+func (r *feltReader) next() (*big.Int, error) {
+	if r.pos >= len(r.felts) {
+		return nil, fmt.Errorf("ran out of felts")
+	}
+	value := strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(r.felts[r.pos]), "0x"), "0X")
+	n, ok := new(big.Int).SetString(value, 16)
+	if !ok {
+		return nil, fmt.Errorf("invalid felt %q", r.felts[r.pos])
+	}
+	r.pos++
+	return n, nil
+}
+
+// nextSigned reads a felt holding a signed integer; negative values are
+// stored as their field complement
+func (r *feltReader) nextSigned() (*big.Int, error) {
+	n, err := r.next()
+	if err != nil {
+		return nil, err
+	}
+	if n.Cmp(new(big.Int).Rsh(feltPrime, 1)) > 0 {
+		n.Sub(n, feltPrime)
+	}
+	return n, nil
+}
+
+// nextByteArray reads a ByteArray: the number of full 31-byte words, the
+// words, the pending word and its length
+func (r *feltReader) nextByteArray() (string, error) {
+	words, err := r.next()
+	if err != nil {
+		return "", err
+	}
+	if !words.IsInt64() || words.Sign() < 0 || words.Int64() > int64(r.remaining()) {
+		return "", fmt.Errorf("invalid ByteArray length %s", words)
+	}
+
+	var text []byte
+	for i := int64(0); i < words.Int64(); i++ {
+		word, err := r.next()
+		if err != nil {
+			return "", err
+		}
+		if len(word.Bytes()) > 31 {
+			return "", fmt.Errorf("invalid ByteArray word %s", r.felts[r.pos-1])
+		}
+		text = append(text, word.FillBytes(make([]byte, 31))...)
+	}
+	pending, err := r.next()
+	if err != nil {
+		return "", err
+	}
+	pendingLen, err := r.next()
+	if err != nil {
+		return "", err
+	}
+	if !pendingLen.IsInt64() || pendingLen.Sign() < 0 || pendingLen.Int64() > 30 || len(pending.Bytes()) > int(pendingLen.Int64()) {
+		return "", fmt.Errorf("invalid ByteArray pending word length %s", pendingLen)
+	}
+	text = append(text, pending.FillBytes(make([]byte, pendingLen.Int64()))...)
+
+	if !utf8.Valid(text) {
+		return "0x" + fmt.Sprintf("%x", text), nil
+	}
+	return string(text), nil
+}
+
+// decodeShortString decodes a felt holding a Cairo short string (up to 31
+// ASCII characters). ok is false when the felt is not printable text.
+func decodeShortString(felt string) (string, bool) {
+	n, ok := new(big.Int).SetString(strings.TrimPrefix(normalizeFelt(felt), "0x"), 16)
+	if !ok || n.Sign() == 0 {
+		return "", false
+	}
+	text := n.Bytes()
+	if len(text) > 31 {
+		return "", false
+	}
+	for _, c := range text {
+		if c < 0x20 || c > 0x7e {
+			return "", false
+		}
+	}
+	return string(text), true
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const testABI = `[
+	{"type": "enum", "name": "test::Direction", "variants": [
+		{"name": "North", "type": "()"},
+		{"name": "East", "type": "()"},
+		{"name": "Steps", "type": "core::integer::u8"}
+	]},
+	{"type": "event", "name": "test::Moved", "kind": "struct", "members": [
+		{"name": "player", "type": "core::starknet::contract_address::ContractAddress", "kind": "key"},
+		{"name": "direction", "type": "test::Direction", "kind": "data"}
+	]},
+	{"type": "event", "name": "test::Event", "kind": "enum", "variants": [
+		{"name": "Moved", "type": "test::Moved", "kind": "nested"}
+	]}
+]`
+
+func loadTestABI(t *testing.T) *ContractABI {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "abi.json")
+	if err := os.WriteFile(path, []byte(testABI), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	abi, err := loadContractABI(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return abi
+}
+
+func TestDecodeValue(t *testing.T) {
+	abi := loadTestABI(t)
+	fullWord := "abcdefghijklmnopqrstuvwxyz01234"
+	tests := []struct {
+		typ   string
+		felts []string
+		want  interface{}
+		err   bool
+	}{
+		{typ: "core::integer::u256", felts: []string{"0x1", "0x1"}, want: "340282366920938463463374607431768211457"},
+		{typ: "core::integer::u256", felts: []string{"0xffffffffffffffffffffffffffffffff", "0x0"}, want: "340282366920938463463374607431768211455"},
+		{typ: "core::integer::u256", felts: []string{"0x1"}, err: true},
+		{typ: "core::integer::i8", felts: []string{"0x800000000000011000000000000000000000000000000000000000000000000"}, want: int64(-1)},
+		{typ: "core::byte_array::ByteArray", felts: []string{"0x0", "0x68656c6c6f", "0x5"}, want: "hello"},
+		{typ: "core::byte_array::ByteArray", felts: []string{"0x0", "0x0", "0x0"}, want: ""},
+		{typ: "core::byte_array::ByteArray", felts: []string{"0x1", fmt.Sprintf("0x%x", fullWord), "0x35", "0x1"}, want: fullWord + "5"},
+		// Leading zero bytes of the pending word count towards its length
+		{typ: "core::byte_array::ByteArray", felts: []string{"0x0", "0x41", "0x2"}, want: "\x00A"},
+		{typ: "core::byte_array::ByteArray", felts: []string{"0x0", "0xff", "0x1"}, want: "0xff"},
+		// A full word holds 31 bytes, 2^248 does not fit
+		{typ: "core::byte_array::ByteArray", felts: []string{"0x1", "0x100000000000000000000000000000000000000000000000000000000000000", "0x0", "0x0"}, err: true},
+		{typ: "core::byte_array::ByteArray", felts: []string{"0x0", "0x4142", "0x1"}, err: true},
+		{typ: "core::byte_array::ByteArray", felts: []string{"0x0", "0x0", "0x1f"}, err: true},
+		{typ: "core::byte_array::ByteArray", felts: []string{"0x5", "0x0", "0x0"}, err: true},
+		{typ: "test::Direction", felts: []string{"0x1"}, want: "East"},
+		{typ: "test::Direction", felts: []string{"0x2", "0x7"}, want: map[string]interface{}{"Steps": uint64(7)}},
+		{typ: "test::Direction", felts: []string{"0x3"}, err: true},
+		{typ: "test::Direction", felts: []string{"0x2"}, err: true},
+		{typ: "core::array::Array::<test::Direction>", felts: []string{"0x2", "0x0", "0x2", "0x1"}, want: []interface{}{"North", map[string]interface{}{"Steps": uint64(1)}}},
+		{typ: "core::array::Array::<test::Direction>", felts: []string{"0x3", "0x0"}, err: true},
+		// Lengths and indexes parse as signed, a negative one must not reach make
+		{typ: "core::array::Array::<test::Direction>", felts: []string{"0x-1"}, err: true},
+		{typ: "core::byte_array::ByteArray", felts: []string{"0x-1", "0x0", "0x0"}, err: true},
+		{typ: "test::Direction", felts: []string{"0x-1"}, err: true},
+		{typ: "test::Unknown", felts: []string{"0x0"}, err: true},
+	}
+	for _, test := range tests {
+		got, err := abi.decodeValue(test.typ, &feltReader{felts: test.felts})
+		if test.err {
+			if err == nil {
+				t.Errorf("decodeValue(%s, %v) = %v, want an error", test.typ, test.felts, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("decodeValue(%s, %v) failed: %v", test.typ, test.felts, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("decodeValue(%s, %v) = %#v, want %#v", test.typ, test.felts, got, test.want)
+		}
+	}
+}
+
+func TestDecodeEvent(t *testing.T) {
+	abi := loadTestABI(t)
+	decoded, err := abi.DecodeEvent("0x1", []string{starknetKeccak("Moved"), "0x0abc"}, []string{"0x2", "0x3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"player": "0xabc", "direction": map[string]interface{}{"Steps": uint64(3)}}
+	if decoded.Name != "test::Moved" || !reflect.DeepEqual(decoded.Fields, want) {
+		t.Errorf("DecodeEvent = %s %#v, want test::Moved %#v", decoded.Name, decoded.Fields, want)
+	}
+
+	if _, err := abi.DecodeEvent("0x1", []string{starknetKeccak("Moved"), "0xabc"}, []string{"0x2", "0x3", "0x4"}); err == nil {
+		t.Error("DecodeEvent with a felt left over succeeded")
+	}
+	if _, err := abi.DecodeEvent("0x1", []string{starknetKeccak("Jumped")}, nil); err == nil {
+		t.Error("DecodeEvent of an event the ABI does not define succeeded")
+	}
+}
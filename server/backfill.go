@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+)
+
+var (
+	// Flags of the backfill subcommand, which also takes every server flag
+	backfillFlags  = flag.NewFlagSet("backfill", flag.ExitOnError)
+	backfillFrom   = backfillFlags.Int("from", -1, "First block to scan")
+	backfillTo     = backfillFlags.Int("to", -1, "Last block to scan")
+	backfillDryRun = backfillFlags.Bool("dry-run", false, "Print the Jobs that would be created, with their event IDs and environment, instead of creating them")
+
+	// Jobs handled by a running backfill, nil when serving
+	backfillJobs *BackfillReport
+)
+
+// parseBackfillFlags parses the arguments after "backfill", which may be any
+// server flag as well as the backfill's own
+func parseBackfillFlags(args []string) {
+	flag.VisitAll(func(f *flag.Flag) {
+		backfillFlags.Var(f.Value, f.Name, f.Usage)
+	})
+	backfillFlags.Usage = func() {
+		fmt.Fprintf(backfillFlags.Output(), "Usage: %s backfill --from N --to M [--dry-run] [server flags]\n\n", os.Args[0])
+		fmt.Fprintln(backfillFlags.Output(), "Scans a block range with the watch rules, creates the agent Jobs for it and exits.")
+		backfillFlags.PrintDefaults()
+	}
+	backfillFlags.Parse(args)
+}
+
+// BackfillReport lists the Jobs a backfill created or, in a dry run, would create
+type BackfillReport struct {
+	FromBlock int            `json:"from_block"`
+	ToBlock   int            `json:"to_block"`
+	DryRun    bool           `json:"dry_run"`
+	Revision  string         `json:"rules_revision"`
+	Jobs      []BackfillJob  `json:"jobs"`
+	ByRule    map[string]int `json:"jobs_by_rule"`
+
+	mu sync.Mutex
+}
+
+// BackfillJob is one agent Job of a backfill with the environment its
+// containers get
+type BackfillJob struct {
+	JobName         string            `json:"job_name"`
+	Namespace       string            `json:"namespace"`
+	EventID         string            `json:"event_id"`
+	Rule            string            `json:"rule"`
+	BlockNumber     int               `json:"block_number"`
+	TransactionHash string            `json:"transaction_hash"`
+	Image           string            `json:"image"`
+	Env             map[string]string `json:"env"`
+}
+
+// add records a Job for an event matched by a rule
+func (r *BackfillReport) add(job *batchv1.Job, event EventPayload, rule *WatchRule) {
+	entry := BackfillJob{
+		JobName:   job.Name,
+		Namespace: job.Namespace,
+		EventID:   event.EventID,
+		Rule:      rule.displayName(),
+		Env:       make(map[string]string),
+	}
+	entry.BlockNumber, _ = event.Payload["block_number"].(int)
+	entry.TransactionHash, _ = event.Payload["transaction_hash"].(string)
+	if containers := job.Spec.Template.Spec.Containers; len(containers) > 0 {
+		entry.Image = containers[0].Image
+		for _, env := range containers[0].Env {
+			entry.Env[env.Name] = env.Value
+			if source := env.ValueFrom; source != nil {
+				switch {
+				case source.SecretKeyRef != nil:
+					entry.Env[env.Name] = fmt.Sprintf("<secret %s/%s>", source.SecretKeyRef.Name, source.SecretKeyRef.Key)
+				case source.ConfigMapKeyRef != nil:
+					entry.Env[env.Name] = fmt.Sprintf("<configmap %s/%s>", source.ConfigMapKeyRef.Name, source.ConfigMapKeyRef.Key)
+				case source.FieldRef != nil:
+					entry.Env[env.Name] = fmt.Sprintf("<field %s>", source.FieldRef.FieldPath)
+				default:
+					entry.Env[env.Name] = "<from source>"
+				}
+			}
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Jobs = append(r.Jobs, entry)
+	r.ByRule[entry.Rule]++
+}
+
+// runBackfill scans a block range with the active watch rules and creates
+// the Jobs for the events they match, or reports them in a dry run. Jobs that
+// already exist, for example because the live listener created them, are left
+// alone. The live listener's position is not touched.
+func runBackfill(ctx context.Context, fromBlock, toBlock int, dryRun bool) error {
+	if fromBlock < 0 || toBlock < fromBlock {
+		return fmt.Errorf("--from and --to must be block numbers with --from <= --to, got %d and %d", fromBlock, toBlock)
+	}
+	latestBlockNumber, err := getLatestBlockNumber(ctx, defaultStarknetConfig)
+	if err != nil {
+		return err
+	}
+	if toBlock > latestBlockNumber {
+		return fmt.Errorf("--to %d is past the latest block %d", toBlock, latestBlockNumber)
+	}
+
+	rules := activeRules.Load()
+	backfillJobs = &BackfillReport{
+		FromBlock: fromBlock,
+		ToBlock:   toBlock,
+		DryRun:    dryRun,
+		Revision:  rules.Revision,
+		Jobs:      []BackfillJob{},
+		ByRule:    make(map[string]int),
+	}
+	log.Infof("Backfilling blocks %d to %d with %d rule(s), revision %s (dry run: %t)",
+		fromBlock, toBlock, len(rules.Rules), rules.Revision, dryRun)
+
+	for _, group := range rules.groups {
+		group.logFilter()
+		if err := backfillGroup(ctx, group, fromBlock, toBlock); err != nil {
+			return err
+		}
+	}
+
+	// Workers finish Jobs out of order
+	sort.SliceStable(backfillJobs.Jobs, func(i, j int) bool {
+		a, b := backfillJobs.Jobs[i], backfillJobs.Jobs[j]
+		if a.BlockNumber != b.BlockNumber {
+			return a.BlockNumber < b.BlockNumber
+		}
+		return a.JobName < b.JobName
+	})
+	for rule, count := range backfillJobs.ByRule {
+		log.Infof("Rule %s: %d Job(s)", rule, count)
+	}
+	if dryRun {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.SetEscapeHTML(false)
+		return encoder.Encode(backfillJobs)
+	}
+	log.Infof("Backfill of blocks %d to %d done, %d Job(s) created or already present", fromBlock, toBlock, len(backfillJobs.Jobs))
+	return nil
+}
+
+// backfillGroup scans a block range for one watch group, retrying failed
+// batches with backoff until --rpc-max-retries attempts in a row made no progress
+func backfillGroup(ctx context.Context, group *watchGroup, fromBlock, toBlock int) error {
+	// The range replaces the rules' own start blocks, so the scanner's rules
+	// match in every block
+	scanner := newBlockScanner(defaultStarknetConfig, group)
+	// The report is complete once the queued Jobs are done
+	defer scanner.collect(true)
+	failures := 0
+	for nextBlock := fromBlock; nextBlock <= toBlock; {
+		scanned := scanner.scan(ctx, nextBlock, toBlock)
+		scanner.trim()
+		if scanned > nextBlock {
+			nextBlock, failures = scanned, 0
+			continue
+		}
+
+		failures++
+		if failures > *rpcMaxRetries {
+			return fmt.Errorf("scanning %s stopped at block %d", group, nextBlock)
+		}
+		delay := rpcBackoff(failures-1, 0)
+		log.Warnf("Scanning %s stopped at block %d, retrying in %s", group, nextBlock, delay)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+// testMoveChain has Moved events of contract 0x1 in blocks 9, 11 and 12, the
+// last one after a Moved event of another contract
+var testMoveChain = testChain{head: 20, transactions: []testTransaction{
+	{hash: "0xa0", block: 9, events: []testEvent{{from: "0x1", keys: []string{starknetKeccak("Moved")}, data: []string{"0x5"}}}},
+	{hash: "0xa1", block: 11, events: []testEvent{{from: "0x1", keys: []string{starknetKeccak("Moved")}, data: []string{"0x6"}}}},
+	{hash: "0xa2", block: 12, events: []testEvent{
+		{from: "0x3", keys: []string{starknetKeccak("Moved")}},
+		{from: "0x1", keys: []string{starknetKeccak("Moved")}, data: []string{"0x7"}},
+	}},
+}}
+
+// useJobQueue gives the test a Job queue that is drained when it ends
+func useJobQueue(t *testing.T) {
+	saved := jobQueue
+	jobQueue = newJobQueue(4, 2)
+	t.Cleanup(func() {
+		jobQueue.Drain(context.Background())
+		jobQueue = saved
+	})
+}
+
+func TestRunBackfillDryRun(t *testing.T) {
+	newTestRPCNode(t, &testMoveChain)
+	useTestRules(t, `namespace: agents
+rules:
+  - name: moved
+    contract: "0x1"
+    selector: Moved
+    start_block: 15
+`)
+	useJobQueue(t)
+	defer func() { backfillJobs = nil }()
+
+	tests := []struct {
+		fromBlock, toBlock int
+		events             []string
+		err                bool
+	}{
+		// The range replaces the rule's start block
+		{fromBlock: 10, toBlock: 20, events: []string{"starknet-emitted-11-0xa1-0", "starknet-emitted-12-0xa2-1"}},
+		{fromBlock: 12, toBlock: 12, events: []string{"starknet-emitted-12-0xa2-1"}},
+		{fromBlock: 13, toBlock: 20, events: []string{}},
+		{fromBlock: 12, toBlock: 11, err: true},
+		{fromBlock: -1, toBlock: 11, err: true},
+		{fromBlock: 12, toBlock: 21, err: true},
+	}
+	for _, test := range tests {
+		err := runBackfill(context.Background(), test.fromBlock, test.toBlock, true)
+		if test.err {
+			if err == nil {
+				t.Errorf("runBackfill(%d, %d) succeeded, want an error", test.fromBlock, test.toBlock)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("runBackfill(%d, %d) failed: %v", test.fromBlock, test.toBlock, err)
+			continue
+		}
+
+		events := []string{}
+		for _, job := range backfillJobs.Jobs {
+			if job.Rule != "moved" || job.Namespace != "agents" || job.Env["EVENT_ID"] != job.EventID {
+				t.Errorf("runBackfill(%d, %d) reported Job %+v", test.fromBlock, test.toBlock, job)
+			}
+			events = append(events, job.EventID)
+		}
+		if !reflect.DeepEqual(events, test.events) {
+			t.Errorf("runBackfill(%d, %d) reported Jobs for %v, want %v", test.fromBlock, test.toBlock, events, test.events)
+		}
+		if backfillJobs.ByRule["moved"] != len(test.events) {
+			t.Errorf("runBackfill(%d, %d) counted %v Jobs by rule, want %d", test.fromBlock, test.toBlock, backfillJobs.ByRule, len(test.events))
+		}
+	}
+}
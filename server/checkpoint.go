@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// checkpointConfigMapKey is the ConfigMap key holding the checkpoint
+	checkpointConfigMapKey = "checkpoint.json"
+	// checkpointAnnotation is the Lease annotation holding the checkpoint
+	checkpointAnnotation = "chairman.dreams.dev/checkpoint"
+)
+
+// Checkpoint is the last block each watch group's listener fully processed,
+// meaning the Jobs for all its events were created
+type Checkpoint struct {
+	Blocks    map[string]int `json:"blocks"`
+	UpdatedAt time.Time      `json:"updated_at"`
+	// Whether an operator paused the listener, so that a new leader or a
+	// restarted replica stays paused
+	Paused bool `json:"paused,omitempty"`
+}
+
+// checkpointStore persists the checkpoint
+type checkpointStore interface {
+	// load returns the stored checkpoint, or an empty one if none was stored yet
+	load(ctx context.Context) (Checkpoint, error)
+	save(ctx context.Context, checkpoint Checkpoint) error
+	String() string
+}
+
+// parseCheckpointStore parses --checkpoint: file:PATH, configmap:[NAMESPACE/]NAME
+// or lease:[NAMESPACE/]NAME
+func parseCheckpointStore(value string) (checkpointStore, error) {
+	kind, target, ok := strings.Cut(value, ":")
+	if !ok || target == "" {
+		return nil, fmt.Errorf("expected file:PATH, configmap:[NAMESPACE/]NAME or lease:[NAMESPACE/]NAME, got %q", value)
+	}
+	objectNamespace, name, ok := strings.Cut(target, "/")
+	if !ok {
+		objectNamespace, name = *namespace, target
+	}
+	switch kind {
+	case "file":
+		return fileCheckpointStore{path: target}, nil
+	case "configmap":
+		return configMapCheckpointStore{namespace: objectNamespace, name: name}, nil
+	case "lease":
+		return leaseCheckpointStore{namespace: objectNamespace, name: name}, nil
+	default:
+		return nil, fmt.Errorf("unknown checkpoint store %q, expected file, configmap or lease", kind)
+	}
+}
+
+// fileCheckpointStore keeps the checkpoint in a local file, which needs a
+// volume that outlives the pod
+type fileCheckpointStore struct {
+	path string
+}
+
+func (s fileCheckpointStore) load(ctx context.Context) (Checkpoint, error) {
+	raw, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return Checkpoint{Blocks: map[string]int{}}, nil
+	}
+	if err != nil {
+		return Checkpoint{}, err
+	}
+	return parseCheckpoint(raw)
+}
+
+func (s fileCheckpointStore) save(ctx context.Context, checkpoint Checkpoint) error {
+	raw, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	// Write a temporary file and rename it, so a crash never leaves half a checkpoint
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func (s fileCheckpointStore) String() string {
+	return "file " + s.path
+}
+
+// configMapCheckpointStore keeps the checkpoint in the checkpoint.json key of
+// a ConfigMap, which is created when missing
+type configMapCheckpointStore struct {
+	namespace, name string
+}
+
+func (s configMapCheckpointStore) load(ctx context.Context) (Checkpoint, error) {
+	configMap, err := kubernetesClientset.CoreV1().ConfigMaps(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return Checkpoint{Blocks: map[string]int{}}, nil
+	}
+	if err != nil {
+		return Checkpoint{}, err
+	}
+	raw, ok := configMap.Data[checkpointConfigMapKey]
+	if !ok {
+		return Checkpoint{Blocks: map[string]int{}}, nil
+	}
+	return parseCheckpoint([]byte(raw))
+}
+
+func (s configMapCheckpointStore) save(ctx context.Context, checkpoint Checkpoint) error {
+	raw, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	configMaps := kubernetesClientset.CoreV1().ConfigMaps(s.namespace)
+	configMap, err := configMaps.Get(ctx, s.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = configMaps.Create(ctx, &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: s.name, Namespace: s.namespace, Labels: map[string]string{"app": "chairman-server"}},
+			Data:       map[string]string{checkpointConfigMapKey: string(raw)},
+		}, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if configMap.Data == nil {
+		configMap.Data = make(map[string]string)
+	}
+	configMap.Data[checkpointConfigMapKey] = string(raw)
+	_, err = configMaps.Update(ctx, configMap, metav1.UpdateOptions{})
+	return err
+}
+
+func (s configMapCheckpointStore) String() string {
+	return fmt.Sprintf("ConfigMap %s/%s", s.namespace, s.name)
+}
+
+// leaseCheckpointStore keeps the checkpoint in an annotation of a
+// coordination.k8s.io Lease, which is created when missing
+type leaseCheckpointStore struct {
+	namespace, name string
+}
+
+func (s leaseCheckpointStore) load(ctx context.Context) (Checkpoint, error) {
+	lease, err := kubernetesClientset.CoordinationV1().Leases(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return Checkpoint{Blocks: map[string]int{}}, nil
+	}
+	if err != nil {
+		return Checkpoint{}, err
+	}
+	raw, ok := lease.Annotations[checkpointAnnotation]
+	if !ok {
+		return Checkpoint{Blocks: map[string]int{}}, nil
+	}
+	return parseCheckpoint([]byte(raw))
+}
+
+func (s leaseCheckpointStore) save(ctx context.Context, checkpoint Checkpoint) error {
+	raw, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	leases := kubernetesClientset.CoordinationV1().Leases(s.namespace)
+	lease, err := leases.Get(ctx, s.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = leases.Create(ctx, &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        s.name,
+				Namespace:   s.namespace,
+				Labels:      map[string]string{"app": "chairman-server"},
+				Annotations: map[string]string{checkpointAnnotation: string(raw)},
+			},
+		}, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if lease.Annotations == nil {
+		lease.Annotations = make(map[string]string)
+	}
+	lease.Annotations[checkpointAnnotation] = string(raw)
+	_, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+	return err
+}
+
+func (s leaseCheckpointStore) String() string {
+	return fmt.Sprintf("Lease %s/%s", s.namespace, s.name)
+}
+
+func parseCheckpoint(raw []byte) (Checkpoint, error) {
+	var checkpoint Checkpoint
+	if err := json.Unmarshal(raw, &checkpoint); err != nil {
+		return Checkpoint{}, fmt.Errorf("invalid checkpoint: %v", err)
+	}
+	if checkpoint.Blocks == nil {
+		checkpoint.Blocks = map[string]int{}
+	}
+	return checkpoint, nil
+}
+
+// Checkpointer tracks the listener's position in memory and writes it to its
+// store in the background. Positions only advance once the Jobs of the blocks
+// before them exist, so after a crash the listener at worst scans a few blocks
+// again, and the Jobs it would create for them already exist.
+//
+// A nil Checkpointer, used when --checkpoint is not set, ignores everything.
+type Checkpointer struct {
+	store checkpointStore
+
+	mu         sync.Mutex
+	checkpoint Checkpoint
+	dirty      bool
+	saves      int64
+	failures   int64
+}
+
+// loadCheckpointer reads the stored checkpoint
+func loadCheckpointer(ctx context.Context, store checkpointStore) (*Checkpointer, error) {
+	checkpoint, err := store.load(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load checkpoint from %s: %w", store, err)
+	}
+	return &Checkpointer{store: store, checkpoint: checkpoint}, nil
+}
+
+// Position returns the last block a watch group fully processed
+func (c *Checkpointer) Position(group string) (int, bool) {
+	if c == nil {
+		return 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	blockNumber, ok := c.checkpoint.Blocks[group]
+	return blockNumber, ok
+}
+
+// Commit records that a watch group fully processed every block up to
+// blockNumber. It may move back, after a reorg.
+func (c *Checkpointer) Commit(group string, blockNumber int) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if current, ok := c.checkpoint.Blocks[group]; ok && current == blockNumber {
+		return
+	}
+	c.checkpoint.Blocks[group] = blockNumber
+	c.dirty = true
+}
+
+// Paused reports whether the stored listener was paused
+func (c *Checkpointer) Paused() bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.checkpoint.Paused
+}
+
+// SetPaused records whether the listener is paused
+func (c *Checkpointer) SetPaused(paused bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.checkpoint.Paused != paused {
+		c.checkpoint.Paused = paused
+		c.dirty = true
+	}
+}
+
+// Flush writes the checkpoint to its store if it changed since the last write
+func (c *Checkpointer) Flush(ctx context.Context) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	if !c.dirty {
+		c.mu.Unlock()
+		return nil
+	}
+	checkpoint := Checkpoint{Blocks: make(map[string]int, len(c.checkpoint.Blocks)), Paused: c.checkpoint.Paused, UpdatedAt: time.Now().UTC()}
+	for group, blockNumber := range c.checkpoint.Blocks {
+		checkpoint.Blocks[group] = blockNumber
+	}
+	c.dirty = false
+	c.mu.Unlock()
+
+	err := c.store.save(ctx, checkpoint)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		// Try again with the next flush
+		c.dirty = true
+		c.failures++
+		return fmt.Errorf("failed to save checkpoint to %s: %w", c.store, err)
+	}
+	c.checkpoint.UpdatedAt = checkpoint.UpdatedAt
+	c.saves++
+	return nil
+}
+
+// run flushes the checkpoint every interval until ctx is done
+func (c *Checkpointer) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.Flush(ctx); err != nil {
+				log.Errorf("%v", err)
+			}
+		}
+	}
+}
+
+// writeMetrics reports checkpoint writes and the checkpointed blocks
+func (c *Checkpointer) writeMetrics(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeMetric(w, "chairman_checkpoint_saves_total", "counter", "Times the listener checkpoint was written", float64(c.saves))
+	writeMetric(w, "chairman_checkpoint_save_failures_total", "counter", "Times writing the listener checkpoint failed", float64(c.failures))
+	if !c.checkpoint.UpdatedAt.IsZero() {
+		writeMetric(w, "chairman_checkpoint_updated_timestamp_seconds", "gauge", "Time the listener checkpoint was last written", float64(c.checkpoint.UpdatedAt.Unix()))
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// fakeCheckpointStore keeps the checkpoint in memory, failing saves while err is set
+type fakeCheckpointStore struct {
+	checkpoint Checkpoint
+	saves      int
+	err        error
+}
+
+func (s *fakeCheckpointStore) load(ctx context.Context) (Checkpoint, error) {
+	if s.checkpoint.Blocks == nil {
+		return Checkpoint{Blocks: map[string]int{}}, nil
+	}
+	return s.checkpoint, nil
+}
+
+func (s *fakeCheckpointStore) save(ctx context.Context, checkpoint Checkpoint) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.checkpoint = checkpoint
+	s.saves++
+	return nil
+}
+
+func (s *fakeCheckpointStore) String() string {
+	return "fake"
+}
+
+func TestParseCheckpointStore(t *testing.T) {
+	tests := []struct {
+		value string
+		want  checkpointStore
+		err   bool
+	}{
+		{value: "file:/data/checkpoint.json", want: fileCheckpointStore{path: "/data/checkpoint.json"}},
+		{value: "configmap:chairman-checkpoint", want: configMapCheckpointStore{namespace: *namespace, name: "chairman-checkpoint"}},
+		{value: "lease:agents/chairman-checkpoint", want: leaseCheckpointStore{namespace: "agents", name: "chairman-checkpoint"}},
+		{value: "secret:chairman-checkpoint", err: true},
+		{value: "file:", err: true},
+		{value: "chairman-checkpoint", err: true},
+	}
+	for _, test := range tests {
+		got, err := parseCheckpointStore(test.value)
+		if (err != nil) != test.err || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseCheckpointStore(%q) = %v, %v, want %v, error %t", test.value, got, err, test.want, test.err)
+		}
+	}
+}
+
+func TestCheckpointStores(t *testing.T) {
+	useFakeClientset(t)
+	stores := []checkpointStore{
+		fileCheckpointStore{path: filepath.Join(t.TempDir(), "checkpoint.json")},
+		configMapCheckpointStore{namespace: "default", name: "chairman-checkpoint"},
+		leaseCheckpointStore{namespace: "default", name: "chairman-checkpoint"},
+	}
+	for _, store := range stores {
+		ctx := context.Background()
+		checkpoint, err := store.load(ctx)
+		if err != nil || len(checkpoint.Blocks) != 0 {
+			t.Errorf("%s: first load = %+v, %v, want an empty checkpoint", store, checkpoint, err)
+		}
+		// The first save creates the object, the second one updates it
+		for _, blocks := range []map[string]int{{"0x1/immediate": 10}, {"0x1/immediate": 12, "0x2/depth:3": 7}} {
+			if err := store.save(ctx, Checkpoint{Blocks: blocks}); err != nil {
+				t.Fatalf("%s: save failed: %v", store, err)
+			}
+			checkpoint, err := store.load(ctx)
+			if err != nil || !reflect.DeepEqual(checkpoint.Blocks, blocks) {
+				t.Errorf("%s: load after saving %v = %v, %v", store, blocks, checkpoint.Blocks, err)
+			}
+		}
+	}
+}
+
+func TestCheckpointerFlush(t *testing.T) {
+	store := &fakeCheckpointStore{checkpoint: Checkpoint{Blocks: map[string]int{"0x1/immediate": 10}}}
+	checkpoints, err := loadCheckpointer(context.Background(), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blockNumber, ok := checkpoints.Position("0x1/immediate"); !ok || blockNumber != 10 {
+		t.Errorf("Position = %d, %t, want the stored block 10", blockNumber, ok)
+	}
+
+	tests := []struct {
+		name   string
+		commit int
+		err    error
+		saves  int
+		stored int
+	}{
+		{name: "unchanged", commit: 10, saves: 0, stored: 10},
+		{name: "advanced", commit: 12, saves: 1, stored: 12},
+		{name: "store failing", commit: 14, err: errors.New("unavailable"), saves: 1, stored: 12},
+		// The failed position is written with the next flush
+		{name: "store back", commit: -1, saves: 2, stored: 14},
+		{name: "nothing new", commit: -1, saves: 2, stored: 14},
+		{name: "rewound after a reorg", commit: 13, saves: 3, stored: 13},
+	}
+	for _, test := range tests {
+		if test.commit >= 0 {
+			checkpoints.Commit("0x1/immediate", test.commit)
+		}
+		store.err = test.err
+		err := checkpoints.Flush(context.Background())
+		if (err != nil) != (test.err != nil) {
+			t.Errorf("%s: Flush error = %v, want %v", test.name, err, test.err)
+		}
+		if store.saves != test.saves || store.checkpoint.Blocks["0x1/immediate"] != test.stored {
+			t.Errorf("%s: %d save(s) storing block %d, want %d storing block %d",
+				test.name, store.saves, store.checkpoint.Blocks["0x1/immediate"], test.saves, test.stored)
+		}
+	}
+	if checkpoints.failures != 1 {
+		t.Errorf("%d failed save(s) counted, want 1", checkpoints.failures)
+	}
+}
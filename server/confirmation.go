@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Block statuses reported by starknet_getBlockWithTxHashes
+const (
+	blockStatusAcceptedOnL2 = "ACCEPTED_ON_L2"
+	blockStatusAcceptedOnL1 = "ACCEPTED_ON_L1"
+)
+
+// ConfirmationMode selects when a block is considered final enough to spawn
+// agents for its events
+type ConfirmationMode string
+
+const (
+	// ConfirmImmediate processes blocks as soon as they are accepted on L2
+	ConfirmImmediate ConfirmationMode = "immediate"
+	// ConfirmDepth processes blocks once Depth newer blocks were built on them
+	ConfirmDepth ConfirmationMode = "depth"
+	// ConfirmL1 processes blocks once their state was accepted on Ethereum
+	ConfirmL1 ConfirmationMode = "l1"
+)
+
+// ConfirmationPolicy decides how far behind the chain head the listener stays
+type ConfirmationPolicy struct {
+	Mode  ConfirmationMode `json:"mode"`
+	Depth int              `json:"depth,omitempty"`
+
+	// Highest block seen ACCEPTED_ON_L1 so far, the lower bound for the next search
+	lastL1Block int
+}
+
+// parseConfirmationPolicy parses "immediate", "l1" or "depth:N"
+func parseConfirmationPolicy(value string) (ConfirmationPolicy, error) {
+	mode, arg, _ := strings.Cut(strings.TrimSpace(value), ":")
+	switch ConfirmationMode(mode) {
+	case ConfirmImmediate, "":
+		return ConfirmationPolicy{Mode: ConfirmImmediate}, nil
+	case ConfirmL1:
+		return ConfirmationPolicy{Mode: ConfirmL1}, nil
+	case ConfirmDepth:
+		depth, err := strconv.Atoi(arg)
+		if err != nil || depth < 0 {
+			return ConfirmationPolicy{}, fmt.Errorf("invalid confirmation depth %q, expected depth:N with N >= 0", value)
+		}
+		return ConfirmationPolicy{Mode: ConfirmDepth, Depth: depth}, nil
+	default:
+		return ConfirmationPolicy{}, fmt.Errorf("unknown confirmation policy %q, expected immediate, depth:N or l1", value)
+	}
+}
+
+func (p ConfirmationPolicy) String() string {
+	if p.Mode == ConfirmDepth {
+		return fmt.Sprintf("%s:%d", p.Mode, p.Depth)
+	}
+	return string(p.Mode)
+}
+
+// safeHead returns the highest block at or below head that the policy allows
+// processing. fromBlock is the first block still to be processed and bounds
+// the search for the latest L1-accepted block from below.
+func (p *ConfirmationPolicy) safeHead(ctx context.Context, head, fromBlock int) (int, error) {
+	switch p.Mode {
+	case ConfirmDepth:
+		return head - p.Depth, nil
+	case ConfirmL1:
+		return p.latestL1Block(ctx, head, fromBlock)
+	default:
+		return head, nil
+	}
+}
+
+// latestL1Block binary-searches for the newest ACCEPTED_ON_L1 block. Statuses
+// are monotonic along the chain, so every block below an L1-accepted block is
+// L1-accepted too.
+func (p *ConfirmationPolicy) latestL1Block(ctx context.Context, head, fromBlock int) (int, error) {
+	// low is known to be accepted on L1 (or before the range we care about),
+	// high is the highest candidate still to be checked
+	low := max(p.lastL1Block, fromBlock-1)
+	high := head
+	for low < high {
+		mid := low + (high-low+1)/2
+		headers, err := getBlockHeaders(ctx, []int{mid})
+		if err != nil {
+			return 0, fmt.Errorf("failed to get status of block %d: %w", mid, err)
+		}
+		if headers[mid].Status == blockStatusAcceptedOnL1 {
+			low = mid
+		} else {
+			high = mid - 1
+		}
+	}
+
+	p.lastL1Block = max(p.lastL1Block, low)
+	return low, nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// spawnedBucket holds a SpawnRecord per event and rule, see dedupKey
+var spawnedBucket = []byte("spawned")
+
+// SpawnRecord is what the dedup store remembers about a Job it saw created.
+// One record stands for one event handed to one rule.
+type SpawnRecord struct {
+	EventID     string    `json:"event_id"`
+	Rule        string    `json:"rule"`
+	Namespace   string    `json:"namespace"`
+	BlockNumber int       `json:"block_number"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// DedupStore is a BoltDB file of the events that were handed to an agent,
+// consulted before creating a Job so every event spawns one agent per rule
+// across restarts, replays and backfills, even after its Job was cleaned up.
+// Kubernetes rejecting a second Job with the same name stays the last line of
+// defence while the Job exists.
+//
+// The file belongs to one replica, so exactly-once spawning only holds while a
+// single replica runs. A new leader elected with --leader-elect would not see
+// what the previous one recorded, which is why the two cannot be combined.
+//
+// A nil DedupStore, used when --dedup-db is not set, remembers nothing.
+type DedupStore struct {
+	db *bolt.DB
+
+	hits     atomic.Int64
+	recorded atomic.Int64
+	failures atomic.Int64
+}
+
+// openDedupStore opens or creates the store. BoltDB locks the file, so a
+// second process using it waits up to timeout and then fails.
+func openDedupStore(path string, timeout time.Duration) (*DedupStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: timeout})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open dedup store %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(spawnedBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize dedup store %s: %w", path, err)
+	}
+	return &DedupStore{db: db}, nil
+}
+
+// dedupKey identifies an event handed to a rule in the store. Unlike Job
+// names it is never shortened.
+func dedupKey(eventID, ruleName string) string {
+	return eventID + "/" + ruleName
+}
+
+// Lookup returns the record of a Job that was already created. A store that
+// cannot be read reports nothing, leaving duplicates to Kubernetes.
+func (d *DedupStore) Lookup(key string) (SpawnRecord, bool) {
+	if d == nil {
+		return SpawnRecord{}, false
+	}
+	var record SpawnRecord
+	var found bool
+	err := d.db.View(func(tx *bolt.Tx) error {
+		raw := tx.Bucket(spawnedBucket).Get([]byte(key))
+		if raw == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(raw, &record)
+	})
+	if err != nil {
+		d.failures.Add(1)
+		log.Errorf("Failed to look up %s in the dedup store: %v", key, err)
+		return SpawnRecord{}, false
+	}
+	if found {
+		d.hits.Add(1)
+	}
+	return record, found
+}
+
+// Record remembers that a Job was created. The write is synced to disk before
+// it returns.
+func (d *DedupStore) Record(key string, record SpawnRecord) {
+	if d == nil {
+		return
+	}
+	raw, err := json.Marshal(record)
+	if err == nil {
+		err = d.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(spawnedBucket).Put([]byte(key), raw)
+		})
+	}
+	if err != nil {
+		d.failures.Add(1)
+		log.Errorf("Failed to record %s in the dedup store: %v", key, err)
+		return
+	}
+	d.recorded.Add(1)
+}
+
+// Forget drops the record of a Job whose event was reverted by a reorg, so
+// the event can spawn again if it is included in the new chain
+func (d *DedupStore) Forget(key string) {
+	if d == nil {
+		return
+	}
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(spawnedBucket).Delete([]byte(key))
+	})
+	if err != nil {
+		d.failures.Add(1)
+		log.Errorf("Failed to forget %s in the dedup store: %v", key, err)
+	}
+}
+
+// Close releases the store's file lock
+func (d *DedupStore) Close() error {
+	if d == nil {
+		return nil
+	}
+	return d.db.Close()
+}
+
+// writeMetrics reports the store's size and how often it stopped a duplicate
+func (d *DedupStore) writeMetrics(w io.Writer) {
+	var records int
+	d.db.View(func(tx *bolt.Tx) error {
+		records = tx.Bucket(spawnedBucket).Stats().KeyN
+		return nil
+	})
+	writeMetric(w, "chairman_dedup_records", "gauge", "Agent Jobs remembered by the dedup store", float64(records))
+	writeMetric(w, "chairman_dedup_hits_total", "counter", "Events not spawned again because the dedup store had their Job", float64(d.hits.Load()))
+	writeMetric(w, "chairman_dedup_recorded_total", "counter", "Agent Jobs added to the dedup store", float64(d.recorded.Load()))
+	writeMetric(w, "chairman_dedup_failures_total", "counter", "Dedup store reads and writes that failed", float64(d.failures.Load()))
+}
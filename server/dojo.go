@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// Dojo world events the listener understands, named as in the world contract
+const (
+	DojoEventEmitted      = "EventEmitted"
+	DojoStoreSetRecord    = "StoreSetRecord"
+	DojoStoreUpdateRecord = "StoreUpdateRecord"
+	DojoStoreUpdateMember = "StoreUpdateMember"
+	DojoStoreDelRecord    = "StoreDelRecord"
+)
+
+// dojoEventKinds maps the first key of a world event to its name
+var dojoEventKinds = func() map[string]string {
+	kinds := make(map[string]string)
+	for _, kind := range []string{DojoEventEmitted, DojoStoreSetRecord, DojoStoreUpdateRecord, DojoStoreUpdateMember, DojoStoreDelRecord} {
+		kinds[starknetKeccak(kind)] = kind
+	}
+	return kinds
+}()
+
+// DojoEvent is a Dojo world event split into its documented parts
+type DojoEvent struct {
+	Kind string `json:"kind"`
+	// Selector of the Dojo event or model the event is about
+	Selector       string   `json:"selector"`
+	SystemAddress  string   `json:"system_address,omitempty"`  // EventEmitted
+	EntityID       string   `json:"entity_id,omitempty"`       // Store* events
+	MemberSelector string   `json:"member_selector,omitempty"` // StoreUpdateMember
+	Keys           []string `json:"keys,omitempty"`
+	Values         []string `json:"values,omitempty"`
+
+	// Filled in from the ABI when it describes the model or event
+	Tag    string                 `json:"tag,omitempty"`
+	Record map[string]interface{} `json:"record,omitempty"`
+}
+
+// parseDojoEvent splits a world event into its parts. It returns nil when the
+// event is not one of the world events the listener knows.
+//
+//	EventEmitted:      keys [kind, selector, system_address]            data [keys..., values...]
+//	StoreSetRecord:    keys [kind, selector, entity_id]                 data [keys..., values...]
+//	StoreUpdateRecord: keys [kind, selector, entity_id]                 data [values...]
+//	StoreUpdateMember: keys [kind, selector, entity_id, member_selector] data [values...]
+//	StoreDelRecord:    keys [kind, selector, entity_id]                 data []
+//
+// Spans in data are prefixed with their length.
+func parseDojoEvent(keys, data []string) (*DojoEvent, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	kind, ok := dojoEventKinds[normalizeFelt(keys[0])]
+	if !ok {
+		return nil, nil
+	}
+
+	wantKeys := 3
+	if kind == DojoStoreUpdateMember {
+		wantKeys = 4
+	}
+	if len(keys) != wantKeys {
+		return nil, fmt.Errorf("%s event has %d keys, expected %d", kind, len(keys), wantKeys)
+	}
+
+	event := &DojoEvent{Kind: kind, Selector: normalizeFelt(keys[1])}
+	r := &feltReader{felts: data}
+	var err error
+	switch kind {
+	case DojoEventEmitted:
+		event.SystemAddress = normalizeFelt(keys[2])
+		if event.Keys, err = r.nextSpan(); err == nil {
+			event.Values, err = r.nextSpan()
+		}
+	case DojoStoreSetRecord:
+		event.EntityID = normalizeFelt(keys[2])
+		if event.Keys, err = r.nextSpan(); err == nil {
+			event.Values, err = r.nextSpan()
+		}
+	case DojoStoreUpdateRecord:
+		event.EntityID = normalizeFelt(keys[2])
+		event.Values, err = r.nextSpan()
+	case DojoStoreUpdateMember:
+		event.EntityID = normalizeFelt(keys[2])
+		event.MemberSelector = normalizeFelt(keys[3])
+		event.Values, err = r.nextSpan()
+	case DojoStoreDelRecord:
+		event.EntityID = normalizeFelt(keys[2])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s event: %w", kind, err)
+	}
+	if r.remaining() > 0 {
+		return nil, fmt.Errorf("%s event has %d unexpected data felt(s)", kind, r.remaining())
+	}
+	return event, nil
+}
+
+// nextSpan reads a length-prefixed Span<felt252>
+func (r *feltReader) nextSpan() ([]string, error) {
+	length, err := r.next()
+	if err != nil {
+		return nil, err
+	}
+	if !length.IsInt64() || length.Sign() < 0 || length.Int64() > int64(r.remaining()) {
+		return nil, fmt.Errorf("invalid span length %s", length)
+	}
+	span := make([]string, 0, length.Int64())
+	for i := int64(0); i < length.Int64(); i++ {
+		felt, _ := r.next()
+		span = append(span, "0x"+felt.Text(16))
+	}
+	return span, nil
+}
+
+// parseDojoEventKinds validates a comma-separated list of world event names
+func parseDojoEventKinds(list string) (map[string]bool, error) {
+	kinds := make(map[string]bool)
+	for _, kind := range strings.Split(list, ",") {
+		kind = strings.TrimSpace(kind)
+		if kind == "" {
+			continue
+		}
+		if _, ok := dojoEventKinds[starknetKeccak(kind)]; !ok {
+			return nil, fmt.Errorf("unknown Dojo world event %q", kind)
+		}
+		kinds[kind] = true
+	}
+	if len(kinds) == 0 {
+		return nil, fmt.Errorf("no Dojo world events given")
+	}
+	return kinds, nil
+}
+
+// describeDojoEvent looks up the tag of the event's model or Dojo event in the
+// manifest and, when the ABI defines its struct, decodes the record. Dojo
+// requires key members to come first, so keys and values together follow the
+// struct's member order.
+func (a *ContractABI) describeDojoEvent(event *DojoEvent) error {
+	tag, ok := a.dojoTags[event.Selector]
+	if !ok {
+		return nil
+	}
+	event.Tag = tag
+
+	if event.Kind != DojoEventEmitted && event.Kind != DojoStoreSetRecord {
+		// Partial updates do not carry the keys the member order starts with
+		return nil
+	}
+	structName := a.dojoStructName(tag)
+	if structName == "" {
+		return nil
+	}
+
+	r := &feltReader{felts: append(append([]string{}, event.Keys...), event.Values...)}
+	record, err := a.decodeValue(structName, r)
+	if err != nil {
+		return fmt.Errorf("failed to decode %s as %s: %w", tag, structName, err)
+	}
+	if r.remaining() > 0 {
+		return fmt.Errorf("failed to decode %s as %s: %d felt(s) left over", tag, structName, r.remaining())
+	}
+	event.Record, _ = record.(map[string]interface{})
+	return nil
+}
+
+// dojoStructName finds the struct the ABI defines for a Dojo tag, preferring
+// one in the tag's namespace. It returns "" when there is none.
+func (a *ContractABI) dojoStructName(tag string) string {
+	namespace, name, _ := strings.Cut(tag, "-")
+	structName := ""
+	for candidate := range a.structs {
+		if shortTypeName(candidate) == name && (structName == "" || strings.HasPrefix(candidate, namespace+"::")) {
+			structName = candidate
+		}
+	}
+	return structName
+}
+
+// recordFieldNames lists the members of the record of the Dojo model or event
+// with the given selector, if the ABI defines it
+func (a *ContractABI) recordFieldNames(selector string) ([]string, bool) {
+	tag, ok := a.dojoTags[normalizeFelt(selector)]
+	if !ok {
+		return nil, false
+	}
+	structName := a.dojoStructName(tag)
+	if structName == "" {
+		return nil, false
+	}
+	return memberNames(a.structs[structName]), true
+}
+
+// resolveSelector turns a configured selector into a normalized felt and
+// reports whether it is the first key of plain Starknet events. It accepts a
+// hex felt, a Dojo tag ("namespace-Name") or a bare event name. Bare names are
+// looked up among the Dojo tags of the ABI, if one is loaded, and are
+// otherwise hashed with starknet_keccak like plain Starknet events. A loaded
+// ABI must define such an event, so a misspelt name fails instead of never
+// matching.
+func resolveSelector(spec string, abi *ContractABI) (string, bool, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return "", false, fmt.Errorf("empty selector")
+	}
+
+	if strings.HasPrefix(spec, "0x") || strings.HasPrefix(spec, "0X") {
+		selector := normalizeFelt(spec)
+		if _, ok := new(big.Int).SetString(strings.TrimPrefix(selector, "0x"), 16); !ok {
+			return "", false, fmt.Errorf("invalid hex selector %q", spec)
+		}
+		return selector, false, nil
+	}
+
+	if namespace, name, ok := strings.Cut(spec, "-"); ok {
+		return dojoSelector(namespace, name), false, nil
+	}
+
+	selector := starknetKeccak(spec)
+	if abi != nil {
+		var matches []string
+		for selector, tag := range abi.dojoTags {
+			if _, name, _ := strings.Cut(tag, "-"); name == spec {
+				matches = append(matches, selector)
+			}
+		}
+		if len(matches) > 1 {
+			return "", false, fmt.Errorf("%q names %d Dojo resources in different namespaces, use the namespace-Name tag", spec, len(matches))
+		}
+		if len(matches) == 1 {
+			return matches[0], false, nil
+		}
+		if !abi.hasEventSelector("", selector) {
+			return "", false, fmt.Errorf("%q is neither a Dojo model or event nor an event in the ABI", spec)
+		}
+	}
+	return selector, true, nil
+}
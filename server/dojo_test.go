@@ -0,0 +1,87 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestResolveSelector(t *testing.T) {
+	abi, err := loadContractABI("../abi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	army := "0x34cab5fd09c4f5f5b8624e52c883afec2462c2fc2e7227121f70de648e68dcc"
+	tests := []struct {
+		spec  string
+		abi   *ContractABI
+		want  string
+		plain bool
+		err   bool
+	}{
+		{spec: "0x034CAB5FD09C4F5F5B8624E52C883AFEC2462C2FC2E7227121F70DE648E68DCC", want: army},
+		{spec: "0xnothex", err: true},
+		{spec: " ", err: true},
+		{spec: "s0_eternum-Army", want: army},
+		{spec: "s0_eternum-Army", abi: abi, want: army},
+		// Bare names are Dojo resources when the ABI knows them
+		{spec: "Army", abi: abi, want: army},
+		// and plain events otherwise
+		{spec: "UpgradeableEvent", abi: abi, want: starknetKeccak("UpgradeableEvent"), plain: true},
+		{spec: "AgentCreatedEvent", want: starknetKeccak("AgentCreatedEvent"), plain: true},
+		{spec: "AgentCreatedEvent", abi: abi, err: true},
+	}
+	for _, test := range tests {
+		got, plain, err := resolveSelector(test.spec, test.abi)
+		if test.err {
+			if err == nil {
+				t.Errorf("resolveSelector(%q) = %s, want an error", test.spec, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("resolveSelector(%q) failed: %v", test.spec, err)
+			continue
+		}
+		if !sameFelt(got, test.want) || plain != test.plain {
+			t.Errorf("resolveSelector(%q) = %s, %t, want %s, %t", test.spec, got, plain, test.want, test.plain)
+		}
+	}
+}
+
+func TestParseDojoEvent(t *testing.T) {
+	model := "0x2a33e6e963e8f80fb8f00a69a8b55ec9834adda81bbb305024500c4b4356e24"
+	setRecord := starknetKeccak(DojoStoreSetRecord)
+	tests := []struct {
+		keys []string
+		data []string
+		want *DojoEvent
+		err  bool
+	}{
+		{keys: []string{"0x1"}, want: nil},
+		{keys: []string{setRecord, model, "0x55"}, data: []string{"0x1", "0x7", "0x2", "0x5", "0x6"},
+			want: &DojoEvent{Kind: DojoStoreSetRecord, Selector: model, EntityID: "0x55", Keys: []string{"0x7"}, Values: []string{"0x5", "0x6"}}},
+		{keys: []string{starknetKeccak(DojoStoreDelRecord), model, "0x55"}, want: &DojoEvent{Kind: DojoStoreDelRecord, Selector: model, EntityID: "0x55"}},
+		{keys: []string{setRecord, model}, data: []string{"0x0", "0x0"}, err: true},
+		{keys: []string{setRecord, model, "0x55"}, data: []string{"0x0", "0x0", "0x1"}, err: true},
+		// Span lengths beyond the data or below zero
+		{keys: []string{setRecord, model, "0x55"}, data: []string{"0x5", "0x7"}, err: true},
+		{keys: []string{setRecord, model, "0x55"}, data: []string{"0x-1", "0x0"}, err: true},
+		{keys: []string{starknetKeccak(DojoStoreUpdateRecord), model, "0x55"}, data: []string{"0xffffffffffffffffffff"}, err: true},
+	}
+	for _, test := range tests {
+		got, err := parseDojoEvent(test.keys, test.data)
+		if test.err {
+			if err == nil {
+				t.Errorf("parseDojoEvent(%v, %v) = %+v, want an error", test.keys, test.data, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseDojoEvent(%v, %v) failed: %v", test.keys, test.data, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseDojoEvent(%v, %v) = %+v, want %+v", test.keys, test.data, got, test.want)
+		}
+	}
+}
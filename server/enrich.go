@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// TransactionInfo is what the listener looks up about the transaction and
+// block of a matched event when --enrich is set. Agents get it as EVENT_TX_JSON.
+type TransactionInfo struct {
+	BlockTimestamp  int64       `json:"block_timestamp"`
+	SenderAddress   string      `json:"sender_address,omitempty"`
+	ExecutionStatus string      `json:"execution_status"`
+	RevertReason    string      `json:"revert_reason,omitempty"`
+	ActualFee       *FeePayment `json:"actual_fee,omitempty"`
+}
+
+// FeePayment is FEE_PAYMENT as defined by spec v0.6 to v0.8
+type FeePayment struct {
+	Amount string `json:"amount"`
+	Unit   string `json:"unit"`
+}
+
+// transactionReceipt holds the receipt fields the listener passes on
+type transactionReceipt struct {
+	TransactionHash string      `json:"transaction_hash"`
+	ActualFee       *FeePayment `json:"actual_fee"`
+	ExecutionStatus string      `json:"execution_status"`
+	RevertReason    string      `json:"revert_reason,omitempty"`
+}
+
+// blockTransaction holds the transaction fields the listener passes on. Only
+// invoke and declare transactions have a sender.
+type blockTransaction struct {
+	TransactionHash string `json:"transaction_hash"`
+	SenderAddress   string `json:"sender_address"`
+}
+
+// blockInfo is what is known about one block: its timestamp, the senders of
+// its transactions and the receipts fetched so far
+type blockInfo struct {
+	hash      string
+	timestamp int64
+	senders   map[string]string
+	receipts  map[string]transactionReceipt
+}
+
+// TransactionEnricher looks up the block and receipt of matched events and
+// caches them per block, so events of the same block or transaction share one
+// lookup. Nodes with spec v0.7 or newer return a block with all its receipts
+// in one call; older ones are asked for each transaction's receipt.
+type TransactionEnricher struct {
+	// Number of most recent blocks kept
+	limit int
+
+	mu     sync.Mutex
+	blocks map[int]*blockInfo
+
+	blockFetches   atomic.Int64
+	receiptFetches atomic.Int64
+	cacheHits      atomic.Int64
+	failures       atomic.Int64
+}
+
+func newTransactionEnricher(limit int) *TransactionEnricher {
+	return &TransactionEnricher{limit: max(limit, 1), blocks: make(map[int]*blockInfo)}
+}
+
+// Lookup returns the block timestamp and the sender, execution status and fee
+// of an event's transaction
+func (e *TransactionEnricher) Lookup(ctx context.Context, event StarknetEvent) (*TransactionInfo, error) {
+	block, err := e.block(ctx, event.BlockNumber, event.BlockHash)
+	if err != nil {
+		e.failures.Add(1)
+		return nil, err
+	}
+	receipt, err := e.receipt(ctx, block, event.TransactionHash)
+	if err != nil {
+		e.failures.Add(1)
+		return nil, err
+	}
+	return &TransactionInfo{
+		BlockTimestamp:  block.timestamp,
+		SenderAddress:   block.senders[normalizeFelt(event.TransactionHash)],
+		ExecutionStatus: receipt.ExecutionStatus,
+		RevertReason:    receipt.RevertReason,
+		ActualFee:       receipt.ActualFee,
+	}, nil
+}
+
+// block returns a block from the cache or the node. A cached block with a
+// different hash was reorged away and is fetched again.
+func (e *TransactionEnricher) block(ctx context.Context, blockNumber int, blockHash string) (*blockInfo, error) {
+	e.mu.Lock()
+	block, ok := e.blocks[blockNumber]
+	e.mu.Unlock()
+	if ok && (blockHash == "" || normalizeFelt(block.hash) == normalizeFelt(blockHash)) {
+		e.cacheHits.Add(1)
+		return block, nil
+	}
+
+	block, err := fetchBlockInfo(ctx, blockNumber)
+	if err != nil {
+		return nil, err
+	}
+	e.blockFetches.Add(1)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.blocks[blockNumber] = block
+	if len(e.blocks) > e.limit {
+		// Drop the oldest blocks; events arrive roughly in block order
+		numbers := make([]int, 0, len(e.blocks))
+		for number := range e.blocks {
+			numbers = append(numbers, number)
+		}
+		sort.Ints(numbers)
+		for _, number := range numbers[:len(numbers)-e.limit] {
+			delete(e.blocks, number)
+		}
+	}
+	return block, nil
+}
+
+// receipt returns a transaction's receipt from its block, fetching it from
+// the node when the block was loaded without receipts
+func (e *TransactionEnricher) receipt(ctx context.Context, block *blockInfo, transactionHash string) (transactionReceipt, error) {
+	key := normalizeFelt(transactionHash)
+	e.mu.Lock()
+	receipt, ok := block.receipts[key]
+	e.mu.Unlock()
+	if ok {
+		return receipt, nil
+	}
+
+	response, err := callStarknetRPC(ctx, "starknet_getTransactionReceipt", []interface{}{transactionHash})
+	if err != nil {
+		return transactionReceipt{}, fmt.Errorf("failed to get receipt of %s: %w", transactionHash, err)
+	}
+	if err := json.Unmarshal(response.Result, &receipt); err != nil {
+		return transactionReceipt{}, fmt.Errorf("failed to unmarshal receipt of %s: %v", transactionHash, err)
+	}
+	e.receiptFetches.Add(1)
+
+	e.mu.Lock()
+	block.receipts[key] = receipt
+	e.mu.Unlock()
+	return receipt, nil
+}
+
+// fetchBlockInfo loads a block with starknet_getBlockWithReceipts where the
+// node supports it, and with starknet_getBlockWithTxs otherwise
+func fetchBlockInfo(ctx context.Context, blockNumber int) (*blockInfo, error) {
+	method := "starknet_getBlockWithTxs"
+	if rpcSpec.BlockWithReceipts {
+		method = "starknet_getBlockWithReceipts"
+	}
+	response, err := callStarknetRPC(ctx, method, []interface{}{blockID(blockNumber)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get block %d: %w", blockNumber, err)
+	}
+
+	// Transactions are plain transactions for starknet_getBlockWithTxs and
+	// transaction and receipt pairs for starknet_getBlockWithReceipts
+	var result struct {
+		BlockHash    string `json:"block_hash"`
+		Timestamp    int64  `json:"timestamp"`
+		Transactions []struct {
+			blockTransaction
+			Transaction *blockTransaction   `json:"transaction"`
+			Receipt     *transactionReceipt `json:"receipt"`
+		} `json:"transactions"`
+	}
+	if err := json.Unmarshal(response.Result, &result); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal block %d: %v", blockNumber, err)
+	}
+
+	block := &blockInfo{
+		hash:      result.BlockHash,
+		timestamp: result.Timestamp,
+		senders:   make(map[string]string, len(result.Transactions)),
+		receipts:  make(map[string]transactionReceipt),
+	}
+	for _, tx := range result.Transactions {
+		transaction := tx.blockTransaction
+		if tx.Transaction != nil {
+			transaction = *tx.Transaction
+		}
+		hash := transaction.TransactionHash
+		if tx.Receipt != nil {
+			// Transactions inside a block with receipts carry no hash of their own
+			hash = tx.Receipt.TransactionHash
+			block.receipts[normalizeFelt(hash)] = *tx.Receipt
+		}
+		if transaction.SenderAddress != "" {
+			block.senders[normalizeFelt(hash)] = transaction.SenderAddress
+		}
+	}
+	return block, nil
+}
+
+// environment flattens the lookup into variables for the agent
+func (t *TransactionInfo) environment() map[string]string {
+	env := map[string]string{
+		"BLOCK_TIMESTAMP":              strconv.FormatInt(t.BlockTimestamp, 10),
+		"TRANSACTION_EXECUTION_STATUS": t.ExecutionStatus,
+	}
+	if t.SenderAddress != "" {
+		env["TRANSACTION_SENDER"] = t.SenderAddress
+	}
+	if t.ActualFee != nil {
+		env["TRANSACTION_FEE"] = t.ActualFee.Amount
+		env["TRANSACTION_FEE_UNIT"] = t.ActualFee.Unit
+	}
+	return env
+}
+
+// writeMetrics reports how often lookups were served from the cache
+func (e *TransactionEnricher) writeMetrics(w io.Writer) {
+	writeMetric(w, "chairman_enrichment_block_fetches_total", "counter", "Blocks fetched to enrich matched events", float64(e.blockFetches.Load()))
+	writeMetric(w, "chairman_enrichment_receipt_fetches_total", "counter", "Transaction receipts fetched one by one to enrich matched events", float64(e.receiptFetches.Load()))
+	writeMetric(w, "chairman_enrichment_cache_hits_total", "counter", "Matched events enriched from an already fetched block", float64(e.cacheHits.Load()))
+	writeMetric(w, "chairman_enrichment_failures_total", "counter", "Matched events passed on without enrichment because a lookup failed", float64(e.failures.Load()))
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// receiptEvent is EVENT as listed in a transaction receipt
+type receiptEvent struct {
+	FromAddress string   `json:"from_address"`
+	Keys        []string `json:"keys"`
+	Data        []string `json:"data"`
+}
+
+// matches reports whether a receipt event is the emitted event
+func (r receiptEvent) matches(event StarknetEvent) bool {
+	if !sameFelt(r.FromAddress, event.FromAddress) || len(r.Keys) != len(event.Keys) || len(r.Data) != len(event.Data) {
+		return false
+	}
+	for i := range r.Keys {
+		if !sameFelt(r.Keys[i], event.Keys[i]) {
+			return false
+		}
+	}
+	for i := range r.Data {
+		if !sameFelt(r.Data[i], event.Data[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// EventIndexer finds the position of events among all events their
+// transaction emitted, which event IDs include so that every event of a
+// multicall gets its own ID. Emitted events do not carry it, so it is read from
+// the transaction receipts, which are cached for the events of a transaction
+// that arrive one by one.
+type EventIndexer struct {
+	limit int
+
+	mu       sync.Mutex
+	receipts map[string][]receiptEvent
+	// Cached transaction hashes, oldest first
+	order []string
+
+	fetches  atomic.Int64
+	failures atomic.Int64
+}
+
+var eventIndexes = newEventIndexer(256)
+
+func newEventIndexer(limit int) *EventIndexer {
+	return &EventIndexer{limit: max(limit, 1), receipts: make(map[string][]receiptEvent)}
+}
+
+// resolve sets the EventIndex of events that have none (-1). Events must be in
+// the order they were emitted, so identical events of one transaction get
+// successive positions. taken, which may be nil, reports positions an earlier
+// delivery of the event already got; events whose positions are all taken
+// keep -1.
+func (x *EventIndexer) resolve(ctx context.Context, events []StarknetEvent, taken func(StarknetEvent) bool) error {
+	receipts := make(map[string][]receiptEvent)
+	var missing []string
+	x.mu.Lock()
+	for _, event := range events {
+		if event.EventIndex >= 0 {
+			continue
+		}
+		hash := normalizeFelt(event.TransactionHash)
+		if receipt, ok := x.receipts[hash]; ok {
+			receipts[hash] = receipt
+		} else if !slices.Contains(missing, hash) {
+			missing = append(missing, hash)
+		}
+	}
+	x.mu.Unlock()
+	if err := x.fetch(ctx, missing, receipts); err != nil {
+		x.failures.Add(1)
+		return err
+	}
+
+	used := make(map[string]map[int]bool)
+	for i := range events {
+		event := &events[i]
+		if event.EventIndex >= 0 {
+			continue
+		}
+		hash := normalizeFelt(event.TransactionHash)
+		receipt := receipts[hash]
+		if used[hash] == nil {
+			used[hash] = make(map[int]bool)
+		}
+		for position, emitted := range receipt {
+			if used[hash][position] || !emitted.matches(*event) {
+				continue
+			}
+			candidate := *event
+			candidate.EventIndex = position
+			if taken != nil && taken(candidate) {
+				continue
+			}
+			used[hash][position] = true
+			event.EventIndex = position
+			break
+		}
+		if event.EventIndex < 0 && !containsEvent(receipt, *event) {
+			x.failures.Add(1)
+			return fmt.Errorf("event of transaction %s in block %d is not in its receipt", event.TransactionHash, event.BlockNumber)
+		}
+	}
+	return nil
+}
+
+// fetch loads the receipts of transactions in one batch request, adding their
+// events to receipts and the cache
+func (x *EventIndexer) fetch(ctx context.Context, hashes []string, receipts map[string][]receiptEvent) error {
+	if len(hashes) == 0 {
+		return nil
+	}
+	calls := make([]StarknetRPCCall, len(hashes))
+	for i, hash := range hashes {
+		calls[i] = StarknetRPCCall{Method: "starknet_getTransactionReceipt", Params: []interface{}{hash}}
+	}
+	responses, err := callStarknetRPCBatch(ctx, calls)
+	if err != nil {
+		return fmt.Errorf("failed to get receipts to number events: %w", err)
+	}
+	x.fetches.Add(int64(len(hashes)))
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for i, response := range responses {
+		if response.Error != nil {
+			return fmt.Errorf("failed to get receipt of %s: %w", hashes[i], response.Error)
+		}
+		var receipt struct {
+			Events []receiptEvent `json:"events"`
+		}
+		if err := json.Unmarshal(response.Result, &receipt); err != nil {
+			return fmt.Errorf("failed to unmarshal receipt of %s: %v", hashes[i], err)
+		}
+		if _, ok := x.receipts[hashes[i]]; !ok {
+			x.order = append(x.order, hashes[i])
+		}
+		x.receipts[hashes[i]] = receipt.Events
+		receipts[hashes[i]] = receipt.Events
+	}
+	for len(x.order) > x.limit {
+		delete(x.receipts, x.order[0])
+		x.order = x.order[1:]
+	}
+	return nil
+}
+
+// writeMetrics reports how many receipts were needed to number events
+func (x *EventIndexer) writeMetrics(w io.Writer) {
+	writeMetric(w, "chairman_event_index_receipt_fetches_total", "counter", "Transaction receipts fetched to find the position of events in their transaction", float64(x.fetches.Load()))
+	writeMetric(w, "chairman_event_index_failures_total", "counter", "Times events could not be numbered because their receipts could not be read", float64(x.failures.Load()))
+}
+
+func containsEvent(receipt []receiptEvent, event StarknetEvent) bool {
+	for _, emitted := range receipt {
+		if emitted.matches(event) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"math/big"
+	"strings"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// feltMask250 keeps the low 250 bits of a Keccak hash, as Starknet selectors do
+var feltMask250 = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 250), big.NewInt(1))
+
+// normalizeFelt returns the canonical form of a felt given as a hex string:
+// lower case, 0x-prefixed and without leading zeros. Values that do not parse
+// are returned lower-cased so comparisons still behave predictably.
+func normalizeFelt(value string) string {
+	trimmed := strings.TrimSpace(value)
+	digits := strings.TrimPrefix(strings.TrimPrefix(trimmed, "0x"), "0X")
+	n, ok := new(big.Int).SetString(digits, 16)
+	if !ok || digits == "" {
+		return strings.ToLower(trimmed)
+	}
+	return "0x" + n.Text(16)
+}
+
+// sameFelt reports whether two hex felts have the same numeric value
+func sameFelt(a, b string) bool {
+	return normalizeFelt(a) == normalizeFelt(b)
+}
+
+// starknetKeccak returns the Starknet selector of a name: its Keccak-256 hash
+// truncated to 250 bits, as a normalized felt
+func starknetKeccak(name string) string {
+	hash := sha3.NewLegacyKeccak256()
+	hash.Write([]byte(name))
+	n := new(big.Int).SetBytes(hash.Sum(nil))
+	return "0x" + n.And(n, feltMask250).Text(16)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ChainHead is the latest accepted block as last seen by the head tracker
+type ChainHead struct {
+	BlockNumber int       `json:"block_number"`
+	BlockHash   string    `json:"block_hash,omitempty"`
+	ObservedAt  time.Time `json:"observed_at"`
+}
+
+// HeadTracker follows the chain head with starknet_blockHashAndNumber and
+// caches it, so the listeners, the confirmation policy and the API share one
+// cheap lookup instead of each fetching the latest block.
+type HeadTracker struct {
+	// How long a cached head is served before it is refreshed
+	maxAge time.Duration
+
+	// Serialises refreshes so concurrent callers share one RPC call
+	refreshMu sync.Mutex
+
+	mu   sync.Mutex
+	head ChainHead
+	// Last block each listener fully processed, by watch group
+	processed map[string]int
+	// Set once the node turned out not to support starknet_blockHashAndNumber
+	numberOnly bool
+}
+
+func newHeadTracker(maxAge time.Duration) *HeadTracker {
+	return &HeadTracker{maxAge: maxAge, processed: make(map[string]int)}
+}
+
+// Latest returns the chain head, refreshing it from the node when the cached
+// one is older than the tracker's max age
+func (t *HeadTracker) Latest(ctx context.Context) (ChainHead, error) {
+	t.refreshMu.Lock()
+	defer t.refreshMu.Unlock()
+
+	if head, ok := t.cached(); ok {
+		return head, nil
+	}
+
+	head, err := t.fetch(ctx)
+	if err != nil {
+		return ChainHead{}, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.observe(head)
+	return t.head, nil
+}
+
+// cached returns the cached head if it is still fresh
+func (t *HeadTracker) cached() (ChainHead, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fresh := !t.head.ObservedAt.IsZero() && time.Since(t.head.ObservedAt) < t.maxAge
+	return t.head, fresh
+}
+
+// fetch asks the node for the head, falling back to starknet_blockNumber for
+// nodes that do not implement starknet_blockHashAndNumber. Callers hold t.refreshMu.
+func (t *HeadTracker) fetch(ctx context.Context) (ChainHead, error) {
+	if !t.numberOnly {
+		response, err := callStarknetRPC(ctx, "starknet_blockHashAndNumber", []interface{}{})
+		var rpcErr *RPCError
+		if errors.As(err, &rpcErr) && rpcErr.Code == -32601 {
+			log.Warnf("Node does not support starknet_blockHashAndNumber, tracking the head with starknet_blockNumber")
+			t.numberOnly = true
+		} else if err != nil {
+			return ChainHead{}, fmt.Errorf("failed to get chain head: %w", err)
+		} else {
+			var head ChainHead
+			if err := json.Unmarshal(response.Result, &head); err != nil {
+				return ChainHead{}, fmt.Errorf("failed to unmarshal chain head: %v", err)
+			}
+			head.ObservedAt = time.Now()
+			return head, nil
+		}
+	}
+
+	response, err := callStarknetRPC(ctx, "starknet_blockNumber", []interface{}{})
+	if err != nil {
+		return ChainHead{}, fmt.Errorf("failed to get latest block number: %w", err)
+	}
+	var head ChainHead
+	if err := json.Unmarshal(response.Result, &head.BlockNumber); err != nil {
+		return ChainHead{}, fmt.Errorf("failed to unmarshal latest block number: %v", err)
+	}
+	head.ObservedAt = time.Now()
+	return head, nil
+}
+
+// observe stores a head unless it is older than the cached one. Callers hold t.mu.
+func (t *HeadTracker) observe(head ChainHead) {
+	if head.BlockNumber < t.head.BlockNumber && time.Since(t.head.ObservedAt) < t.maxAge {
+		// A lagging endpoint answered; keep the newer head until it expires
+		return
+	}
+	t.head = head
+}
+
+// Observe records a head learned elsewhere, such as a new heads subscription,
+// so it is served without another RPC call
+func (t *HeadTracker) Observe(blockNumber int, blockHash string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.observe(ChainHead{BlockNumber: blockNumber, BlockHash: blockHash, ObservedAt: time.Now()})
+}
+
+// RecordProcessed records the last block a watch group's listener fully
+// processed. The group furthest behind, together with the head, gives the
+// listener's lag.
+func (t *HeadTracker) RecordProcessed(group string, blockNumber int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.processed[group] = blockNumber
+}
+
+// ForgetProcessed stops counting a watch group that is no longer scanned
+func (t *HeadTracker) ForgetProcessed(group string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.processed, group)
+}
+
+// Processed returns the last block each watch group's listener fully processed
+func (t *HeadTracker) Processed() map[string]int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	processed := make(map[string]int, len(t.processed))
+	for group, blockNumber := range t.processed {
+		processed[group] = blockNumber
+	}
+	return processed
+}
+
+// HeadStatus is the externally visible state of the head tracker
+type HeadStatus struct {
+	Head           ChainHead `json:"head"`
+	ProcessedBlock *int      `json:"processed_block,omitempty"`
+	LagBlocks      *int      `json:"lag_blocks,omitempty"`
+}
+
+// Status returns the cached head and the listener's lag behind it, without
+// calling the node
+func (t *HeadTracker) Status() HeadStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	status := HeadStatus{Head: t.head}
+	if len(t.processed) > 0 {
+		processed, first := 0, true
+		for _, blockNumber := range t.processed {
+			if first || blockNumber < processed {
+				processed, first = blockNumber, false
+			}
+		}
+		lag := max(t.head.BlockNumber-processed, 0)
+		status.ProcessedBlock = &processed
+		status.LagBlocks = &lag
+	}
+	return status
+}
+
+// writeMetrics reports the head, the processed block and the lag between them
+func (t *HeadTracker) writeMetrics(w io.Writer) {
+	status := t.Status()
+	if status.Head.ObservedAt.IsZero() {
+		return
+	}
+	writeMetric(w, "chairman_chain_head_block", "gauge", "Latest block number reported by the Starknet node", float64(status.Head.BlockNumber))
+	writeMetric(w, "chairman_chain_head_age_seconds", "gauge", "Seconds since the chain head was last refreshed", time.Since(status.Head.ObservedAt).Seconds())
+	if status.LagBlocks != nil {
+		writeMetric(w, "chairman_processed_block", "gauge", "Last block the event listener fully processed", float64(*status.ProcessedBlock))
+		writeMetric(w, "chairman_head_lag_blocks", "gauge", "Number of blocks the event listener is behind the chain head", float64(*status.LagBlocks))
+	}
+}
+
+func getChainHead(c *gin.Context) {
+	c.JSON(http.StatusOK, headTracker.Status())
+}
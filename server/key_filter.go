@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// eventKeysFilter builds the starknet_getEvents keys filter for a group's
+// selectors. Dojo model and event selectors are the second key of the enabled
+// world events, plain event selectors the first key of their events. The two
+// cannot be expressed in one filter, so a group mixing them is filtered
+// client-side and gets an error.
+func eventKeysFilter(dojoSelectors, eventSelectors []string) ([][]string, error) {
+	if len(dojoSelectors) > 0 && len(eventSelectors) > 0 {
+		return nil, fmt.Errorf("Dojo selectors %v and event selectors %v cannot share one keys filter", dojoSelectors, eventSelectors)
+	}
+	if len(eventSelectors) > 0 {
+		return [][]string{normalizeFelts(eventSelectors)}, nil
+	}
+	if len(dojoSelectors) == 0 {
+		return nil, nil
+	}
+
+	var kinds []string
+	for selector, kind := range dojoEventKinds {
+		if enabledDojoEvents[kind] {
+			kinds = append(kinds, selector)
+		}
+	}
+	sort.Strings(kinds)
+	return [][]string{kinds, normalizeFelts(dojoSelectors)}, nil
+}
+
+func normalizeFelts(felts []string) []string {
+	normalized := make([]string, 0, len(felts))
+	for _, felt := range felts {
+		normalized = append(normalized, normalizeFelt(felt))
+	}
+	return normalized
+}
+
+// eventTrafficStats counts what the listener downloads and throws away, to
+// show how well the keys filter pushes filtering down to the node
+type eventTrafficStats struct {
+	pages     atomic.Int64
+	events    atomic.Int64
+	bytes     atomic.Int64
+	discarded atomic.Int64
+
+	mu sync.Mutex
+	// Outcome of the last comparison against an unfiltered query
+	lastProbe   *keyFilterProbe
+	lastProbeAt time.Time
+}
+
+// keyFilterProbe compares one block range fetched with and without the keys filter
+type keyFilterProbe struct {
+	FromBlock        int
+	ToBlock          int
+	FilteredEvents   int
+	FilteredBytes    int
+	UnfilteredEvents int
+	UnfilteredBytes  int
+}
+
+// savedRatio is the share of response bytes the keys filter avoided
+func (p *keyFilterProbe) savedRatio() float64 {
+	if p.UnfilteredBytes == 0 {
+		return 0
+	}
+	return 1 - float64(p.FilteredBytes)/float64(p.UnfilteredBytes)
+}
+
+var eventTraffic = &eventTrafficStats{}
+
+// record counts a fetched block range
+func (t *eventTrafficStats) record(stats EventPageStats) {
+	t.pages.Add(int64(stats.Pages))
+	t.events.Add(int64(stats.Events))
+	t.bytes.Add(int64(stats.Bytes))
+}
+
+// probeDue reports whether it is time to measure the keys filter again
+func (t *eventTrafficStats) probeDue() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return *keyFilterProbeInterval > 0 && time.Since(t.lastProbeAt) >= *keyFilterProbeInterval
+}
+
+// probeKeyFilter fetches a range that was just scanned with the keys filter a
+// second time without it, only counting the events and bytes, and reports how
+// much traffic the filter saved on that range
+func (s *blockScanner) probeKeyFilter(ctx context.Context, fromBlock, toBlock int, filtered EventPageStats) {
+	eventTraffic.mu.Lock()
+	eventTraffic.lastProbeAt = time.Now()
+	eventTraffic.mu.Unlock()
+
+	unfiltered := StarknetEventFilter(s.filter)
+	unfiltered.Keys = nil
+	unfiltered.FromBlock = blockID(fromBlock)
+	unfiltered.ToBlock = blockID(toBlock)
+
+	results, err := getEventsBatch(ctx, s.config, []StarknetEventFilter{unfiltered})
+	if err == nil {
+		err = results[0].Err
+	}
+	if err != nil {
+		log.Warnf("Failed to measure keys filter savings on blocks %d to %d: %v", fromBlock, toBlock, err)
+		return
+	}
+
+	probe := &keyFilterProbe{
+		FromBlock:        fromBlock,
+		ToBlock:          toBlock,
+		FilteredEvents:   filtered.Events,
+		FilteredBytes:    filtered.Bytes,
+		UnfilteredEvents: results[0].Stats.Events,
+		UnfilteredBytes:  results[0].Stats.Bytes,
+	}
+	eventTraffic.mu.Lock()
+	eventTraffic.lastProbe = probe
+	eventTraffic.mu.Unlock()
+
+	log.Infof("Keys filter saved %.1f%% of event traffic on blocks %d to %d: %d event(s) in %d bytes instead of %d event(s) in %d bytes",
+		100*probe.savedRatio(), fromBlock, toBlock, probe.FilteredEvents, probe.FilteredBytes, probe.UnfilteredEvents, probe.UnfilteredBytes)
+}
+
+// writeMetrics reports the event traffic counters and the last keys filter probe
+func (t *eventTrafficStats) writeMetrics(w io.Writer) {
+	writeMetric(w, "chairman_event_pages_fetched_total", "counter", "starknet_getEvents pages fetched", float64(t.pages.Load()))
+	writeMetric(w, "chairman_events_fetched_total", "counter", "Events downloaded from the Starknet node", float64(t.events.Load()))
+	writeMetric(w, "chairman_event_bytes_fetched_total", "counter", "Bytes of starknet_getEvents results downloaded", float64(t.bytes.Load()))
+	writeMetric(w, "chairman_events_discarded_total", "counter", "Downloaded events discarded by client-side filtering", float64(t.discarded.Load()))
+
+	t.mu.Lock()
+	probe := t.lastProbe
+	t.mu.Unlock()
+	if probe != nil {
+		writeMetric(w, "chairman_key_filter_saved_ratio", "gauge", "Share of event traffic the keys filter saved in the last probe", probe.savedRatio())
+		writeMetric(w, "chairman_key_filter_probe_filtered_bytes", "gauge", "Bytes fetched with the keys filter in the last probe", float64(probe.FilteredBytes))
+		writeMetric(w, "chairman_key_filter_probe_unfiltered_bytes", "gauge", "Bytes fetched without the keys filter in the last probe", float64(probe.UnfilteredBytes))
+	}
+}
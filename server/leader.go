@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// LeaderElection runs the event listener on one replica at a time. Replicas
+// compete for a coordination.k8s.io Lease; the holder runs the listener and
+// all of them serve the HTTP API.
+type LeaderElection struct {
+	identity  string
+	namespace string
+	name      string
+	elector   *leaderelection.LeaderElector
+
+	mu           sync.Mutex
+	leadingSince time.Time
+}
+
+// LeaderStatus is the externally visible state of leader election
+type LeaderStatus struct {
+	Enabled      bool       `json:"enabled"`
+	Identity     string     `json:"identity"`
+	Lease        string     `json:"lease,omitempty"`
+	Leader       string     `json:"leader"`
+	IsLeader     bool       `json:"is_leader"`
+	LeadingSince *time.Time `json:"leading_since,omitempty"`
+}
+
+// newLeaderElection prepares leader election on the Lease named by
+// --leader-elect-lease ([namespace/]name) for a server that runs until ctx is
+// done. lead is called when this replica becomes the leader. Losing the Lease
+// is fatal only while ctx is live; once the server shuts down, it is released
+// or lost while shutdown finishes.
+func newLeaderElection(ctx context.Context, lead func(ctx context.Context)) (*LeaderElection, error) {
+	identity, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine the replica's identity: %v", err)
+	}
+	election := &LeaderElection{identity: identity, namespace: *namespace, name: *leaderElectLease}
+	if leaseNamespace, name, ok := strings.Cut(*leaderElectLease, "/"); ok {
+		election.namespace, election.name = leaseNamespace, name
+	}
+
+	election.elector, err = leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta:  metav1.ObjectMeta{Namespace: election.namespace, Name: election.name},
+			Client:     kubernetesClientset.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+		},
+		LeaseDuration: *leaderElectLeaseDuration,
+		RenewDeadline: *leaderElectRenewDeadline,
+		RetryPeriod:   *leaderElectRetryPeriod,
+		// Hand the Lease over right away when the server stops instead of
+		// letting the other replicas wait for it to expire
+		ReleaseOnCancel: true,
+		Name:            "chairman-server",
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				log.Infof("Became the leader of Lease %s/%s, starting the event listener", election.namespace, election.name)
+				election.mu.Lock()
+				election.leadingSince = time.Now().UTC()
+				election.mu.Unlock()
+				lead(ctx)
+			},
+			OnStoppedLeading: func() {
+				election.mu.Lock()
+				wasLeading := !election.leadingSince.IsZero()
+				election.leadingSince = time.Time{}
+				election.mu.Unlock()
+				if !wasLeading {
+					return
+				}
+				if ctx.Err() != nil {
+					log.Infof("Stopped leading Lease %s/%s while shutting down", election.namespace, election.name)
+					return
+				}
+				// The listener cannot be stopped mid-batch safely, so a replica that
+				// lost the Lease restarts as a follower rather than risk spawning
+				// alongside the new leader
+				log.Fatalf("Lost the leadership of Lease %s/%s, exiting", election.namespace, election.name)
+			},
+			OnNewLeader: func(leader string) {
+				if leader != identity {
+					log.Infof("Replica %s leads Lease %s/%s and runs the event listener", leader, election.namespace, election.name)
+				}
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid leader election settings: %v", err)
+	}
+	return election, nil
+}
+
+// run competes for the Lease and, once it holds it, renews it until ctx is done
+func (e *LeaderElection) run(ctx context.Context) {
+	log.Infof("Waiting to become the leader of Lease %s/%s as %s", e.namespace, e.name, e.identity)
+	e.elector.Run(ctx)
+}
+
+// Status reports who leads. Without leader election every replica is its own leader.
+func (e *LeaderElection) Status() LeaderStatus {
+	if e == nil {
+		hostname, _ := os.Hostname()
+		return LeaderStatus{Identity: hostname, Leader: hostname, IsLeader: true}
+	}
+	status := LeaderStatus{
+		Enabled:  true,
+		Identity: e.identity,
+		Lease:    e.namespace + "/" + e.name,
+		Leader:   e.elector.GetLeader(),
+		IsLeader: e.elector.IsLeader(),
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if status.IsLeader && !e.leadingSince.IsZero() {
+		since := e.leadingSince
+		status.LeadingSince = &since
+	}
+	return status
+}
+
+// writeMetrics reports whether this replica leads
+func (e *LeaderElection) writeMetrics(w io.Writer) {
+	leading := 0.0
+	if e.Status().IsLeader {
+		leading = 1
+	}
+	writeMetric(w, "chairman_leader", "gauge", "Whether this replica holds the leader Lease and runs the event listener", leading)
+}
+
+// getLeader serves the leader election status
+func getLeader(c *gin.Context) {
+	c.JSON(http.StatusOK, leaderElection.Status())
+}
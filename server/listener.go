@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ListenerControl lets operators observe and steer the event listener: pause
+// it during an incident, resume it and move it to another block. The listener
+// applies changes between scans. With --checkpoint the pause is stored with
+// the checkpoint, so a new leader or a restarted replica stays paused.
+type ListenerControl struct {
+	paused atomic.Bool
+	// Signalled when the listener should apply a pause, resume or seek
+	changed chan struct{}
+
+	mu sync.Mutex
+	// Block every watch group should continue from, or -1
+	seekBlock   int
+	lastError   string
+	lastErrorAt time.Time
+
+	eventsSeen    atomic.Int64
+	eventsMatched atomic.Int64
+}
+
+var listenerControl = &ListenerControl{changed: make(chan struct{}, 1), seekBlock: -1}
+
+// ListenerStatus is the externally visible state of the event listener
+type ListenerStatus struct {
+	// Whether this replica runs the listener, which with --leader-elect only the leader does
+	Running     bool          `json:"running"`
+	Leader      string        `json:"leader"`
+	Paused      bool          `json:"paused"`
+	EventSource string        `json:"event_source"`
+	Head        ChainHead     `json:"head"`
+	Groups      []GroupStatus `json:"groups"`
+	// The group furthest behind
+	ProcessedBlock *int `json:"processed_block,omitempty"`
+	LagBlocks      *int `json:"lag_blocks,omitempty"`
+	// Block a requested seek moves the listener to once it is applied
+	PendingSeek   *int       `json:"pending_seek,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorAt   *time.Time `json:"last_error_at,omitempty"`
+	EventsSeen    int64      `json:"events_seen"`
+	EventsMatched int64      `json:"events_matched"`
+	// Job creations queued or in progress, which a pause does not stop
+	PendingJobs int `json:"pending_jobs"`
+	// Whether the listener is paused while queued Jobs are still being created
+	Draining bool `json:"draining"`
+}
+
+// GroupStatus is the listener's position in one watch group
+type GroupStatus struct {
+	Group          string `json:"group"`
+	ProcessedBlock int    `json:"processed_block"`
+	LagBlocks      int    `json:"lag_blocks"`
+}
+
+// Paused reports whether the listener should stop scanning
+func (l *ListenerControl) Paused() bool {
+	return l.paused.Load()
+}
+
+// Pause stops the listener after the block range it is processing
+func (l *ListenerControl) Pause() {
+	l.paused.Store(true)
+	checkpoints.SetPaused(true)
+	l.notify()
+}
+
+// Resume lets a paused listener scan again
+func (l *ListenerControl) Resume() {
+	l.paused.Store(false)
+	checkpoints.SetPaused(false)
+	l.notify()
+}
+
+// restorePause pauses the listener if it was paused when the checkpoint was
+// written, by this replica or a previous leader
+func (l *ListenerControl) restorePause() {
+	if checkpoints.Paused() {
+		log.Warn("The event listener was paused when the checkpoint was written and stays paused until resumed")
+		l.paused.Store(true)
+	}
+}
+
+// Seek moves every watch group to blockNumber, also for rules with a later
+// start block. Events whose Jobs already exist or are in the dedup store are
+// not spawned again.
+func (l *ListenerControl) Seek(blockNumber int) {
+	l.mu.Lock()
+	l.seekBlock = blockNumber
+	l.mu.Unlock()
+	l.notify()
+}
+
+// takeSeek returns and clears the requested seek
+func (l *ListenerControl) takeSeek() (int, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	blockNumber := l.seekBlock
+	l.seekBlock = -1
+	return blockNumber, blockNumber >= 0
+}
+
+func (l *ListenerControl) notify() {
+	select {
+	case l.changed <- struct{}{}:
+	default:
+		// The listener has not picked up the previous change yet and will
+		// read the current state when it does
+	}
+}
+
+// recordError remembers the listener's most recent problem for the status
+func (l *ListenerControl) recordError(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lastError = fmt.Sprintf(format, args...)
+	l.lastErrorAt = time.Now().UTC()
+}
+
+// Status reports the listener's position, counters and last error, without
+// calling the node
+func (l *ListenerControl) Status() ListenerStatus {
+	leader := leaderElection.Status()
+	head := headTracker.Status()
+	status := ListenerStatus{
+		Running:        leader.IsLeader,
+		Leader:         leader.Leader,
+		Paused:         l.Paused(),
+		PendingJobs:    jobQueue.Pending(),
+		EventSource:    *eventSource,
+		Head:           head.Head,
+		Groups:         []GroupStatus{},
+		ProcessedBlock: head.ProcessedBlock,
+		LagBlocks:      head.LagBlocks,
+		EventsSeen:     l.eventsSeen.Load(),
+		EventsMatched:  l.eventsMatched.Load(),
+	}
+	for group, blockNumber := range headTracker.Processed() {
+		status.Groups = append(status.Groups, GroupStatus{
+			Group:          group,
+			ProcessedBlock: blockNumber,
+			LagBlocks:      max(head.Head.BlockNumber-blockNumber, 0),
+		})
+	}
+	status.Draining = status.Paused && status.PendingJobs > 0
+	sort.Slice(status.Groups, func(i, j int) bool { return status.Groups[i].Group < status.Groups[j].Group })
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.seekBlock >= 0 {
+		seekBlock := l.seekBlock
+		status.PendingSeek = &seekBlock
+	}
+	if l.lastError != "" {
+		lastErrorAt := l.lastErrorAt
+		status.LastError = l.lastError
+		status.LastErrorAt = &lastErrorAt
+	}
+	return status
+}
+
+// getListenerStatus serves the listener's status
+func getListenerStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, listenerControl.Status())
+}
+
+// requireListener answers 409 and returns false when another replica runs
+// the listener, since pausing or seeking here would have no effect
+func requireListener(c *gin.Context) bool {
+	if leader := leaderElection.Status(); !leader.IsLeader {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("this replica does not run the listener, %s does", leader.Leader)})
+		return false
+	}
+	return true
+}
+
+// pauseListener stops the listener from scanning, and so from spawning agents
+func pauseListener(c *gin.Context) {
+	if !requireListener(c) {
+		return
+	}
+	listenerControl.Pause()
+	log.Warn("Event listener paused through the API")
+	persistPause(c.Request.Context())
+	c.JSON(http.StatusOK, listenerControl.Status())
+}
+
+// resumeListener lets a paused listener scan again
+func resumeListener(c *gin.Context) {
+	if !requireListener(c) {
+		return
+	}
+	listenerControl.Resume()
+	log.Info("Event listener resumed through the API")
+	persistPause(c.Request.Context())
+	c.JSON(http.StatusOK, listenerControl.Status())
+}
+
+// persistPause writes a pause or resume to the checkpoint store right away
+// rather than with the next periodic flush, which retries it on failure
+func persistPause(ctx context.Context) {
+	if err := checkpoints.Flush(ctx); err != nil {
+		log.Errorf("%v", err)
+		listenerControl.recordError("failed to store the pause with the checkpoint: %v", err)
+	}
+}
+
+// seekListener moves the listener to the block_number in the request body
+func seekListener(c *gin.Context) {
+	if !requireListener(c) {
+		return
+	}
+	var request struct {
+		BlockNumber *int `json:"block_number"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil || request.BlockNumber == nil || *request.BlockNumber < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": `expected {"block_number": N} with N >= 0`})
+		return
+	}
+	head, err := headTracker.Latest(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("failed to get the chain head: %v", err)})
+		return
+	}
+	if *request.BlockNumber > head.BlockNumber+1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("block %d is past the chain head %d", *request.BlockNumber, head.BlockNumber)})
+		return
+	}
+	listenerControl.Seek(*request.BlockNumber)
+	log.Warnf("Event listener seeking to block %d through the API", *request.BlockNumber)
+	c.JSON(http.StatusAccepted, listenerControl.Status())
+}
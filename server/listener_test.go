@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestPauseStoredWithCheckpoint(t *testing.T) {
+	savedControl, savedCheckpoints, savedHead := listenerControl, checkpoints, headTracker
+	defer func() { listenerControl, checkpoints, headTracker = savedControl, savedCheckpoints, savedHead }()
+	headTracker = newHeadTracker(time.Minute)
+	store := &fakeCheckpointStore{}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/listener/pause", pauseListener)
+	router.POST("/listener/resume", resumeListener)
+
+	tests := []struct {
+		request string
+		err     error
+		paused  bool
+		stored  bool
+		// Whether a replica starting now, such as a new leader, is paused
+		restarted bool
+	}{
+		{request: "/listener/pause", paused: true, stored: true, restarted: true},
+		// Resuming while the store is down keeps the restart paused, and the
+		// resume is written with the next flush
+		{request: "/listener/resume", err: errors.New("unavailable"), stored: true, restarted: true},
+		{request: "/listener/resume", stored: false},
+	}
+	for _, test := range tests {
+		listenerControl = &ListenerControl{changed: make(chan struct{}, 1), seekBlock: -1}
+		var err error
+		if checkpoints, err = loadCheckpointer(context.Background(), store); err != nil {
+			t.Fatal(err)
+		}
+		listenerControl.restorePause()
+		store.err = test.err
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, test.request, nil))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("%s answered %d: %s", test.request, recorder.Code, recorder.Body)
+		}
+		if listenerControl.Paused() != test.paused {
+			t.Errorf("after %s the listener is paused %t, want %t", test.request, listenerControl.Paused(), test.paused)
+		}
+		if store.checkpoint.Paused != test.stored {
+			t.Errorf("after %s the stored pause is %t, want %t", test.request, store.checkpoint.Paused, test.stored)
+		}
+		if failed := listenerControl.Status().LastError != ""; failed != (test.err != nil) {
+			t.Errorf("after %s the status reports error %q, want one %t", test.request, listenerControl.Status().LastError, test.err != nil)
+		}
+
+		restarted := &ListenerControl{changed: make(chan struct{}, 1), seekBlock: -1}
+		checkpoints, err = loadCheckpointer(context.Background(), store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		restarted.restorePause()
+		if restarted.Paused() != test.restarted {
+			t.Errorf("after %s a restarted listener is paused %t, want %t", test.request, restarted.Paused(), test.restarted)
+		}
+	}
+}
@@ -1,17 +1,22 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"os/signal"
+	"reflect"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -35,6 +40,7 @@ type StarknetEventFilter struct {
 	FromBlock      interface{} `json:"from_block,omitempty"`
 	ToBlock        interface{} `json:"to_block,omitempty"`
 	ChunkSize      int         `json:"chunk_size,omitempty"`
+	ContinuationToken string   `json:"continuation_token,omitempty"`
 }
 
 // EventEmittedFilter represents the specific filter for EventEmitted events
@@ -44,8 +50,21 @@ type EventEmittedFilter struct {
 	FromBlock      interface{} `json:"from_block,omitempty"`
 	ToBlock        interface{} `json:"to_block,omitempty"`
 	ChunkSize      int         `json:"chunk_size,omitempty"`
+	ContinuationToken string   `json:"continuation_token,omitempty"`
 }
 
+// EventPageStats reports how much of a starknet_getEvents result set was consumed
+type EventPageStats struct {
+	Pages  int `json:"pages"`
+	Events int `json:"events"`
+	Bytes  int `json:"bytes"` // size of the raw results
+}
+
+// errEventPageLimit is returned by getEvents when the result set of a range of
+// several blocks has more pages than --max-event-pages allows. The events
+// returned alongside it are incomplete.
+var errEventPageLimit = errors.New("event page limit reached before the result set was exhausted")
+
 type StarknetConfig struct {
 	NodeURL     string `json:"node_url"`
 	NetworkName string `json:"network_name"`
@@ -69,10 +88,7 @@ type StarknetRPCRequest struct {
 type StarknetRPCResponse struct {
 	JSONRPC string          `json:"jsonrpc"`
 	Result  json.RawMessage `json:"result"`
-	Error   *struct {
-		Code    int    `json:"code"`
-		Message string `json:"message"`
-	} `json:"error,omitempty"`
+	Error   *RPCError       `json:"error,omitempty"`
 	ID int `json:"id"`
 }
 
@@ -88,11 +104,36 @@ type StarknetEvent struct {
 
 var (
 	// Add Kubernetes clientset
-	kubernetesClientset *kubernetes.Clientset
+	kubernetesClientset kubernetes.Interface
 
 	httpClient *http.Client
 	log        = logrus.New()
 
+	// Pool of Starknet RPC endpoints used by callStarknetRPC
+	rpcPool *RPCPool
+	// Last JSON-RPC request ID handed out by nextRPCRequestID
+	rpcRequestID atomic.Int64
+	// Starknet RPC spec version the endpoints implement
+	rpcSpec *RPCSpec
+	// Dojo world events that trigger agents, set from --dojo-events
+	enabledDojoEvents = map[string]bool{DojoEventEmitted: true}
+	// ABI used to decode events for the agents, set from --abi
+	eventABI *ContractABI
+	// Where the watch rules are reloaded from, nil when they come from flags
+	rulesSource ruleSource
+	// Set when the binary runs the backfill subcommand instead of the server
+	backfillMode bool
+	// Looks up the block and receipt of matched events, set with --enrich
+	txEnricher *TransactionEnricher
+	// Shared view of the chain head
+	headTracker *HeadTracker
+	// Persists the listener's position, set with --checkpoint
+	checkpoints *Checkpointer
+	// Events already handed to an agent, set with --dedup-db
+	dedupStore *DedupStore
+	// Decides which replica runs the listener, set with --leader-elect
+	leaderElection *LeaderElection
+
 	// WebSocket upgrader
 	upgrader = websocket.Upgrader{
 		ReadBufferSize:  1024,
@@ -110,15 +151,49 @@ var (
 	// Command line flags
 	startBlockNumber = flag.Int("block", 756800, "Block number to start listening from (0 means latest)")
 	contractAddress  = flag.String("contract", "0x198cbb29ed691e3e143da013736cb32d2eb35835414e0c5ba758f44265d7a52", "Contract address to listen for events")
-	eventSelector    = flag.String("selector", "0x4843fbb65c717bb5ece80d635a568aa1c688f880f0519e3de18bf3bae89abf8", "Event selector to filter for")
-	caseInsensitive  = flag.Bool("case-insensitive", true, "Whether to do case-insensitive comparison for the selector")
-	partialMatch     = flag.Bool("partial-match", true, "Whether to allow partial matches for the selector")
+	eventSelector    = flag.String("selector", "0x4843fbb65c717bb5ece80d635a568aa1c688f880f0519e3de18bf3bae89abf8", "Event to filter for: a hex selector, a Dojo tag (namespace-Name) or an event name")
+	caseInsensitive  = flag.Bool("case-insensitive", true, "Deprecated and ignored: selectors are compared numerically")
+	partialMatch     = flag.Bool("partial-match", true, "Deprecated and ignored: selectors are matched exactly")
 	envFile          = flag.String("env-file", ".env", "Path to the .env file")
 	batchSize        = flag.Int("batch-size", 30, "Number of blocks to process in each batch")
+	maxEventPages    = flag.Int("max-event-pages", 50, "Maximum number of starknet_getEvents pages to follow per block range, single blocks are always read in full (0 means unlimited)")
+	rpcBatchRanges   = flag.Int("rpc-batch-ranges", 4, "Number of block ranges to fetch per JSON-RPC batch request while catching up")
+	confirmation     = flag.String("confirmation", "immediate", "When to act on a block's events: immediate, depth:N (N blocks behind the head) or l1 (once ACCEPTED_ON_L1)")
+	reorgDepth       = flag.Int("reorg-depth", 64, "Number of recent block hashes to remember for reorg detection (0 disables reorg detection)")
+	deleteRevertedJobs = flag.Bool("delete-reverted-jobs", false, "Delete the Jobs of events reverted by a reorg instead of only labelling them")
+	eventSource      = flag.String("event-source", "poll", "How to receive events: poll (starknet_getEvents every 15s) or subscribe (RPC v0.8 WebSocket subscriptions)")
+	wsURL            = flag.String("ws-url", "", "Starknet WebSocket RPC URL for --event-source=subscribe (defaults to the first RPC endpoint)")
 	kubeconfigPath   = flag.String("kubeconfig", "", "Path to kubeconfig file (optional, defaults to ~/.kube/config or in-cluster)")
 	namespace        = flag.String("namespace", "my-agents", "Kubernetes namespace to launch jobs in")
 	agentImage       = flag.String("agent-image", "dreams-agents-client:latest", "Docker image for the agent container")
 	agentServiceAccount = flag.String("chairman-server-sa", "", "ServiceAccount name for agent pods (optional)")
+	rpcURLs          = flag.String("rpc-urls", "", "Comma-separated Starknet RPC endpoints as url or name=url (defaults to the built-in node URL)")
+	rpcMaxRetries    = flag.Int("rpc-max-retries", 4, "Number of times to retry a Starknet RPC request after retryable failures")
+	rpcRetryBaseDelay = flag.Duration("rpc-retry-base-delay", 500*time.Millisecond, "Initial backoff between Starknet RPC retries")
+	rpcRetryMaxDelay = flag.Duration("rpc-retry-max-delay", 30*time.Second, "Maximum backoff between Starknet RPC retries")
+	keyFilterProbeInterval = flag.Duration("key-filter-probe-interval", time.Hour, "How often to re-fetch a scanned range without the keys filter to measure the traffic it saves (0 disables)")
+	dojoEvents       = flag.String("dojo-events", DojoEventEmitted, "Comma-separated Dojo world events whose model or event selector is matched against the watch rules' selectors: EventEmitted, StoreSetRecord, StoreUpdateRecord, StoreUpdateMember, StoreDelRecord")
+	abiPath          = flag.String("abi", "", "Path to a Cairo ABI or Dojo manifest (like abi.json) used to decode events into EVENT_JSON for the agents")
+	headMaxAge       = flag.Duration("head-max-age", 5*time.Second, "How long the cached chain head is used before asking the node again")
+	rulesPath        = flag.String("rules", "", "Path to a YAML or JSON file of watch rules, each with its own contract, selector, start block, batch size, confirmation and job template (replaces --contract and --selector)")
+	rulesConfigMap   = flag.String("rules-configmap", "", "ConfigMap ([namespace/]name) whose rules.yaml key holds the watch rules, with Job templates in other keys (instead of --rules)")
+	rulesReloadInterval = flag.Duration("rules-reload-interval", 10*time.Second, "How often --rules or --rules-configmap is checked for changes, which are applied without restarting the listener (0 disables reloading)")
+	jobTemplatePath  = flag.String("job-template", "", "Path to a Job manifest agents are created from when --rules is not set (defaults to the built-in agent Job)")
+	enrichEvents     = flag.Bool("enrich", false, "Look up the block timestamp and the transaction's sender, execution status and fee of matched events and pass them to agents as EVENT_TX_JSON")
+	enrichCacheBlocks = flag.Int("enrich-cache-blocks", 64, "Number of recent blocks whose timestamps and receipts are cached for --enrich")
+	checkpointLocation = flag.String("checkpoint", "", "Where the listener's last fully processed block is kept so restarts resume after it instead of at --block: file:PATH, configmap:[NAMESPACE/]NAME or lease:[NAMESPACE/]NAME (empty keeps it in memory only)")
+	checkpointInterval = flag.Duration("checkpoint-interval", 5*time.Second, "How often the listener's position is written to --checkpoint")
+	dedupDBPath      = flag.String("dedup-db", "", "Path to a BoltDB file recording every event handed to an agent, so each event spawns one Job per rule across restarts, replays and backfills (needs a volume that outlives the pod and a single replica, so not with --leader-elect)")
+	leaderElect      = flag.Bool("leader-elect", false, "Run the event listener only on the replica holding a Lease, so the server can run with several replicas that all serve the HTTP API")
+	leaderElectLease = flag.String("leader-elect-lease", "chairman-server-leader", "Lease ([namespace/]name) replicas compete for with --leader-elect")
+	leaderElectLeaseDuration = flag.Duration("leader-elect-lease-duration", 15*time.Second, "How long followers wait after the leader's last renewal before taking over its Lease")
+	leaderElectRenewDeadline = flag.Duration("leader-elect-renew-deadline", 10*time.Second, "How long the leader keeps retrying to renew its Lease before giving up the leadership")
+	leaderElectRetryPeriod = flag.Duration("leader-elect-retry-period", 2*time.Second, "How often replicas try to acquire or renew the Lease")
+	shutdownGracePeriod = flag.Duration("shutdown-grace-period", 25*time.Second, "How long a SIGTERM or SIGINT waits for the listener to finish its block range and queued Jobs, running requests to complete and log streams to close")
+	jobWorkers       = flag.Int("job-workers", 4, "Number of workers creating the Jobs of matched events while the listener keeps scanning")
+	jobQueueSize     = flag.Int("job-queue-size", 256, "Number of Job creations queued before the listener waits for the workers")
+	jobCreateRate    = flag.Float64("job-create-rate", 10, "Maximum agent Jobs created per second, in bursts of up to --job-workers (0 means unlimited)")
+	whenPredicate    = flag.String("when", "", "Condition on the event's fields an event must also meet to spawn an agent when --rules is not set, e.g. \"record.troop_amount > 0\"")
 	
 	// Default Starknet configuration
 	defaultStarknetConfig = StarknetConfig{
@@ -144,12 +219,26 @@ var (
 	}
 )
 
-func init() {
-	// Parse command line flags
-	flag.Parse()
+// setup parses the command line and prepares the clients, rules and stores
+// the server uses. It runs from main rather than init so the package's tests
+// can run with their own flags.
+func setup() {
+	// Parse command line flags. "backfill" scans a block range and exits; it
+	// takes the server's flags as well as its own.
+	parsedFlags := flag.CommandLine
+	if len(os.Args) > 1 && os.Args[1] == "backfill" {
+		backfillMode = true
+		parseBackfillFlags(os.Args[2:])
+		parsedFlags = backfillFlags
+	} else {
+		flag.Parse()
+	}
 	
 	log = logrus.New()
 	log.SetOutput(os.Stdout) // Direct logs to standard output
+	if backfillMode {
+		log.SetOutput(os.Stderr) // Keep standard output for the report
+	}
 
 	// Load .env file
 	if err := godotenv.Load(*envFile); err != nil {
@@ -178,6 +267,165 @@ func init() {
 		log.Warn("OPENROUTER_API_KEY environment variable not set")
 	}
 	
+	var err error
+
+	// A dry-run backfill creates nothing, so it only needs the cluster for
+	// rules kept in a ConfigMap
+	if !backfillMode || !*backfillDryRun || *rulesConfigMap != "" {
+		kubernetesClientset = newKubernetesClientset()
+	}
+
+	// Initialize HTTP client
+	httpClient = &http.Client{
+		Timeout: 30 * time.Second,
+	}
+
+	// Build the RPC endpoint pool, falling back to the default node URL
+	endpointSpecs := []string{defaultStarknetConfig.NodeURL}
+	if *rpcURLs != "" {
+		endpointSpecs = strings.Split(*rpcURLs, ",")
+	}
+	rpcPool, err = newRPCPool(endpointSpecs)
+	if err != nil {
+		log.Fatalf("Failed to configure Starknet RPC endpoints: %v", err)
+	}
+	for _, endpoint := range rpcPool.Health() {
+		log.Infof("Using Starknet RPC endpoint %s (%s)", endpoint.Name, endpoint.URL)
+	}
+
+	// Pick the request and response shapes for the nodes' spec version
+	rpcSpec, err = negotiateRPCVersion(context.Background(), rpcPool)
+	if err != nil {
+		log.Fatalf("Failed to negotiate Starknet RPC spec version: %v", err)
+	}
+	log.Infof("Using Starknet RPC spec %s", rpcSpec.Version)
+
+	headTracker = newHeadTracker(*headMaxAge)
+	registerMetrics(headTracker.writeMetrics)
+
+	enabledDojoEvents, err = parseDojoEventKinds(*dojoEvents)
+	if err != nil {
+		log.Fatalf("Invalid --dojo-events: %v", err)
+	}
+
+	if *abiPath != "" {
+		eventABI, err = loadContractABI(*abiPath)
+		if err != nil {
+			log.Fatalf("Failed to load ABI from %s: %v", *abiPath, err)
+		}
+		log.Infof("Decoding events with the ABI from %s", *abiPath)
+	}
+
+	parsedFlags.Visit(func(f *flag.Flag) {
+		if f.Name == "case-insensitive" || f.Name == "partial-match" {
+			log.Warnf("--%s is deprecated and ignored: selectors are normalized and matched exactly", f.Name)
+		}
+	})
+	// Load the watch rules, from a file or ConfigMap that is watched for
+	// changes or from the single-rule flags
+	var source ruleSource
+	switch {
+	case *rulesPath != "" && *rulesConfigMap != "":
+		log.Fatalf("--rules and --rules-configmap cannot be used together")
+	case *rulesPath != "":
+		source = fileRuleSource{path: *rulesPath}
+	case *rulesConfigMap != "":
+		source = parseConfigMapRuleSource(*rulesConfigMap)
+	}
+	if source != nil {
+		set, err := loadRuleSet(context.Background(), source, eventABI)
+		if err != nil {
+			log.Fatalf("Failed to load watch rules from %s: %v", source, err)
+		}
+		log.Infof("Loaded %d watch rule(s) from %s, revision %s", len(set.Rules), source, set.Revision)
+		activeRules.Store(set)
+		rulesSource = source
+	} else {
+		rule, err := flagWatchRule()
+		if err != nil {
+			log.Fatalf("Invalid watch rule flags: %v", err)
+		}
+		if rule.selector != normalizeFelt(*eventSelector) {
+			log.Infof("Resolved selector %s to %s", *eventSelector, rule.selector)
+		}
+		activeRules.Store(flagRuleSet(rule))
+	}
+	for _, rule := range activeRules.Load().Rules {
+		log.Infof("Watching rule %s", rule)
+	}
+	registerMetrics(writePredicateMetrics)
+	registerMetrics(writeRulesMetrics)
+	if *enrichEvents {
+		txEnricher = newTransactionEnricher(*enrichCacheBlocks)
+		registerMetrics(txEnricher.writeMetrics)
+		log.Infof("Enriching matched events with their block timestamp and transaction receipt, caching %d blocks", *enrichCacheBlocks)
+	}
+	registerMetrics(eventTraffic.writeMetrics)
+	registerMetrics(eventIndexes.writeMetrics)
+
+	if *dedupDBPath != "" {
+		// Every replica would open the file, and only one can hold its lock
+		if *leaderElect {
+			log.Fatalf("--dedup-db cannot be used with --leader-elect: the store is a local file only one replica can open, run a single replica without --leader-elect")
+		}
+		dedupStore, err = openDedupStore(*dedupDBPath, 10*time.Second)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		registerMetrics(dedupStore.writeMetrics)
+		log.Infof("Recording the events handed to agents in %s", *dedupDBPath)
+	}
+
+	jobCreateLimiter = newJobCreateLimiter(*jobCreateRate, *jobWorkers)
+	jobQueue = newJobQueue(*jobQueueSize, *jobWorkers)
+	registerMetrics(jobQueue.writeMetrics)
+}
+
+// startEventListener starts following the chain for the watch rules. The
+// listener follows the active rules, picking up reloaded ones without
+// starting over.
+func startEventListener(ctx context.Context) {
+	// Resume after the checkpointed blocks rather than at the rules' start blocks
+	if *checkpointLocation != "" {
+		store, err := parseCheckpointStore(*checkpointLocation)
+		if err != nil {
+			log.Fatalf("Invalid --checkpoint: %v", err)
+		}
+		checkpoints, err = loadCheckpointer(ctx, store)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		log.Infof("Checkpointing the listener to %s every %s, %d group(s) checkpointed", store, *checkpointInterval, len(checkpoints.checkpoint.Blocks))
+		registerMetrics(checkpoints.writeMetrics)
+		go checkpoints.run(ctx, max(*checkpointInterval, time.Second))
+		listenerControl.restorePause()
+	}
+
+	switch *eventSource {
+	case "poll":
+		listeners.Add(1)
+		go func() {
+			defer listeners.Done()
+			startEventEmittedListener(ctx, defaultStarknetConfig)
+		}()
+	case "subscribe":
+		if !rpcSpec.Subscriptions {
+			log.Fatalf("--event-source=subscribe needs RPC spec 0.8 or newer, the endpoints implement %s", rpcSpec.Version)
+		}
+		listeners.Add(1)
+		go func() {
+			defer listeners.Done()
+			startEventSubscriptionListener(ctx, defaultStarknetConfig)
+		}()
+	default:
+		log.Fatalf("Unknown --event-source %q, expected poll or subscribe", *eventSource)
+	}
+	log.Infof("Started Starknet EventEmitted listener (%s)", *eventSource)
+}
+
+// newKubernetesClientset connects to the cluster the server runs in, falling
+// back to a kubeconfig when it runs outside of one
+func newKubernetesClientset() *kubernetes.Clientset {
 	var config *rest.Config
 	var err error
 
@@ -211,49 +459,26 @@ func init() {
 	}
 
 	// Fix: Pass only the config to NewForConfig
-	kubernetesClientset, err = kubernetes.NewForConfig(config) // Remove second argument
+	clientset, err := kubernetes.NewForConfig(config) // Remove second argument
 	if err != nil {
 		log.Fatalf("Failed to create Kubernetes client: %v", err)
 	}
 	log.Info("Successfully created Kubernetes client")
+	return clientset
+}
 
-	// Initialize HTTP client
-	httpClient = &http.Client{
-		Timeout: 30 * time.Second,
-	}
-
-	// Update the filter based on command line flags
-	if *contractAddress != "" {
-		defaultEventEmittedFilter.ContractAddress = *contractAddress
-	}
-	
-	// We're not setting the Keys filter anymore to get all events
-	// Instead, we'll filter in the handleEventEmitted function
-	
-	// Set the starting block based on command line flags
-	if *startBlockNumber > 0 {
-		defaultEventEmittedFilter.FromBlock = map[string]interface{}{
-			"block_number": *startBlockNumber,
-		}
-		log.Infof("Starting from block number: %d", *startBlockNumber)
-	} else {
-		defaultEventEmittedFilter.FromBlock = "latest"
-		log.Info("Starting from latest block")
-	}
-
-	// Start listening for events automatically
-	ctx := context.Background()
-	// Use the EventEmitted filter instead of the general filter
-	go startEventEmittedListener(ctx, defaultStarknetConfig, defaultEventEmittedFilter)
-	log.Infof("Started Starknet EventEmitted listener for contract: %s", defaultEventEmittedFilter.ContractAddress)
+// nextRPCRequestID hands out JSON-RPC request IDs so batch responses can be
+// correlated with their requests
+func nextRPCRequestID() int {
+	return int(rpcRequestID.Add(1))
 }
 
-func callStarknetRPC(nodeURL string, method string, params []interface{}) (*StarknetRPCResponse, error) {
+func callStarknetRPC(ctx context.Context, method string, params []interface{}) (*StarknetRPCResponse, error) {
 	request := StarknetRPCRequest{
 		JSONRPC: "2.0",
 		Method:  method,
 		Params:  params,
-		ID:      1,
+		ID:      nextRPCRequestID(),
 	}
 
 	requestBody, err := json.Marshal(request)
@@ -264,50 +489,113 @@ func callStarknetRPC(nodeURL string, method string, params []interface{}) (*Star
 	// Log the request for debugging
 	log.Debugf("Starknet RPC request: %s %s", method, string(requestBody))
 
-	resp, err := httpClient.Post(nodeURL, "application/json", bytes.NewBuffer(requestBody))
-	if err != nil {
-		return nil, fmt.Errorf("failed to send request: %v", err)
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
+	// The pool picks the healthiest endpoint, fails over on provider errors and
+	// retries retryable failures with backoff until ctx is done
+	var response StarknetRPCResponse
+	err = rpcPool.call(ctx, method, requestBody, func(body []byte) error {
+		response = StarknetRPCResponse{}
+		if err := json.Unmarshal(body, &response); err != nil {
+			return fmt.Errorf("failed to unmarshal response: %w", err)
+		}
+		if response.Error != nil {
+			return response.Error
+		}
+		return nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response: %v", err)
+		return nil, err
 	}
+	return &response, nil
+}
 
-	// Log the response for debugging
-	log.Debugf("Starknet RPC response: %s", string(body))
+// StarknetRPCCall is a single method invocation within a batch request
+type StarknetRPCCall struct {
+	Method string
+	Params []interface{}
+}
 
-	var response StarknetRPCResponse
-	if err := json.Unmarshal(body, &response); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal response: %v", err)
+// callStarknetRPCBatch sends several calls as one JSON-RPC 2.0 batch and
+// returns the responses in the order of calls. Errors of individual calls are
+// left in each response's Error field; the returned error covers the batch as a
+// whole. A batch of one is sent as a plain request.
+func callStarknetRPCBatch(ctx context.Context, calls []StarknetRPCCall) ([]StarknetRPCResponse, error) {
+	if len(calls) == 0 {
+		return nil, nil
+	}
+	if len(calls) == 1 {
+		response, err := callStarknetRPC(ctx, calls[0].Method, calls[0].Params)
+		var rpcErr *RPCError
+		if errors.As(err, &rpcErr) {
+			return []StarknetRPCResponse{{JSONRPC: "2.0", Error: rpcErr}}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return []StarknetRPCResponse{*response}, nil
+	}
+
+	requests := make([]StarknetRPCRequest, len(calls))
+	// The requests on their own, for endpoints that reject batches
+	singles := make([][]byte, len(calls))
+	positions := make(map[int]int, len(calls))
+	for i, call := range calls {
+		requests[i] = StarknetRPCRequest{
+			JSONRPC: "2.0",
+			Method:  call.Method,
+			Params:  call.Params,
+			ID:      nextRPCRequestID(),
+		}
+		positions[requests[i].ID] = i
+		single, err := json.Marshal(requests[i])
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal batch request: %v", err)
+		}
+		singles[i] = single
 	}
 
-	if response.Error != nil {
-		return nil, fmt.Errorf("RPC error: %s", response.Error.Message)
+	requestBody, err := json.Marshal(requests)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal batch request: %v", err)
 	}
 
-	return &response, nil
-}
+	method := fmt.Sprintf("batch[%d x %s]", len(calls), calls[0].Method)
+	log.Debugf("Starknet RPC batch request: %s %s", method, string(requestBody))
 
-func getLatestBlockHash(ctx context.Context, config StarknetConfig) (string, error) {
-	response, err := callStarknetRPC(config.NodeURL, "starknet_blockHashAndNumber", []interface{}{})
-	if err != nil {
-		return "", err
-	}
+	responses := make([]StarknetRPCResponse, len(calls))
+	err = rpcPool.callBatch(ctx, method, requestBody, singles, func(body []byte) error {
+		var batch []StarknetRPCResponse
+		if err := json.Unmarshal(body, &batch); err != nil {
+			// Nodes that reject the batch as a whole answer with a single error object
+			var single StarknetRPCResponse
+			if json.Unmarshal(body, &single) == nil && single.Error != nil {
+				return single.Error
+			}
+			return fmt.Errorf("failed to unmarshal batch response: %w", err)
+		}
 
-	var result struct {
-		BlockHash string `json:"block_hash"`
-		BlockNumber uint64 `json:"block_number"`
-	}
-	if err := json.Unmarshal(response.Result, &result); err != nil {
-		return "", fmt.Errorf("failed to unmarshal block hash: %v", err)
+		seen := make([]bool, len(calls))
+		for _, response := range batch {
+			i, ok := positions[response.ID]
+			if !ok || seen[i] {
+				return fmt.Errorf("batch response has unexpected id %d", response.ID)
+			}
+			responses[i] = response
+			seen[i] = true
+		}
+		for i, ok := range seen {
+			if !ok {
+				return fmt.Errorf("batch response is missing a result for %s (id %d)", calls[i].Method, requests[i].ID)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-
-	return result.BlockHash, nil
+	return responses, nil
 }
 
-func getEvents(ctx context.Context, config StarknetConfig, blockHash string, filter StarknetEventFilter) ([]StarknetEvent, error) {
+func getEvents(ctx context.Context, config StarknetConfig, blockHash string, filter StarknetEventFilter) ([]StarknetEvent, EventPageStats, error) {
 	// Create a copy of the filter and set the block hash
 	eventFilter := filter
 	
@@ -319,80 +607,168 @@ func getEvents(ctx context.Context, config StarknetConfig, blockHash string, fil
 		}
 	}
 	
-	// Set a default chunk size if not specified
-	if eventFilter.ChunkSize == 0 {
-		eventFilter.ChunkSize = 100
-	}
-	
-	// Log the request for debugging
-	filterJSON, _ := json.Marshal(eventFilter)
-	log.Debugf("Starknet getEvents filter: %s", string(filterJSON))
-	
-	// Call RPC with the filter as a single parameter
-	response, err := callStarknetRPC(config.NodeURL, "starknet_getEvents", []interface{}{
-		eventFilter, // Single parameter: the filter object
-	})
-	
+	results, err := getEventsBatch(ctx, config, []StarknetEventFilter{eventFilter})
 	if err != nil {
-		return nil, err
+		return nil, EventPageStats{}, err
 	}
+	return results[0].Events, results[0].Stats, results[0].Err
+}
 
-	var result struct {
-		Events []StarknetEvent `json:"events"`
-		ContinuationToken string `json:"continuation_token,omitempty"`
-	}
-	if err := json.Unmarshal(response.Result, &result); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal events: %v", err)
+// singleBlockFilter tells whether a filter covers exactly one block
+func singleBlockFilter(filter StarknetEventFilter) bool {
+	return filter.FromBlock != nil && reflect.DeepEqual(filter.FromBlock, filter.ToBlock)
+}
+
+// EventRangeResult holds the outcome of one filter passed to getEventsBatch
+type EventRangeResult struct {
+	Events []StarknetEvent
+	Stats  EventPageStats
+	Err    error // set when this filter failed or hit --max-event-pages
+}
+
+// getEventsBatch fetches the events for several filters, typically consecutive
+// block ranges. Each round sends the next page of every filter that still has
+// results pending as a single batch request, following continuation tokens so
+// ranges with more than ChunkSize matching events are returned in full. The
+// returned error is only set when the batch as a whole failed.
+func getEventsBatch(ctx context.Context, config StarknetConfig, filters []StarknetEventFilter) ([]EventRangeResult, error) {
+	results := make([]EventRangeResult, len(filters))
+	pending := make([]StarknetEventFilter, len(filters))
+	open := make([]int, 0, len(filters))
+	for i, filter := range filters {
+		// Set a default chunk size if not specified
+		if filter.ChunkSize == 0 {
+			filter.ChunkSize = 100
+		}
+		pending[i] = filter
+		open = append(open, i)
+	}
+
+	for len(open) > 0 {
+		var calls []StarknetRPCCall
+		var active []int
+		for _, i := range open {
+			// A single block cannot be split into smaller ranges, so it is
+			// fetched in full rather than stalling the scan on it forever
+			if *maxEventPages > 0 && results[i].Stats.Pages >= *maxEventPages && !singleBlockFilter(pending[i]) {
+				results[i].Err = fmt.Errorf("%w (%d pages, %d events)", errEventPageLimit, results[i].Stats.Pages, results[i].Stats.Events)
+				continue
+			}
+
+			// Log the request for debugging
+			filterJSON, _ := json.Marshal(pending[i])
+			log.Debugf("Starknet getEvents filter: %s", string(filterJSON))
+
+			calls = append(calls, StarknetRPCCall{Method: "starknet_getEvents", Params: []interface{}{pending[i]}})
+			active = append(active, i)
+		}
+		if len(calls) == 0 {
+			break
+		}
+
+		responses, err := callStarknetRPCBatch(ctx, calls)
+		if err != nil {
+			return nil, err
+		}
+
+		var next []int
+		for j, i := range active {
+			response := responses[j]
+			if response.Error != nil && response.Error.Retryable() {
+				// Give a page that failed inside an otherwise good batch its own retries
+				single, err := callStarknetRPC(ctx, calls[j].Method, calls[j].Params)
+				if err != nil {
+					results[i].Err = err
+					continue
+				}
+				response = *single
+			} else if response.Error != nil {
+				results[i].Err = response.Error
+				continue
+			}
+
+			events, continuationToken, err := decodeEventsPage(response.Result)
+			if err != nil {
+				results[i].Err = fmt.Errorf("failed to unmarshal events: %v", err)
+				continue
+			}
+
+			results[i].Stats.Pages++
+			results[i].Stats.Events += len(events)
+			results[i].Stats.Bytes += len(response.Result)
+			results[i].Events = append(results[i].Events, events...)
+
+			if continuationToken != "" {
+				pending[i].ContinuationToken = continuationToken
+				next = append(next, i)
+			}
+		}
+		open = next
 	}
 
-	return result.Events, nil
+	return results, nil
 }
 
-// getBlockNumber gets a block number from a block hash
-func getBlockNumber(ctx context.Context, config StarknetConfig, blockHash string) (int, error) {
-	response, err := callStarknetRPC(config.NodeURL, "starknet_getBlockWithTxs", []interface{}{
-		map[string]string{"block_hash": blockHash},
-	})
+// getLatestBlockNumber returns the number of the latest accepted block, as
+// cached by the head tracker
+func getLatestBlockNumber(ctx context.Context, config StarknetConfig) (int, error) {
+	head, err := headTracker.Latest(ctx)
 	if err != nil {
 		return 0, err
 	}
+	return head.BlockNumber, nil
+}
 
-	var result struct {
-		BlockNumber int `json:"block_number"`
+// StarknetBlockHeader holds the block header fields the listener relies on
+type StarknetBlockHeader struct {
+	BlockNumber int    `json:"block_number"`
+	BlockHash   string `json:"block_hash"`
+	ParentHash  string `json:"parent_hash"`
+	Status      string `json:"status"`
+	Timestamp   int64  `json:"timestamp"`
+}
+
+// getBlockHeaders fetches the headers of the given blocks in one batch request,
+// using starknet_getBlockWithTxHashes to avoid downloading full transactions
+func getBlockHeaders(ctx context.Context, blockNumbers []int) (map[int]StarknetBlockHeader, error) {
+	calls := make([]StarknetRPCCall, len(blockNumbers))
+	for i, blockNumber := range blockNumbers {
+		calls[i] = StarknetRPCCall{
+			Method: "starknet_getBlockWithTxHashes",
+			Params: []interface{}{blockID(blockNumber)},
+		}
 	}
-	if err := json.Unmarshal(response.Result, &result); err != nil {
-		return 0, fmt.Errorf("failed to unmarshal block number: %v", err)
+
+	responses, err := callStarknetRPCBatch(ctx, calls)
+	if err != nil {
+		return nil, err
 	}
 
-	return result.BlockNumber, nil
+	headers := make(map[int]StarknetBlockHeader, len(blockNumbers))
+	for i, response := range responses {
+		if response.Error != nil {
+			return nil, fmt.Errorf("failed to get block %d: %w", blockNumbers[i], response.Error)
+		}
+		var header StarknetBlockHeader
+		if err := json.Unmarshal(response.Result, &header); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal block %d header: %v", blockNumbers[i], err)
+		}
+		headers[blockNumbers[i]] = header
+	}
+	return headers, nil
 }
 
-// startEventEmittedListener starts a listener specifically for EventEmitted events
-func startEventEmittedListener(ctx context.Context, config StarknetConfig, filter EventEmittedFilter) {
-	// Get the selector we're interested in
-	selector := *eventSelector
-	
-	log.Infof("Starting Starknet EventEmitted listener for contract: %s", 
-		filter.ContractAddress)
-	log.Infof("Will filter for selector: %s in code", selector)
-	log.Infof("Processing blocks in batches of %d", *batchSize)
-	
-	// Determine the starting block
+// resolveStartBlock determines the first block to process from the filter's
+// FromBlock, which is either "latest" or a block_number map
+func resolveStartBlock(ctx context.Context, config StarknetConfig, filter EventEmittedFilter) (int, error) {
 	var currentBlockNumber int
 	var err error
 	
 	// If FromBlock is "latest", get the latest block number
 	if fromBlock, ok := filter.FromBlock.(string); ok && fromBlock == "latest" {
-		blockHash, err := getLatestBlockHash(ctx, config)
+		currentBlockNumber, err = getLatestBlockNumber(ctx, config)
 		if err != nil {
-			log.Errorf("Failed to get latest block hash: %v", err)
-			return
-		}
-		
-		currentBlockNumber, err = getBlockNumber(ctx, config, blockHash)
-		if err != nil {
-			log.Errorf("Failed to get block number for hash %s: %v", blockHash, err)
-			return
+			return 0, err
 		}
 		
 		log.Infof("Starting from latest block number: %d", currentBlockNumber)
@@ -407,148 +783,624 @@ func startEventEmittedListener(ctx context.Context, config StarknetConfig, filte
 			case string:
 				currentBlockNumber, err = strconv.Atoi(v)
 				if err != nil {
-					log.Errorf("Invalid block number: %v", v)
-					return
+					return 0, fmt.Errorf("invalid block number: %v", v)
 				}
 			default:
-				log.Errorf("Unsupported block number type: %T", blockNum)
-				return
+				return 0, fmt.Errorf("unsupported block number type: %T", blockNum)
 			}
 			log.Infof("Starting from specified block number: %d", currentBlockNumber)
 		}
 	}
-	
+	return currentBlockNumber, nil
+}
+
+// startEventEmittedListener polls for the events of every watch group in one
+// loop. Each group keeps its own position, since rules start at different
+// blocks and confirmation policies hold groups back by different amounts.
+// When the rules change, groups that still exist keep their position.
+func startEventEmittedListener(ctx context.Context, config StarknetConfig) {
+	log.Info("Starting Starknet EventEmitted listener")
+
+	var groups []*polledGroup
+	var applied *RuleSet
+
 	ticker := time.NewTicker(15 * time.Second)
 	defer ticker.Stop()
 
-	// Keep track of processed blocks to avoid duplicates
-	processedBlocks := make(map[string]bool)
-
 	for {
+		if set := activeRules.Load(); set != applied {
+			groups = reconcilePolledGroups(ctx, config, groups, set)
+			applied = set
+		}
+		if blockNumber, ok := listenerControl.takeSeek(); ok {
+			for _, group := range groups {
+				group.seek(blockNumber)
+			}
+		}
+
 		select {
 		case <-ctx.Done():
 			log.Info("Stopping Starknet EventEmitted listener")
+			for _, group := range groups {
+				if group.nextBlock >= 0 {
+					group.scanner.collect(true)
+					group.scanner.commit(group.nextBlock)
+				}
+			}
 			return
+		case <-rulesChanged:
+			// Applied at the top of the loop, between scans
+		case <-listenerControl.changed:
+			// Seeks are applied at the top of the loop; a resume waits for the next tick
 		case <-ticker.C:
-			// Get the latest block hash and number
-			blockHash, err := getLatestBlockHash(ctx, config)
-			if err != nil {
-				log.Errorf("Failed to get latest block hash: %v", err)
+			if listenerControl.Paused() {
+				log.Debug("Event listener is paused, not scanning")
 				continue
 			}
-			
-			latestBlockNumber, err := getBlockNumber(ctx, config, blockHash)
+
+			// Get the latest block number, shared by all groups
+			latestBlockNumber, err := getLatestBlockNumber(ctx, config)
 			if err != nil {
-				log.Errorf("Failed to get block number for hash %s: %v", blockHash, err)
+				log.Errorf("Failed to get latest block number: %v", err)
+				listenerControl.recordError("failed to get latest block number: %v", err)
 				continue
 			}
-			
-			// Process blocks in batches
-			for currentBlockNumber <= latestBlockNumber {
-				// Calculate the end block number for this batch
-				endBlockNumber := currentBlockNumber + *batchSize - 1
-				if endBlockNumber > latestBlockNumber {
-					endBlockNumber = latestBlockNumber
-				}
-				
-				// Create a copy of the filter for this batch request
-				requestFilter := filter
-				
-				// Set the from_block and to_block for the batch
-				requestFilter.FromBlock = map[string]interface{}{
-					"block_number": currentBlockNumber,
-				}
-				requestFilter.ToBlock = map[string]interface{}{
-					"block_number": endBlockNumber,
-				}
-				
-				log.Debugf("Checking for EventEmitted events in blocks %d to %d", currentBlockNumber, endBlockNumber)
-				
-				// Get events for this batch of blocks
-				events, err := getEvents(ctx, config, "", StarknetEventFilter(requestFilter))
-				if err != nil {
-					log.Errorf("Failed to fetch Starknet EventEmitted events for blocks %d to %d: %v", 
-						currentBlockNumber, endBlockNumber, err)
+
+			for _, group := range groups {
+				if ctx.Err() != nil || listenerControl.Paused() {
 					break
 				}
-				
-				if len(events) > 0 {
-					log.Infof("Found %d events in blocks %d to %d", len(events), currentBlockNumber, endBlockNumber)
-					
-					// Group events by block number for better logging
-					eventsByBlock := make(map[int][]StarknetEvent)
-					for _, event := range events {
-						eventsByBlock[event.BlockNumber] = append(eventsByBlock[event.BlockNumber], event)
-					}
-					
-					// Process events for each block
-					for blockNum, blockEvents := range eventsByBlock {
-						log.Infof("Processing %d events in block %d", len(blockEvents), blockNum)
-						
-						for i, event := range blockEvents {
-							// Log the event details for debugging
-							keysJSON, _ := json.Marshal(event.Keys)
-							log.Infof("Event %d in block %d: Keys: %s", i, blockNum, string(keysJSON))
-							
-							// Create event payload
-							eventPayload := EventPayload{
-								EventID:   fmt.Sprintf("starknet-emitted-%d-%s-%d", blockNum, event.TransactionHash, event.EventIndex),
-								EventType: "starknet_event_emitted",
-								Payload: map[string]any{
-									"block_number":     blockNum,
-									"transaction_hash": event.TransactionHash,
-									"contract_address": event.FromAddress,
-									"keys":            event.Keys,
-									"data":            event.Data,
-									"event_index":     event.EventIndex,
-									"selector":        *eventSelector,
-								},
-								Environment: map[string]string{
-									"STARKNET_NETWORK": config.NetworkName,
-									"CONTRACT_ADDRESS": event.FromAddress,
-									"EVENT_SELECTOR":   *eventSelector,
-									"BLOCK_NUMBER":     fmt.Sprintf("%d", blockNum),
-								},
-							}
-							
-							// Handle the event by creating a container
-							handleEventEmitted(eventPayload)
-						}
-					}
-				} else {
-					log.Debugf("No events found in blocks %d to %d", currentBlockNumber, endBlockNumber)
+				if group.nextBlock < 0 && !group.start(ctx, config) {
+					continue
 				}
-				
-				// Mark these blocks as processed
-				for blockNum := currentBlockNumber; blockNum <= endBlockNumber; blockNum++ {
-					processedBlocks[fmt.Sprintf("%d", blockNum)] = true
-				}
-				
-				// Move to the next batch
-				currentBlockNumber = endBlockNumber + 1
+				group.nextBlock = group.scanner.poll(ctx, group.nextBlock, latestBlockNumber)
+				group.scanner.commit(group.nextBlock)
 			}
+		}
+	}
+}
+
+// polledGroup is a watch group and the poll listener's position in it
+type polledGroup struct {
+	scanner *blockScanner
+	// First block not processed yet, -1 until the start block is resolved
+	nextBlock int
+}
+
+// start resolves where the group starts scanning, reporting whether it could
+func (g *polledGroup) start(ctx context.Context, config StarknetConfig) bool {
+	nextBlock, err := g.scanner.resolveStartBlock(ctx)
+	if err != nil {
+		log.Errorf("Failed to determine the starting block of %s, will retry: %v", g.scanner.group, err)
+		listenerControl.recordError("failed to determine the starting block of %s: %v", g.scanner.group, err)
+		return false
+	}
+	g.nextBlock = nextBlock
+	return true
+}
+
+// seek moves the group to blockNumber, checkpointing the new position
+func (g *polledGroup) seek(blockNumber int) {
+	log.Warnf("Moving %s from block %d to block %d", g.scanner.group, g.nextBlock, blockNumber)
+	g.scanner.seek(blockNumber)
+	g.nextBlock = blockNumber
+}
+
+// reconcilePolledGroups matches the polled groups to a rule set. Groups that
+// are still wanted continue from their position with the new rules, new
+// groups start at their rules' start blocks and removed groups are dropped.
+func reconcilePolledGroups(ctx context.Context, config StarknetConfig, groups []*polledGroup, set *RuleSet) []*polledGroup {
+	existing := make(map[string]*polledGroup, len(groups))
+	for _, group := range groups {
+		existing[group.scanner.group.String()] = group
+	}
+
+	next := make([]*polledGroup, 0, len(set.groups))
+	for _, group := range set.groups {
+		group.logFilter()
+		if polled, ok := existing[group.String()]; ok {
+			delete(existing, group.String())
+			polled.scanner.setGroup(group)
+			if polled.nextBlock >= 0 {
+				polled.scanner.continueFrom(polled.nextBlock)
+			}
+			next = append(next, polled)
+			continue
+		}
+		polled := &polledGroup{scanner: newBlockScanner(config, group), nextBlock: -1}
+		polled.start(ctx, config)
+		next = append(next, polled)
+	}
+	for key := range existing {
+		log.Infof("No rules left for %s, no longer scanning it", key)
+		headTracker.ForgetProcessed(key)
+	}
+	return next
+}
+
+// poll checks a group's processed blocks for reorgs and scans the blocks its
+// confirmation policy allows, returning the first block still to be processed
+func (s *blockScanner) poll(ctx context.Context, currentBlockNumber, latestBlockNumber int) int {
+	// Wait for the Jobs of the last poll, so a reorg can revert them too
+	s.collect(true)
+
+	// Make sure the blocks processed so far are still canonical
+	currentBlockNumber, err := s.detectReorg(ctx, currentBlockNumber)
+	if err != nil {
+		log.Errorf("Failed to check %s for chain reorganizations: %v", s.group, err)
+		listenerControl.recordError("failed to check %s for chain reorganizations: %v", s.group, err)
+		return currentBlockNumber
+	}
+	
+	// Only process blocks the confirmation policy considers final
+	safeBlockNumber, err := s.confirmation.safeHead(ctx, latestBlockNumber, currentBlockNumber)
+	if err != nil {
+		log.Errorf("Failed to apply confirmation policy %s: %v", s.confirmation, err)
+		return currentBlockNumber
+	}
+	if safeBlockNumber < latestBlockNumber {
+		log.Debugf("Confirmation policy %s allows blocks up to %d (head is %d)",
+			s.confirmation, safeBlockNumber, latestBlockNumber)
+	}
+	
+	currentBlockNumber = s.scan(ctx, currentBlockNumber, safeBlockNumber)
+	s.trim()
+	return currentBlockNumber
+}
+
+// blockScanner fetches and processes block ranges for the listeners and keeps
+// the state they share between scans
+type blockScanner struct {
+	config StarknetConfig
+	// Rules whose events are scanned for
+	group  *watchGroup
+	filter EventEmittedFilter
+
+	// Hashes of recently processed blocks and the jobs created in them, used to
+	// detect reorgs and revert the affected jobs
+	history *chainHistory
+	// Decides how far behind the chain head scanning stays
+	confirmation ConfirmationPolicy
+	// Events for which skip returns true are dropped; may be nil
+	skip func(StarknetEvent) bool
+	// First block with a Job that could not be created, or -1. The checkpoint
+	// stays before it, so a restart tries that block's Jobs again.
+	heldBlock int
+	// Processed ranges whose Jobs are still queued, oldest first. The
+	// checkpoint stays before the first of them.
+	inflight []*jobBatch
+	// First block each rule of the group matches events in. Rules without
+	// one match in every block scanned.
+	firstBlocks map[*WatchRule]int
+}
+
+// ruleFirstBlocks shares the first block each rule matches events in, as the
+// listener's scanners resolved it, with transaction replays
+var ruleFirstBlocks sync.Map // *WatchRule -> int
+
+func newBlockScanner(config StarknetConfig, group *watchGroup) *blockScanner {
+	return &blockScanner{
+		config:       config,
+		group:        group,
+		filter:       group.filter,
+		history:      newChainHistory(*reorgDepth),
+		confirmation: group.confirmation,
+		heldBlock:    -1,
+		firstBlocks:  make(map[*WatchRule]int),
+	}
+}
+
+// setGroup switches the scanner to a group's new rules, keeping its history.
+// The new rules match in every block until continueFrom is called.
+func (s *blockScanner) setGroup(group *watchGroup) {
+	for _, rule := range s.group.rules {
+		ruleFirstBlocks.Delete(rule)
+	}
+	s.group = group
+	s.filter = group.filter
+	s.firstBlocks = make(map[*WatchRule]int)
+}
+
+// continueFrom sets the first block of the rules of a group that replaces one
+// already processed up to nextBlock. Rules without a start block of their own
+// match from there on.
+func (s *blockScanner) continueFrom(nextBlock int) {
+	for _, rule := range s.group.rules {
+		if *rule.StartBlock > 0 {
+			s.setFirstBlock(rule, *rule.StartBlock)
+		} else {
+			s.setFirstBlock(rule, nextBlock)
+		}
+	}
+}
+
+// setFirstBlock records the first block a rule matches events in
+func (s *blockScanner) setFirstBlock(rule *WatchRule, blockNumber int) {
+	s.firstBlocks[rule] = blockNumber
+	ruleFirstBlocks.Store(rule, blockNumber)
+}
+
+// resolveStartBlock resolves the first block of every rule in the group and
+// returns the earliest, where scanning starts. A group with a checkpoint
+// resumes after the checkpointed block instead.
+func (s *blockScanner) resolveStartBlock(ctx context.Context) (int, error) {
+	if blockNumber, ok := checkpoints.Position(s.group.String()); ok {
+		log.Infof("Resuming %s from block %d, after its checkpoint", s.group, blockNumber+1)
+		s.continueFrom(blockNumber + 1)
+		return blockNumber + 1, nil
+	}
+
+	first := -1
+	for _, rule := range s.group.rules {
+		filter := EventEmittedFilter{FromBlock: "latest"}
+		if *rule.StartBlock > 0 {
+			filter.FromBlock = map[string]interface{}{"block_number": *rule.StartBlock}
+		}
+		blockNumber, err := resolveStartBlock(ctx, s.config, filter)
+		if err != nil {
+			return 0, fmt.Errorf("rule %s: %w", rule, err)
+		}
+		s.setFirstBlock(rule, blockNumber)
+		if first < 0 || blockNumber < first {
+			first = blockNumber
+		}
+	}
+	return first, nil
+}
+
+// process queues the Jobs for the events of a block range
+func (s *blockScanner) process(ctx context.Context, fromBlock, toBlock int, events []StarknetEvent) {
+	s.inflight = append(s.inflight, processEventRange(ctx, s.config, s.group.rules, s.firstBlocks, fromBlock, toBlock, events))
+	s.collect(false)
+}
+
+// collect takes in the ranges whose Jobs are done, remembering the Jobs
+// created for reorg handling and the first block whose Jobs could not all be
+// created. With wait set it waits for every queued range.
+func (s *blockScanner) collect(wait bool) {
+	for len(s.inflight) > 0 {
+		batch := s.inflight[0]
+		if wait {
+			<-batch.done
+		} else {
+			select {
+			case <-batch.done:
+			default:
+				return
+			}
+		}
+		s.inflight = s.inflight[1:]
+
+		for _, job := range batch.jobs {
+			s.history.recordJob(job)
+		}
+		failedBlock := batch.failedBlock
+		if failedBlock >= 0 {
+			listenerControl.recordError("failed to create Jobs for events of %s in block %d", s.group, failedBlock)
+		}
+		if failedBlock >= 0 && (s.heldBlock < 0 || failedBlock < s.heldBlock) {
+			if checkpoints != nil {
+				log.Warnf("Holding the checkpoint of %s before block %d, whose Jobs will be retried after a restart", s.group, failedBlock)
+			}
+			s.heldBlock = failedBlock
+		}
+	}
+}
+
+// seek makes the rules match from blockNumber on, even before their start
+// blocks, and records the group as processed up to the block before it
+func (s *blockScanner) seek(blockNumber int) {
+	s.collect(true)
+	for _, rule := range s.group.rules {
+		s.setFirstBlock(rule, blockNumber)
+	}
+	s.heldBlock = -1
+	s.commit(blockNumber)
+	headTracker.RecordProcessed(s.group.String(), blockNumber-1)
+}
+
+// commit checkpoints a group as processed up to the block before nextBlock,
+// or before its held block or first range with queued Jobs
+func (s *blockScanner) commit(nextBlock int) {
+	s.collect(false)
+	if len(s.inflight) > 0 {
+		nextBlock = min(nextBlock, s.inflight[0].fromBlock)
+	}
+	if s.heldBlock >= 0 {
+		nextBlock = min(nextBlock, s.heldBlock)
+	}
+	checkpoints.Commit(s.group.String(), nextBlock-1)
+}
+
+// trim bounds the memory used by the scanner's bookkeeping
+func (s *blockScanner) trim() {
+	s.history.trim()
+}
+
+// scan fetches and processes the events of blocks currentBlockNumber to
+// latestBlockNumber and returns the first block that has not been processed.
+// Processing stops early at the first range that cannot be fetched or whose
+// blocks changed while it was being fetched.
+func (s *blockScanner) scan(ctx context.Context, currentBlockNumber, latestBlockNumber int) int {
+	// Process blocks in batches, fetching up to --rpc-batch-ranges ranges per
+	// round trip while catching up. The range shrinks for the rest of this
+	// scan when a batch has more events than --max-event-pages can return.
+	rangeSize := s.group.batchSize
+scan:
+	for currentBlockNumber <= latestBlockNumber && ctx.Err() == nil && !listenerControl.Paused() {
+		// Plan the next ranges, the last one ending at most at the latest block
+		var filters []StarknetEventFilter
+		var ranges [][2]int
+		for fromBlock := currentBlockNumber; fromBlock <= latestBlockNumber && len(ranges) < max(1, *rpcBatchRanges); {
+			toBlock := min(fromBlock+rangeSize-1, latestBlockNumber)
+			
+			// Create a copy of the filter for this batch request
+			requestFilter := s.filter
 			
-			// Limit the size of processedBlocks to avoid memory leaks
-			if len(processedBlocks) > 1000 {
-				// Remove oldest entries (this is a simple approach)
-				for k := range processedBlocks {
-					delete(processedBlocks, k)
-					if len(processedBlocks) <= 500 {
-						break
+			// Set the from_block and to_block for the batch
+			requestFilter.FromBlock = blockID(fromBlock)
+			requestFilter.ToBlock = blockID(toBlock)
+			
+			filters = append(filters, StarknetEventFilter(requestFilter))
+			ranges = append(ranges, [2]int{fromBlock, toBlock})
+			fromBlock = toBlock + 1
+		}
+		
+		log.Debugf("Checking for EventEmitted events in blocks %d to %d (%d range(s))",
+			currentBlockNumber, ranges[len(ranges)-1][1], len(ranges))
+		
+		// Get events for these batches of blocks in one round trip
+		results, err := getEventsBatch(ctx, s.config, filters)
+		if err != nil {
+			logEventFetchError(currentBlockNumber, ranges[len(ranges)-1][1], err)
+			break
+		}
+		
+		// Fetch the headers needed to verify the ranges against the chain
+		headers, err := s.rangeHeaders(ctx, ranges, results)
+		if err != nil {
+			log.Errorf("Failed to fetch block headers for blocks %d to %d: %v",
+				currentBlockNumber, ranges[len(ranges)-1][1], err)
+			listenerControl.recordError("failed to fetch block headers for blocks %d to %d: %v",
+				currentBlockNumber, ranges[len(ranges)-1][1], err)
+			break
+		}
+		
+		for i, result := range results {
+			startBlockNumber, endBlockNumber := ranges[i][0], ranges[i][1]
+			if errors.Is(result.Err, errEventPageLimit) && endBlockNumber > startBlockNumber {
+				rangeSize = (endBlockNumber - startBlockNumber + 1) / 2
+				log.Warnf("Blocks %d to %d exceed the event page limit (%v), retrying with %d blocks per batch",
+					startBlockNumber, endBlockNumber, result.Err, rangeSize)
+				continue scan
+			}
+			if result.Err != nil {
+				logEventFetchError(startBlockNumber, endBlockNumber, result.Err)
+				break scan
+			}
+			if err := s.history.verifyAndRecord(startBlockNumber, endBlockNumber, result.Events, headers); err != nil {
+				log.Warnf("Chain changed while scanning blocks %d to %d, will re-check next poll: %v",
+					startBlockNumber, endBlockNumber, err)
+				break scan
+			}
+			
+			// Event IDs include the position of events in their transaction
+			if err := eventIndexes.resolve(ctx, result.Events, nil); err != nil {
+				log.Errorf("Failed to number the events of blocks %d to %d, will try again next poll: %v",
+					startBlockNumber, endBlockNumber, err)
+				listenerControl.recordError("failed to number the events of blocks %d to %d: %v", startBlockNumber, endBlockNumber, err)
+				break scan
+			}
+			
+			log.Debugf("Consumed %d page(s), %d event(s) and %d bytes for blocks %d to %d",
+				result.Stats.Pages, result.Stats.Events, result.Stats.Bytes, startBlockNumber, endBlockNumber)
+			eventTraffic.record(result.Stats)
+			
+			events := result.Events
+			if s.skip != nil {
+				events = events[:0:0]
+				for _, event := range result.Events {
+					if !s.skip(event) {
+						events = append(events, event)
 					}
 				}
 			}
+			if s.heldBlock >= startBlockNumber {
+				// The blocks are processed again, so their Jobs get another chance
+				s.heldBlock = -1
+			}
+			// A fetched range is processed to the end even when the listener is
+			// stopping, so none of its Jobs are left out of the checkpoint
+			s.process(context.WithoutCancel(ctx), startBlockNumber, endBlockNumber, events)
+			
+			if len(s.filter.Keys) > 0 && eventTraffic.probeDue() {
+				s.probeKeyFilter(ctx, startBlockNumber, endBlockNumber, result.Stats)
+			}
+			
+			// Move to the next batch
+			currentBlockNumber = endBlockNumber + 1
+			if ctx.Err() != nil {
+				break scan
+			}
 		}
 	}
+	headTracker.RecordProcessed(s.group.String(), currentBlockNumber-1)
+	return currentBlockNumber
 }
 
-// handleEventEmitted specifically handles EventEmitted events
-func handleEventEmitted(event EventPayload) {
+// logEventFetchError reports a failed getEvents call, separating provider
+// trouble that already exhausted its retries from permanent request errors
+func logEventFetchError(fromBlock, toBlock int, err error) {
+	if isRetryableRPCError(err) {
+		log.Errorf("Failed to fetch Starknet EventEmitted events for blocks %d to %d after retries, will try again next poll: %v", 
+			fromBlock, toBlock, err)
+	} else {
+		log.Errorf("Permanent error fetching Starknet EventEmitted events for blocks %d to %d, check the contract address and event filter: %v", 
+			fromBlock, toBlock, err)
+	}
+	listenerControl.recordError("failed to fetch events for blocks %d to %d: %v", fromBlock, toBlock, err)
+}
+
+// starknetEventID derives the stable identifier used for an event's job and labels
+func starknetEventID(event StarknetEvent) string {
+	return fmt.Sprintf("starknet-emitted-%d-%s-%d", event.BlockNumber, event.TransactionHash, event.EventIndex)
+}
+
+// processEventRange queues every event found in a block range once for each
+// rule it matches, in block order, and returns the batch that collects the
+// jobs created for them and the first block with a Job that could not be created
+func processEventRange(ctx context.Context, config StarknetConfig, rules []*WatchRule, firstBlocks map[*WatchRule]int, fromBlock, toBlock int, events []StarknetEvent) *jobBatch {
+	batch := newJobBatch(fromBlock)
+	defer batch.seal()
+	if len(events) == 0 {
+		log.Debugf("No events found in blocks %d to %d", fromBlock, toBlock)
+		return batch
+	}
+	log.Infof("Found %d events in blocks %d to %d", len(events), fromBlock, toBlock)
+	listenerControl.eventsSeen.Add(int64(len(events)))
+	
+	// Group events by block number for better logging
+	eventsByBlock := make(map[int][]StarknetEvent)
+	var blockNumbers []int
+	for _, event := range events {
+		if _, ok := eventsByBlock[event.BlockNumber]; !ok {
+			blockNumbers = append(blockNumbers, event.BlockNumber)
+		}
+		eventsByBlock[event.BlockNumber] = append(eventsByBlock[event.BlockNumber], event)
+	}
+	
+	// Process events for each block
+	for _, blockNum := range blockNumbers {
+		blockEvents := eventsByBlock[blockNum]
+		log.Infof("Processing %d events in block %d", len(blockEvents), blockNum)
+		
+		for i, event := range blockEvents {
+			// Log the event details for debugging
+			keysJSON, _ := json.Marshal(event.Keys)
+			log.Infof("Event %d in block %d: Keys: %s", i, blockNum, string(keysJSON))
+			
+			eventPayload, dojoEvent, decoded, err := newEventPayload(config, event)
+			if err != nil {
+				log.Warnf("Skipping event %s: %v", eventPayload.EventID, err)
+				eventTraffic.discarded.Add(1)
+				continue
+			}
+			
+			// Find the rules the event matches
+			var matched []*WatchRule
+			for _, rule := range rules {
+				if event.BlockNumber < firstBlocks[rule] {
+					log.Debugf("Skipping event %s for rule %s, block %d is before the rule's start block %d",
+						eventPayload.EventID, rule, event.BlockNumber, firstBlocks[rule])
+					continue
+				}
+				matchedKey, ok := rule.matches(event, dojoEvent, decoded)
+				if !ok {
+					continue
+				}
+				log.Infof("Event %s matches rule %s on key %s", eventPayload.EventID, rule, matchedKey)
+				matched = append(matched, rule)
+			}
+			if len(matched) == 0 {
+				// This is not an error, just not an event we're looking for
+				log.Debugf("Skipping event %s as it matches none of the %d rule(s)", eventPayload.EventID, len(rules))
+				eventTraffic.discarded.Add(1)
+				continue
+			}
+			
+			listenerControl.eventsMatched.Add(1)
+			enrichEventPayload(ctx, eventPayload, event)
+			
+			// Queue the creation of a container for every rule it matches
+			for _, rule := range matched {
+				jobQueue.enqueue(ctx, jobTask{
+					event:       eventPayload.forRule(rule),
+					rule:        rule,
+					blockNumber: blockNum,
+					blockHash:   event.BlockHash,
+					batch:       batch,
+				})
+			}
+		}
+	}
+	return batch
+}
+
+// newEventPayload builds the payload agents get for an event, splitting Dojo
+// world events into their parts and decoding the event when an ABI is set.
+// It fails for world events whose parts cannot be read.
+func newEventPayload(config StarknetConfig, event StarknetEvent) (EventPayload, *DojoEvent, *DecodedEvent, error) {
+	eventPayload := EventPayload{
+		EventID:   starknetEventID(event),
+		EventType: "starknet_event_emitted",
+		Payload: map[string]any{
+			"block_number":     event.BlockNumber,
+			"transaction_hash": event.TransactionHash,
+			"contract_address": event.FromAddress,
+			"keys":            event.Keys,
+			"data":            event.Data,
+			"event_index":     event.EventIndex,
+		},
+		Environment: map[string]string{
+			"STARKNET_NETWORK": config.NetworkName,
+			"CONTRACT_ADDRESS": event.FromAddress,
+			"BLOCK_NUMBER":     fmt.Sprintf("%d", event.BlockNumber),
+		},
+	}
+
+	// Split Dojo world events into their parts
+	dojoEvent, err := parseDojoEvent(event.Keys, event.Data)
+	if err != nil {
+		return eventPayload, nil, nil, fmt.Errorf("malformed Dojo world event: %w", err)
+	}
+	if dojoEvent != nil {
+		if eventABI != nil {
+			if err := eventABI.describeDojoEvent(dojoEvent); err != nil {
+				log.Warnf("Event %s: %v", eventPayload.EventID, err)
+			}
+		}
+		eventPayload.Payload["dojo"] = dojoEvent
+	}
+
+	// Decode the event for the agent when an ABI is configured
+	var decoded *DecodedEvent
+	if eventABI != nil {
+		decoded, err = eventABI.DecodeEvent(event.FromAddress, event.Keys, event.Data)
+		if err != nil {
+			log.Warnf("Failed to decode event %s with the ABI: %v", eventPayload.EventID, err)
+		} else {
+			eventPayload.Payload["decoded"] = decoded
+		}
+	}
+	return eventPayload, dojoEvent, decoded, nil
+}
+
+// enrichEventPayload adds the block timestamp and transaction receipt with
+// --enrich. Agents still run when the lookup fails, just without them.
+func enrichEventPayload(ctx context.Context, eventPayload EventPayload, event StarknetEvent) {
+	if txEnricher == nil {
+		return
+	}
+	info, err := txEnricher.Lookup(ctx, event)
+	if err != nil {
+		log.Warnf("Failed to enrich event %s: %v", eventPayload.EventID, err)
+		return
+	}
+	eventPayload.Payload["transaction"] = info
+	for k, v := range info.environment() {
+		eventPayload.Environment[k] = v
+	}
+}
+
+// handleEventEmitted creates the Job a rule specifies for an EventEmitted event
+// that matched it. It returns the event's Job when one was created or already
+// existed.
+func handleEventEmitted(event EventPayload, rule *WatchRule) *batchv1.Job {
 	// Extract the keys from the event payload
 	keys, ok := event.Payload["keys"].([]string)
 	if !ok || len(keys) == 0 {
 		log.Warnf("Event %s has no keys or invalid keys format", event.EventID)
-		return
+		return nil
 	}
 
 	// Extract the data/values from the event payload
@@ -565,16 +1417,8 @@ func handleEventEmitted(event EventPayload) {
 		data = []string{}
 	}
 
-	// Get the selector we're interested in
-	targetSelector := *eventSelector
-	
-	// Convert to lowercase if case-insensitive comparison is enabled
-	var normalizedTargetSelector string
-	if *caseInsensitive {
-		normalizedTargetSelector = strings.ToLower(targetSelector)
-	} else {
-		normalizedTargetSelector = targetSelector
-	}
+	// Get the selector the rule matched
+	targetSelector := rule.selector
 
 	// Log all keys for debugging
 	keysJSON, _ := json.Marshal(keys)
@@ -584,83 +1428,19 @@ func handleEventEmitted(event EventPayload) {
 	dataJSON, _ := json.Marshal(data)
 	log.Infof("Event %s has data: %s", event.EventID, string(dataJSON))
 
-	// Check if this is an EventEmitted event with the specific selector
-	// The selector could be any of the keys, not just the first one
-	selectorFound := false
-	matchedKey := ""
-	for _, key := range keys {
-		// Normalize the key if case-insensitive comparison is enabled
-		var normalizedKey string
-		if *caseInsensitive {
-			normalizedKey = strings.ToLower(key)
-		} else {
-			normalizedKey = key
-		}
-		
-		// Check for exact match first
-		if normalizedKey == normalizedTargetSelector {
-			selectorFound = true
-			matchedKey = key
-			log.Infof("Found exact matching selector %s in event keys (original key: %s)", targetSelector, key)
-			break
-		}
-		
-		// If partial matching is enabled, check for substring matches
-		if *partialMatch {
-			if strings.Contains(normalizedKey, normalizedTargetSelector) {
-				selectorFound = true
-				matchedKey = key
-				log.Infof("Found partial matching selector %s in event key %s (selector is substring of key)", targetSelector, key)
-				break
-			}
-			
-			if strings.Contains(normalizedTargetSelector, normalizedKey) {
-				selectorFound = true
-				matchedKey = key
-				log.Infof("Found partial matching selector %s in event key %s (key is substring of selector)", targetSelector, key)
-				break
-			}
-		}
-	}
+	log.Infof("Processing EventEmitted event with selector: %s for rule %s", targetSelector, rule)
 
-	if !selectorFound {
-		// This is not an error, just not the event we're looking for
-		log.Debugf("Skipping event %s as it doesn't contain our selector %s", event.EventID, targetSelector)
-		return
-	}
-
-	log.Infof("Processing EventEmitted event with selector: %s, matched key: %s", targetSelector, matchedKey)
-
-	// Generate a Kubernetes-compatible job name (DNS-1123 subdomain)
-	// Max length 63 chars, lowercase alphanumeric, '-', start/end with alphanumeric
-	jobNameBase := fmt.Sprintf("agent-%s", event.EventID)
-	// Sanitize and shorten if necessary
-	jobNameBase = strings.ToLower(jobNameBase)
-	jobNameBase = strings.ReplaceAll(jobNameBase, "_", "-") // Replace underscores
-	// Replace any invalid characters (example: keep only a-z, 0-9, -)
-	var sanitizedName strings.Builder
-	for _, r := range jobNameBase {
-		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' {
-			sanitizedName.WriteRune(r)
-		}
-	}
-	jobNameBase = sanitizedName.String()
-	if len(jobNameBase) > 50 { // Leave room for potential suffix
-		jobNameBase = jobNameBase[:50]
-	}
-	// Ensure it doesn't end with '-'
-	jobNameBase = strings.TrimSuffix(jobNameBase, "-")
-	// Add a timestamp or random suffix to ensure uniqueness if needed, though Job controller handles this.
-	// Let's use the base name directly for now. Kubernetes will add a unique suffix to the Pod name.
-	jobName := jobNameBase
+	// Generate a Kubernetes-compatible job name
+	jobName := agentJobName(event.EventID, rule.Name)
 
 	// Sanitize and truncate label values
 	sanitizedEventID := sanitizeAndTruncateLabelValue(event.EventID)
 	sanitizedSelector := sanitizeAndTruncateLabelValue(targetSelector)
 
-	// Prepare environment variables for the agent Pod
+	// Prepare environment variables for the agent Pod. EVENT_ID is the full
+	// ID, which the death signal endpoint accepts.
 	envVars := []v1.EnvVar{
-		{Name: "EVENT_ID", Value: sanitizedEventID},
+		{Name: "EVENT_ID", Value: event.EventID},
 		{Name: "EVENT_TYPE", Value: event.EventType},
 		{Name: "EVENT_SELECTOR", Value: sanitizedSelector},
 		// Add keys
@@ -669,6 +1449,19 @@ func handleEventEmitted(event EventPayload) {
 		{Name: "EVENT_DATA_JSON", Value: toJsonString(data)}, // Pass data as JSON string
 	}
 	
+	// Add the ABI-decoded event, if the listener could decode it
+	if decoded, ok := event.Payload["decoded"]; ok {
+		envVars = append(envVars, v1.EnvVar{Name: "EVENT_JSON", Value: toJsonString(decoded)})
+	}
+	// Add the block timestamp and transaction receipt, with --enrich
+	if info, ok := event.Payload["transaction"]; ok {
+		envVars = append(envVars, v1.EnvVar{Name: "EVENT_TX_JSON", Value: toJsonString(info)})
+	}
+	// Add the parts of a Dojo world event: selector, keys, values and, with an ABI, the record
+	if dojoEvent, ok := event.Payload["dojo"]; ok {
+		envVars = append(envVars, v1.EnvVar{Name: "DOJO_EVENT_JSON", Value: toJsonString(dojoEvent)})
+	}
+	
 	// Add EVENT_KEY_N and EVENT_DATA_N if needed by the agent, but JSON is often easier
 	
 	for i, key := range keys {
@@ -689,40 +1482,6 @@ func handleEventEmitted(event EventPayload) {
 		}
 	}
 	
-	// **IMPORTANT**: Add API Keys securely. Best practice is using Kubernetes Secrets.
-	// Option 1: Mount Secrets as Env Vars (Recommended)
-	// Assumes you have Secrets named 'agent-api-keys' with keys 'anthropic-api-key', 'openai-api-key', etc.
-	envVars = append(envVars, v1.EnvVar{
-		Name: "ANTHROPIC_API_KEY",
-		ValueFrom: &v1.EnvVarSource{
-			SecretKeyRef: &v1.SecretKeySelector{
-				LocalObjectReference: v1.LocalObjectReference{Name: "agent-api-keys"}, // CHANGE_ME: Your secret name
-				Key:                  "anthropic-api-key",        // CHANGE_ME: Key within the secret
-				Optional:             func(b bool) *bool { return &b }(true), // Make optional if key might not exist
-			},
-		},
-	})
-	envVars = append(envVars, v1.EnvVar{
-		Name: "OPENAI_API_KEY",
-		ValueFrom: &v1.EnvVarSource{
-			SecretKeyRef: &v1.SecretKeySelector{
-				LocalObjectReference: v1.LocalObjectReference{Name: "agent-api-keys"}, // CHANGE_ME
-				Key:                  "openai-api-key",         // CHANGE_ME
-				Optional:             func(b bool) *bool { return &b }(true),
-			},
-		},
-	})
-	envVars = append(envVars, v1.EnvVar{
-		Name: "OPENROUTER_API_KEY",
-		ValueFrom: &v1.EnvVarSource{
-			SecretKeyRef: &v1.SecretKeySelector{
-				LocalObjectReference: v1.LocalObjectReference{Name: "agent-api-keys"}, // CHANGE_ME
-				Key:                  "openrouter-api-key",     // CHANGE_ME
-				Optional:             func(b bool) *bool { return &b }(true),
-			},
-		},
-	})
-	
 	// Option 2: Pass keys from server env (Less Secure, only for testing/simplicity if needed)
 	/*
 	 if anthropicAPIKey != "" { envVars = append(envVars, v1.EnvVar{Name: "ANTHROPIC_API_KEY", Value: anthropicAPIKey}) }
@@ -730,66 +1489,64 @@ func handleEventEmitted(event EventPayload) {
 	 if openrouterAPIKey != "" { envVars = append(envVars, v1.EnvVar{Name: "OPENROUTER_API_KEY", Value: openrouterAPIKey}) }
 	*/
 
-	// Define the Job
-	job := &batchv1.Job{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      jobName,
-			Namespace: *namespace,
-			Labels: map[string]string{ // Labels for finding/managing jobs later
-				"app":       "chairman-agent",
-				"event-id":  sanitizedEventID, // Use sanitized value
-				"selector":  sanitizedSelector, // Use sanitized value
-			},
-		},
-		Spec: batchv1.JobSpec{
-			// TTLSecondsAfterFinished: PtrInt32(3600), // Optional: Auto-cleanup finished jobs after 1 hour
-			BackoffLimit: PtrInt32(1), // Optional: Retry once on failure
-			Template: v1.PodTemplateSpec{
-				ObjectMeta: metav1.ObjectMeta{
-					Labels: map[string]string{ // Pods also get labels
-						"app":      "chairman-agent",
-						"event-id": sanitizedEventID, // Use sanitized value
-					},
-				},
-				Spec: v1.PodSpec{
-					Containers: []v1.Container{
-						{
-							Name:  "agent-container",
-							Image: *agentImage, // Use the image specified by flag
-							Env:   envVars,
-							// Add resource requests/limits if known
-							/*
-							Resources: v1.ResourceRequirements{
-								Requests: v1.ResourceList{
-									v1.ResourceCPU:    resource.MustParse("100m"), // 0.1 CPU core
-									v1.ResourceMemory: resource.MustParse("128Mi"), // 128 MiB RAM
-								},
-								Limits: v1.ResourceList{
-									v1.ResourceCPU:    resource.MustParse("500m"), // 0.5 CPU core
-									v1.ResourceMemory: resource.MustParse("512Mi"), // 512 MiB RAM
-								},
-							},
-							*/
-						},
-					},
-					RestartPolicy: v1.RestartPolicyNever, // Or OnFailure if container might exit non-zero legitimately
-					// Assign a ServiceAccount if the agent needs specific K8s permissions
-					ServiceAccountName: *agentServiceAccount,
-				},
-			},
-		},
+	// Define the Job from the rule's template. The API keys come from the
+	// agent-api-keys Secret in the built-in template.
+	labels := map[string]string{ // Labels for finding/managing jobs later
+		"app":      "chairman-agent",
+		"event-id": sanitizedEventID, // Use sanitized value
+		"selector": sanitizedSelector, // Use sanitized value
+	}
+	if rule.Name != "" {
+		labels["rule"] = rule.Name
+	}
+	job := newAgentJob(rule.template, agentNamespace(), jobName, event.EventID, labels, envVars)
+	if backfillJobs != nil && backfillJobs.DryRun {
+		log.Infof("Dry run: would create Kubernetes Job %s for event %s", jobName, event.EventID)
+		backfillJobs.add(job, event, rule)
+		return job
+	}
+
+	// Spawn each event once per rule, even if its Job was cleaned up since
+	spawnKey := dedupKey(event.EventID, rule.Name)
+	if spawned, ok := dedupStore.Lookup(spawnKey); ok {
+		log.Infof("Event %s was already handed to Job %s in %s at %s, not spawning it again",
+			event.EventID, jobName, spawned.Namespace, spawned.CreatedAt.Format(time.RFC3339))
+		job.Namespace = spawned.Namespace
+		if backfillJobs != nil {
+			backfillJobs.add(job, event, rule)
+		}
+		return job
+	}
+	record := SpawnRecord{EventID: event.EventID, Rule: rule.displayName(), Namespace: job.Namespace, CreatedAt: time.Now().UTC()}
+	record.BlockNumber, _ = event.Payload["block_number"].(int)
+
+	// Create the Job in Kubernetes, no faster than --job-create-rate
+	if err := waitForJobCreation(context.Background()); err != nil {
+		log.Errorf("Failed to wait for the Job creation rate limit for event %s: %v", event.EventID, err)
+		return nil
+	}
+	log.Debugf("Attempting to create Kubernetes Job: %s in namespace: %s", jobName, job.Namespace)
+	_, err := kubernetesClientset.BatchV1().Jobs(job.Namespace).Create(context.Background(), job, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		log.Infof("Kubernetes Job %s already exists for event %s", jobName, event.EventID)
+		dedupStore.Record(spawnKey, record)
+		if backfillJobs != nil {
+			backfillJobs.add(job, event, rule)
+		}
+		return job
 	}
-
-	// Create the Job in Kubernetes
-	log.Debugf("Attempting to create Kubernetes Job: %s in namespace: %s", jobName, *namespace)
-	_, err := kubernetesClientset.BatchV1().Jobs(*namespace).Create(context.Background(), job, metav1.CreateOptions{})
 	if err != nil {
 		log.Errorf("Failed to create Kubernetes Job %s for event %s: %v", jobName, event.EventID, err)
-		// Handle error (e.g., retry logic, specific error checks like "already exists")
-		return
+		// Handle error (e.g., retry logic)
+		return nil
 	}
 
 	log.Infof("Kubernetes Job %s created successfully for event %s", jobName, event.EventID)
+	dedupStore.Record(spawnKey, record)
+	if backfillJobs != nil {
+		backfillJobs.add(job, event, rule)
+	}
+	return job
 }
 
 // Helper to convert slices/maps to JSON strings safely
@@ -893,7 +1650,7 @@ func handleEvent(c *gin.Context) {
 	job := &batchv1.Job{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      jobName,
-			Namespace: *namespace,
+			Namespace: agentNamespace(),
 			Labels: map[string]string{
 				"app":        "chairman-agent-generic",
 				"event-id":   event.EventID,
@@ -927,8 +1684,8 @@ func handleEvent(c *gin.Context) {
 	}
 
 	// Create Job
-	log.Debugf("Attempting to create generic Kubernetes Job: %s in namespace: %s", jobName, *namespace)
-	createdJob, err := kubernetesClientset.BatchV1().Jobs(*namespace).Create(context.Background(), job, metav1.CreateOptions{})
+	log.Debugf("Attempting to create generic Kubernetes Job: %s in namespace: %s", jobName, job.Namespace)
+	createdJob, err := kubernetesClientset.BatchV1().Jobs(job.Namespace).Create(context.Background(), job, metav1.CreateOptions{})
 	if err != nil {
 		log.Errorf("Failed to create generic Kubernetes Job %s: %v", jobName, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create agent job"})
@@ -947,12 +1704,12 @@ func handleEvent(c *gin.Context) {
 func getJobStatus(c *gin.Context) {
 	jobName := c.Param("job_name") // Use job name as identifier
 
-	job, err := kubernetesClientset.BatchV1().Jobs(*namespace).Get(context.Background(), jobName, metav1.GetOptions{})
+	job, err := kubernetesClientset.BatchV1().Jobs(agentNamespace()).Get(context.Background(), jobName, metav1.GetOptions{})
 	if err != nil {
 		log.Warnf("Failed to get Job %s: %v", jobName, err)
 		// Distinguish between "not found" and other errors
 		if strings.Contains(err.Error(), "not found") {
-			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Job %s not found in namespace %s", jobName, *namespace)})
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Job %s not found in namespace %s", jobName, agentNamespace())})
 		} else {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Error fetching job status: %v", err)})
 		}
@@ -983,8 +1740,11 @@ func getJobStatus(c *gin.Context) {
 		status = "Queued"
 	}
 
-	// Get event ID from labels if present
-	eventID := job.Labels["event-id"] // Assuming we set this label
+	// Get event ID from the annotation, or the shortened label of older Jobs
+	eventID, ok := job.Annotations[eventIDAnnotation]
+	if !ok {
+		eventID = job.Labels["event-id"]
+	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"jobName":        job.Name,
@@ -1003,12 +1763,12 @@ func getJobStatus(c *gin.Context) {
 func deleteJob(c *gin.Context) {
 	jobName := c.Param("job_name") // Use job name
 
-	log.Infof("Attempting to delete Job: %s in namespace: %s", jobName, *namespace)
+	log.Infof("Attempting to delete Job: %s in namespace: %s", jobName, agentNamespace())
 
 	// Define deletion policy: Background propagation deletes dependents (Pods) in the background
 	deletePolicy := metav1.DeletePropagationBackground
 
-	err := kubernetesClientset.BatchV1().Jobs(*namespace).Delete(context.Background(), jobName, metav1.DeleteOptions{
+	err := kubernetesClientset.BatchV1().Jobs(agentNamespace()).Delete(context.Background(), jobName, metav1.DeleteOptions{
 		PropagationPolicy: &deletePolicy,
 	})
 	if err != nil {
@@ -1035,7 +1795,7 @@ func streamJobLogs(c *gin.Context) {
 	jobName := c.Param("job_name")
 
 	// 1. Find the Pod(s) associated with the Job
-	podList, err := kubernetesClientset.CoreV1().Pods(*namespace).List(context.Background(), metav1.ListOptions{
+	podList, err := kubernetesClientset.CoreV1().Pods(agentNamespace()).List(context.Background(), metav1.ListOptions{
 		LabelSelector: fmt.Sprintf("job-name=%s", jobName), // K8s automatically adds this label
 	})
 	if err != nil {
@@ -1071,6 +1831,10 @@ func streamJobLogs(c *gin.Context) {
 		return
 	}
 	defer ws.Close()
+	// Shutdown cancels the log request and closes the WebSocket
+	streamCtx, cancelStream := context.WithCancel(context.Background())
+	defer cancelStream()
+	defer trackLogStream(ws, cancelStream)()
 
 	// 2. Stream logs from the selected Pod
 	// Tail lines parameter - get from query? Default to reasonable number
@@ -1082,14 +1846,14 @@ func streamJobLogs(c *gin.Context) {
 	}
 	follow := c.Query("follow") != "false" // Follow logs by default
 
-	req := kubernetesClientset.CoreV1().Pods(*namespace).GetLogs(podName, &v1.PodLogOptions{
+	req := kubernetesClientset.CoreV1().Pods(agentNamespace()).GetLogs(podName, &v1.PodLogOptions{
 		Follow:     follow,    // Follow the logs
 		Timestamps: true,      // Include timestamps
 		TailLines:  &tailLines, // Start with the last N lines
 		// Container: "agent-container", // Specify if multiple containers in pod
 	})
 
-	podLogs, err := req.Stream(context.Background())
+	podLogs, err := req.Stream(streamCtx)
 	if err != nil {
 		log.Errorf("Failed to stream logs for pod %s: %v", podName, err)
 		ws.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("Error streaming logs: %v", err)))
@@ -1164,7 +1928,7 @@ func handleAgentDeathSignal(c *gin.Context) {
 		LabelSelector: fmt.Sprintf("event-id=%s", sanitizedEventID),
 	}
 
-	jobList, err := kubernetesClientset.BatchV1().Jobs(*namespace).List(context.Background(), listOptions)
+	jobList, err := kubernetesClientset.BatchV1().Jobs(agentNamespace()).List(context.Background(), listOptions)
 	if err != nil {
 		// Handle potential errors during list operation
 		log.Errorf("Error listing jobs for event-id %s: %v", sanitizedEventID, err)
@@ -1176,7 +1940,16 @@ func handleAgentDeathSignal(c *gin.Context) {
 		return
 	}
 
-	if len(jobList.Items) == 0 {
+	// Shortened labels of events of the same transaction can be equal, the
+	// annotation tells them apart. Jobs created before it only have the label.
+	jobs := jobList.Items[:0]
+	for _, job := range jobList.Items {
+		if annotated, ok := job.Annotations[eventIDAnnotation]; !ok || annotated == eventID {
+			jobs = append(jobs, job)
+		}
+	}
+
+	if len(jobs) == 0 {
 		log.Warnf("No jobs found with event-id label: %s", sanitizedEventID)
 		c.JSON(http.StatusNotFound, gin.H{
 			"error":      fmt.Sprintf("No job found for event ID %s", sanitizedEventID),
@@ -1191,10 +1964,10 @@ func handleAgentDeathSignal(c *gin.Context) {
 	var deletionErrors []string
 	deletePolicy := metav1.DeletePropagationBackground // Delete pods in background
 
-	for _, job := range jobList.Items {
+	for _, job := range jobs {
 		jobName := job.Name
 		log.Infof("Attempting to delete Job %s (found via event-id %s)", jobName, sanitizedEventID)
-		err := kubernetesClientset.BatchV1().Jobs(*namespace).Delete(context.Background(), jobName, metav1.DeleteOptions{
+		err := kubernetesClientset.BatchV1().Jobs(agentNamespace()).Delete(context.Background(), jobName, metav1.DeleteOptions{
 			PropagationPolicy: &deletePolicy,
 		})
 
@@ -1241,20 +2014,77 @@ func handleAgentDeathSignal(c *gin.Context) {
 }
 
 func main() {
+	setup()
+
+	// SIGTERM and SIGINT stop the server gracefully, see shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	if backfillMode {
+		err := runBackfill(ctx, *backfillFrom, *backfillTo, *backfillDryRun)
+		dedupStore.Close()
+		if err != nil {
+			log.Fatalf("Backfill failed: %v", err)
+		}
+		return
+	}
+
+	// Every replica follows rule changes, so GET /rules and replays agree
+	if rulesSource != nil && *rulesReloadInterval > 0 {
+		go watchRuleSource(ctx, rulesSource, *rulesReloadInterval)
+	}
+
+	// Start listening for events automatically, or once this replica leads.
+	// The Lease is only released on shutdown once the listener stopped.
+	electionCtx, stopElection := context.WithCancel(context.Background())
+	electionDone := make(chan struct{})
+	if *leaderElect {
+		var err error
+		leaderElection, err = newLeaderElection(ctx, func(leading context.Context) {
+			listenerCtx, cancel := context.WithCancel(leading)
+			context.AfterFunc(ctx, cancel)
+			startEventListener(listenerCtx)
+		})
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		registerMetrics(leaderElection.writeMetrics)
+		go func() {
+			defer close(electionDone)
+			leaderElection.run(electionCtx)
+		}()
+	} else {
+		close(electionDone)
+		startEventListener(ctx)
+	}
+
 	r := gin.Default()
 
 	r.POST("/event", handleEvent)
 	r.GET("/jobs/:job_name/status", getJobStatus)
 	r.DELETE("/jobs/:job_name", deleteJob)
 	r.GET("/jobs/:job_name/logs", streamJobLogs)
+	r.GET("/rpc/endpoints", getRPCEndpoints)
+	r.GET("/chain/head", getChainHead)
+	r.GET("/metrics", getMetrics)
+	r.GET("/rules", getRules)
+	r.GET("/leader", getLeader)
+	r.GET("/listener", getListenerStatus)
+	r.POST("/listener/pause", pauseListener)
+	r.POST("/listener/resume", resumeListener)
+	r.POST("/listener/seek", seekListener)
+	r.POST("/replay/tx/:hash", replayTransaction)
 
 	// Add the new endpoint for agent death signals
 	r.DELETE("/signal-death/:event_id", handleAgentDeathSignal)
 
 	log.Info("Starting Dreams Kubernetes Agent Manager...")
-	log.Infof("Listening for contract: %s", defaultEventEmittedFilter.ContractAddress)
-	log.Infof("Event Selector: %s (Case-Insensitive: %v, Partial Match: %v)", *eventSelector, *caseInsensitive, *partialMatch)
-	log.Infof("Target Kubernetes Namespace: %s", *namespace)
+	rules := activeRules.Load()
+	for _, rule := range rules.Rules {
+		log.Infof("Watch rule: %s", rule)
+	}
+	log.Infof("Watch rules revision %s from %s", rules.Revision, rules.Source)
+	log.Infof("Target Kubernetes Namespace: %s", rules.Namespace)
 	log.Infof("Agent Image: %s", *agentImage)
 	if *agentServiceAccount != "" {
 		log.Infof("Using ServiceAccount for Agents: %s", *agentServiceAccount)
@@ -1263,10 +2093,21 @@ func main() {
 	log.Infof("OPENAI_API_KEY: %s (Expected via K8s Secret 'agent-api-keys')", maskAPIKey(openaiAPIKey))
 	log.Infof("OPENROUTER_API_KEY: %s (Expected via K8s Secret 'agent-api-keys')", maskAPIKey(openrouterAPIKey))
 
-	log.Infof("Listening on :8000")
-	if err := r.Run(":8000"); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	server := &http.Server{
+		Addr:              ":8000",
+		Handler:           r,
+		ReadHeaderTimeout: 10 * time.Second,
 	}
+	go func() {
+		log.Infof("Listening on :8000")
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Failed to start server: %v", err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	shutdown(server, stopElection, electionDone)
 }
 
 func maskAPIKey(key string) string {
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// testChain is the chain a test node serves: its head and the transactions
+// in it, in block order
+type testChain struct {
+	head         int
+	transactions []testTransaction
+}
+
+// testTransaction is a transaction with the events it emitted, in order
+type testTransaction struct {
+	hash   string
+	block  int
+	events []testEvent
+}
+
+type testEvent struct {
+	from       string
+	keys, data []string
+}
+
+// testBlockHash is the hash of a test chain's block
+func testBlockHash(blockNumber int) string {
+	return fmt.Sprintf("0xb%d", blockNumber)
+}
+
+// useFakeClientset points the server at a fake cluster holding objects for
+// the duration of the test
+func useFakeClientset(t *testing.T, objects ...runtime.Object) *fake.Clientset {
+	t.Helper()
+	clientset := fake.NewClientset(objects...)
+	saved := kubernetesClientset
+	kubernetesClientset = clientset
+	t.Cleanup(func() { kubernetesClientset = saved })
+	return clientset
+}
+
+// useTestRules makes rules, in the format of --rules, the active rules for
+// the duration of the test
+func useTestRules(t *testing.T, rules string) *RuleSet {
+	t.Helper()
+	set, err := parseWatchRules([]byte(rules), func(name string) ([]byte, error) {
+		return nil, fmt.Errorf("no template %s", name)
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := activeRules.Load()
+	t.Cleanup(func() { activeRules.Store(saved) })
+	activeRules.Store(set)
+	return set
+}
+
+// newTestRPCNode serves chain over JSON-RPC, single requests and batches, and
+// points the RPC pool at it for the duration of the test
+func newTestRPCNode(t *testing.T, chain *testChain) {
+	t.Helper()
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if bytes.HasPrefix(bytes.TrimSpace(body), []byte("[")) {
+			var requests []json.RawMessage
+			json.Unmarshal(body, &requests)
+			responses := make([]interface{}, len(requests))
+			for i, request := range requests {
+				responses[i] = chain.answer(request)
+			}
+			json.NewEncoder(w).Encode(responses)
+			return
+		}
+		json.NewEncoder(w).Encode(chain.answer(body))
+	}))
+	t.Cleanup(node.Close)
+
+	savedPool, savedSpec, savedClient, savedHead := rpcPool, rpcSpec, httpClient, headTracker
+	t.Cleanup(func() { rpcPool, rpcSpec, httpClient, headTracker = savedPool, savedSpec, savedClient, savedHead })
+	pool, err := newRPCPool([]string{node.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rpcPool, rpcSpec, httpClient = pool, &RPCSpec{Version: "0.7.1", BlockWithReceipts: true}, node.Client()
+	headTracker = newHeadTracker(0)
+}
+
+// answer handles one JSON-RPC request
+func (c *testChain) answer(raw json.RawMessage) map[string]interface{} {
+	var request struct {
+		ID     int               `json:"id"`
+		Method string            `json:"method"`
+		Params []json.RawMessage `json:"params"`
+	}
+	json.Unmarshal(raw, &request)
+	result, err := c.call(request.Method, request.Params)
+	if err != nil {
+		return map[string]interface{}{"jsonrpc": "2.0", "id": request.ID, "error": err}
+	}
+	return map[string]interface{}{"jsonrpc": "2.0", "id": request.ID, "result": result}
+}
+
+func (c *testChain) call(method string, params []json.RawMessage) (interface{}, *RPCError) {
+	switch method {
+	case "starknet_blockHashAndNumber":
+		return map[string]interface{}{"block_number": c.head, "block_hash": testBlockHash(c.head)}, nil
+	case "starknet_blockNumber":
+		return c.head, nil
+	case "starknet_getBlockWithTxHashes":
+		var id struct {
+			BlockNumber int `json:"block_number"`
+		}
+		json.Unmarshal(params[0], &id)
+		if id.BlockNumber > c.head {
+			return nil, &RPCError{Code: 24, Message: "Block not found"}
+		}
+		return map[string]interface{}{
+			"block_number": id.BlockNumber,
+			"block_hash":   testBlockHash(id.BlockNumber),
+			"parent_hash":  testBlockHash(id.BlockNumber - 1),
+			"status":       "ACCEPTED_ON_L2",
+		}, nil
+	case "starknet_getTransactionReceipt":
+		var hash string
+		json.Unmarshal(params[0], &hash)
+		for _, tx := range c.transactions {
+			if sameFelt(tx.hash, hash) {
+				return tx.receipt(), nil
+			}
+		}
+		return nil, &RPCError{Code: 29, Message: "Transaction hash not found"}
+	case "starknet_getEvents":
+		var filter StarknetEventFilter
+		json.Unmarshal(params[0], &filter)
+		return c.events(filter), nil
+	}
+	return nil, &RPCError{Code: -32601, Message: "Method not found"}
+}
+
+func (tx testTransaction) receipt() map[string]interface{} {
+	events := make([]map[string]interface{}, len(tx.events))
+	for i, event := range tx.events {
+		events[i] = map[string]interface{}{"from_address": event.from, "keys": event.keys, "data": event.data}
+	}
+	return map[string]interface{}{
+		"transaction_hash": tx.hash,
+		"block_number":     tx.block,
+		"block_hash":       testBlockHash(tx.block),
+		"execution_status": "SUCCEEDED",
+		"events":           events,
+	}
+}
+
+// events returns a page of the events matching filter, in pages of the
+// filter's chunk size
+func (c *testChain) events(filter StarknetEventFilter) map[string]interface{} {
+	fromBlock, toBlock := 0, c.head
+	if id, ok := filter.FromBlock.(map[string]interface{}); ok {
+		fromBlock = int(id["block_number"].(float64))
+	}
+	if id, ok := filter.ToBlock.(map[string]interface{}); ok {
+		toBlock = int(id["block_number"].(float64))
+	}
+
+	var matched []map[string]interface{}
+	for _, tx := range c.transactions {
+		if tx.block < fromBlock || tx.block > toBlock {
+			continue
+		}
+		for _, event := range tx.events {
+			if filter.ContractAddress != "" && !sameFelt(filter.ContractAddress, event.from) || !matchesTestKeys(filter.Keys, event.keys) {
+				continue
+			}
+			matched = append(matched, map[string]interface{}{
+				"from_address":     event.from,
+				"keys":             event.keys,
+				"data":             event.data,
+				"block_number":     tx.block,
+				"block_hash":       testBlockHash(tx.block),
+				"transaction_hash": tx.hash,
+			})
+		}
+	}
+
+	offset, _ := strconv.Atoi(filter.ContinuationToken)
+	end := len(matched)
+	page := map[string]interface{}{}
+	if filter.ChunkSize > 0 && offset+filter.ChunkSize < end {
+		end = offset + filter.ChunkSize
+		page["continuation_token"] = strconv.Itoa(end)
+	}
+	page["events"] = matched[offset:end]
+	return page
+}
+
+// matchesTestKeys applies a getEvents key filter: each position lists the
+// values allowed there, an empty list allows any
+func matchesTestKeys(filter [][]string, keys []string) bool {
+	for i, allowed := range filter {
+		if len(allowed) == 0 {
+			continue
+		}
+		if i >= len(keys) || !containsFelt(allowed, keys[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsFelt(felts []string, felt string) bool {
+	for _, f := range felts {
+		if sameFelt(f, felt) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestGetEventsBatchPageLimit(t *testing.T) {
+	event := testEvent{from: "0x1", keys: []string{"0x2"}}
+	newTestRPCNode(t, &testChain{head: 5, transactions: []testTransaction{
+		{hash: "0x9", block: 5, events: []testEvent{event, event, event}},
+	}})
+	saved := *maxEventPages
+	*maxEventPages = 2
+	defer func() { *maxEventPages = saved }()
+
+	tests := []struct {
+		fromBlock, toBlock int
+		events             int
+		limited            bool
+	}{
+		{fromBlock: 4, toBlock: 5, events: 2, limited: true},
+		// A single block cannot be split, so it is read in full
+		{fromBlock: 5, toBlock: 5, events: 3},
+	}
+	for _, test := range tests {
+		filter := StarknetEventFilter{
+			ContractAddress: "0x1",
+			FromBlock:       blockID(test.fromBlock),
+			ToBlock:         blockID(test.toBlock),
+			ChunkSize:       1,
+		}
+		results, err := getEventsBatch(context.Background(), defaultStarknetConfig, []StarknetEventFilter{filter})
+		if err != nil {
+			t.Fatalf("getEventsBatch(%d-%d) failed: %v", test.fromBlock, test.toBlock, err)
+		}
+		if got := len(results[0].Events); got != test.events {
+			t.Errorf("getEventsBatch(%d-%d) returned %d events, want %d", test.fromBlock, test.toBlock, got, test.events)
+		}
+		if limited := errors.Is(results[0].Err, errEventPageLimit); limited != test.limited {
+			t.Errorf("getEventsBatch(%d-%d) error = %v, want page limit %t", test.fromBlock, test.toBlock, results[0].Err, test.limited)
+		}
+	}
+}
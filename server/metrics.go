@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	metricsMu sync.Mutex
+	// Functions called on every scrape to write their samples
+	metricsCollectors []func(w io.Writer)
+)
+
+// registerMetrics adds a collector to the /metrics endpoint
+func registerMetrics(collect func(w io.Writer)) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	metricsCollectors = append(metricsCollectors, collect)
+}
+
+// writeMetric writes a single unlabelled sample in the Prometheus text format
+func writeMetric(w io.Writer, name, kind, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n",
+		name, help, name, kind, name, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// getMetrics serves the registered metrics in the Prometheus text format
+func getMetrics(c *gin.Context) {
+	metricsMu.Lock()
+	collectors := append([]func(w io.Writer){}, metricsCollectors...)
+	metricsMu.Unlock()
+
+	var body bytes.Buffer
+	for _, collect := range collectors {
+		collect(&body)
+	}
+	c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", body.Bytes())
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+	"sync"
+)
+
+// Parameters of Starknet's Poseidon hash: the Hades permutation over a state of
+// three felts with x^3 S-boxes, 8 full and 83 partial rounds
+const (
+	poseidonFullRounds    = 8
+	poseidonPartialRounds = 83
+	poseidonWidth         = 3
+)
+
+var (
+	poseidonConstantsOnce sync.Once
+	poseidonConstants     []*big.Int
+)
+
+// poseidonRoundConstants derives the round constants the way the reference
+// implementation does: sha256("Hades" + index) reduced modulo the field prime
+func poseidonRoundConstants() []*big.Int {
+	poseidonConstantsOnce.Do(func() {
+		count := (poseidonFullRounds + poseidonPartialRounds) * poseidonWidth
+		poseidonConstants = make([]*big.Int, count)
+		for i := range poseidonConstants {
+			digest := sha256.Sum256([]byte(fmt.Sprintf("Hades%d", i)))
+			poseidonConstants[i] = new(big.Int).Mod(new(big.Int).SetBytes(digest[:]), feltPrime)
+		}
+	})
+	return poseidonConstants
+}
+
+// hadesPermutation permutes the state in place
+func hadesPermutation(state []*big.Int) {
+	constants := poseidonRoundConstants()
+	cube := func(x *big.Int) {
+		square := new(big.Int).Mul(x, x)
+		x.Mul(square, x).Mod(x, feltPrime)
+	}
+
+	rounds := poseidonFullRounds + poseidonPartialRounds
+	for round := 0; round < rounds; round++ {
+		for i := range state {
+			state[i].Add(state[i], constants[round*poseidonWidth+i]).Mod(state[i], feltPrime)
+		}
+		if round < poseidonFullRounds/2 || round >= rounds-poseidonFullRounds/2 {
+			for i := range state {
+				cube(state[i])
+			}
+		} else {
+			cube(state[2])
+		}
+
+		// MDS matrix [[3, 1, 1], [1, -1, 1], [1, 1, -2]]
+		sum := new(big.Int).Add(state[0], state[1])
+		sum.Add(sum, state[2])
+		s0 := new(big.Int).Add(sum, new(big.Int).Lsh(state[0], 1))
+		s1 := new(big.Int).Sub(sum, new(big.Int).Lsh(state[1], 1))
+		s2 := new(big.Int).Sub(sum, new(big.Int).Mul(state[2], big.NewInt(3)))
+		state[0], state[1], state[2] = s0.Mod(s0, feltPrime), s1.Mod(s1, feltPrime), s2.Mod(s2, feltPrime)
+	}
+}
+
+// poseidonHashMany hashes a sequence of felts: the input is padded with 1 and
+// then 0 to an even length and absorbed two felts at a time
+func poseidonHashMany(values []*big.Int) *big.Int {
+	padded := append(append([]*big.Int{}, values...), big.NewInt(1))
+	if len(padded)%2 == 1 {
+		padded = append(padded, big.NewInt(0))
+	}
+
+	state := []*big.Int{new(big.Int), new(big.Int), new(big.Int)}
+	for i := 0; i < len(padded); i += 2 {
+		state[0].Add(state[0], padded[i]).Mod(state[0], feltPrime)
+		state[1].Add(state[1], padded[i+1]).Mod(state[1], feltPrime)
+		hadesPermutation(state)
+	}
+	return state[0]
+}
+
+// byteArrayHash is the Poseidon hash of a string serialized as a Cairo ByteArray
+func byteArrayHash(text string) *big.Int {
+	data := []byte(text)
+	full := len(data) / 31
+
+	values := []*big.Int{big.NewInt(int64(full))}
+	for i := 0; i < full; i++ {
+		values = append(values, new(big.Int).SetBytes(data[i*31:(i+1)*31]))
+	}
+	pending := data[full*31:]
+	values = append(values, new(big.Int).SetBytes(pending), big.NewInt(int64(len(pending))))
+	return poseidonHashMany(values)
+}
+
+// dojoSelector returns the selector Dojo derives for a model or event from its
+// namespace and name: poseidon(bytearray_hash(namespace), bytearray_hash(name))
+func dojoSelector(namespace, name string) string {
+	return "0x" + poseidonHashMany([]*big.Int{byteArrayHash(namespace), byteArrayHash(name)}).Text(16)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDojoSelector(t *testing.T) {
+	raw, err := os.ReadFile("../abi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest struct {
+		Models []dojoResource `json:"models"`
+		Events []dojoResource `json:"events"`
+	}
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	resources := append(manifest.Models, manifest.Events...)
+	if len(resources) == 0 {
+		t.Fatal("no models or events in ../abi.json")
+	}
+	for _, resource := range resources {
+		namespace, name, ok := strings.Cut(resource.Tag, "-")
+		if !ok {
+			t.Errorf("tag %q has no namespace", resource.Tag)
+			continue
+		}
+		if got := dojoSelector(namespace, name); !sameFelt(got, resource.Selector) {
+			t.Errorf("dojoSelector(%q, %q) = %s, want %s", namespace, name, got, resource.Selector)
+		}
+	}
+}
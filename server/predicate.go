@@ -0,0 +1,538 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/big"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"unicode"
+)
+
+// A predicate is a condition a watch rule checks against an event before
+// spawning an agent, such as
+//
+//	record.troop_amount > 0 && record.explorer_id in [12, 57, 0x9a]
+//
+// It is one or more comparisons joined by &&. Each compares a field, read with
+// a.b or a[0], to a literal: a decimal or hex integer, a string, true, false
+// or, for in, a list of them. The operators are == != < <= > >= and in.
+// Numbers, including felts given as hex strings, compare numerically.
+//
+// The fields a predicate can read are listed in predicateRoots.
+var predicateRoots = map[string]string{
+	"keys":         "the event keys as hex felts",
+	"data":         "the event data as hex felts",
+	"block_number": "the block number",
+	"tx_hash":      "the transaction hash",
+	"contract":     "the address of the emitting contract",
+	"decoded":      "the fields of the event decoded with --abi",
+	"dojo":         "the parts of a Dojo world event (kind, selector, entity_id, keys, values)",
+	"record":       "the Dojo model or event record decoded with --abi",
+}
+
+// predicateErrors counts evaluations that failed, for example because a field
+// was missing; the event is not spawned for the rule
+var predicateErrors atomic.Int64
+
+// Predicate is a parsed condition
+type Predicate struct {
+	source      string
+	comparisons []predicateComparison
+}
+
+// predicateComparison compares the field at path to a literal
+type predicateComparison struct {
+	path predicatePath
+	op   string
+	// A *big.Int, string or bool, or for in a list of them
+	value interface{}
+}
+
+// predicatePath is a root field and the members and indexes read from it
+type predicatePath struct {
+	root string
+	// Member names as strings and list indexes as ints
+	steps []interface{}
+}
+
+// predicateOperators lists the comparison operators
+var predicateOperators = []string{"==", "!=", "<=", ">=", "<", ">", "in"}
+
+// parsePredicate parses and checks a condition. fields optionally lists the
+// known members of the decoded and record roots, so misspelled fields are
+// reported at load time; a root without an entry is not checked.
+func parsePredicate(source string, fields map[string][]string) (*Predicate, error) {
+	tokens, err := tokenizePredicate(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &predicateParser{tokens: tokens}
+	predicate := &Predicate{source: source}
+	for {
+		comparison, err := p.parseComparison(fields)
+		if err != nil {
+			return nil, err
+		}
+		predicate.comparisons = append(predicate.comparisons, comparison)
+		if !p.accept("&&") {
+			break
+		}
+	}
+	if p.peek().kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %q at offset %d, expected && or the end", p.peek().text, p.peek().pos)
+	}
+	return predicate, nil
+}
+
+func (p *Predicate) String() string {
+	return p.source
+}
+
+// Eval checks the comparisons against an event's fields in order, stopping at
+// the first that does not hold
+func (p *Predicate) Eval(env map[string]interface{}) (bool, error) {
+	for _, comparison := range p.comparisons {
+		ok, err := comparison.eval(env)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// predicateEnv collects the fields predicates can read for an event
+func predicateEnv(event StarknetEvent, dojoEvent *DojoEvent, decoded *DecodedEvent) map[string]interface{} {
+	env := map[string]interface{}{
+		"keys":         toInterfaceList(event.Keys),
+		"data":         toInterfaceList(event.Data),
+		"block_number": int64(event.BlockNumber),
+		"tx_hash":      event.TransactionHash,
+		"contract":     event.FromAddress,
+	}
+	if decoded != nil {
+		env["decoded"] = decoded.Fields
+	}
+	if dojoEvent != nil {
+		env["dojo"] = map[string]interface{}{
+			"kind":            dojoEvent.Kind,
+			"selector":        dojoEvent.Selector,
+			"system_address":  dojoEvent.SystemAddress,
+			"entity_id":       dojoEvent.EntityID,
+			"member_selector": dojoEvent.MemberSelector,
+			"keys":            toInterfaceList(dojoEvent.Keys),
+			"values":          toInterfaceList(dojoEvent.Values),
+			"tag":             dojoEvent.Tag,
+		}
+		if dojoEvent.Record != nil {
+			env["record"] = dojoEvent.Record
+		}
+	}
+	return env
+}
+
+func toInterfaceList(values []string) []interface{} {
+	list := make([]interface{}, len(values))
+	for i, value := range values {
+		list[i] = value
+	}
+	return list
+}
+
+// writePredicateMetrics reports failed predicate evaluations
+func writePredicateMetrics(w io.Writer) {
+	writeMetric(w, "chairman_predicate_errors_total", "counter", "Rule predicate evaluations that failed, skipping the event for the rule", float64(predicateErrors.Load()))
+}
+
+// Tokens
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenNumber
+	tokenString
+	tokenOperator
+)
+
+type predicateToken struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// predicateSymbols lists the symbols, longest first so "<=" wins over "<"
+var predicateSymbols = []string{"&&", "==", "!=", "<=", ">=", "<", ">", "[", "]", ",", ".", "-"}
+
+func tokenizePredicate(source string) ([]predicateToken, error) {
+	var tokens []predicateToken
+	for i := 0; i < len(source); {
+		c := rune(source[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '_' || unicode.IsLetter(c):
+			start := i
+			for i < len(source) && (source[i] == '_' || unicode.IsLetter(rune(source[i])) || unicode.IsDigit(rune(source[i]))) {
+				i++
+			}
+			tokens = append(tokens, predicateToken{tokenIdent, source[start:i], start})
+		case unicode.IsDigit(c):
+			start := i
+			for i < len(source) && (unicode.IsDigit(rune(source[i])) || unicode.IsLetter(rune(source[i]))) {
+				i++
+			}
+			tokens = append(tokens, predicateToken{tokenNumber, source[start:i], start})
+		case c == '"' || c == '\'':
+			start := i
+			i++
+			var text strings.Builder
+			for i < len(source) && rune(source[i]) != c {
+				if source[i] == '\\' && i+1 < len(source) {
+					i++
+				}
+				text.WriteByte(source[i])
+				i++
+			}
+			if i >= len(source) {
+				return nil, fmt.Errorf("unterminated string at offset %d", start)
+			}
+			i++
+			tokens = append(tokens, predicateToken{tokenString, text.String(), start})
+		default:
+			matched := false
+			for _, symbol := range predicateSymbols {
+				if strings.HasPrefix(source[i:], symbol) {
+					tokens = append(tokens, predicateToken{tokenOperator, symbol, i})
+					i += len(symbol)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected character %q at offset %d", c, i)
+			}
+		}
+	}
+	return append(tokens, predicateToken{tokenEOF, "end of expression", len(source)}), nil
+}
+
+// Parser
+
+type predicateParser struct {
+	tokens []predicateToken
+	pos    int
+}
+
+func (p *predicateParser) peek() predicateToken {
+	return p.tokens[p.pos]
+}
+
+func (p *predicateParser) next() predicateToken {
+	token := p.tokens[p.pos]
+	if token.kind != tokenEOF {
+		p.pos++
+	}
+	return token
+}
+
+// accept consumes the next token if it is the given symbol or keyword
+func (p *predicateParser) accept(text string) bool {
+	token := p.peek()
+	if (token.kind == tokenOperator || token.kind == tokenIdent) && token.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// parseComparison parses "field operator literal"
+func (p *predicateParser) parseComparison(fields map[string][]string) (predicateComparison, error) {
+	path, err := p.parsePath(fields)
+	if err != nil {
+		return predicateComparison{}, err
+	}
+	token := p.next()
+	if !containsString(predicateOperators, token.text) || (token.kind != tokenOperator && token.kind != tokenIdent) {
+		return predicateComparison{}, fmt.Errorf("unexpected %q at offset %d, expected one of %s",
+			token.text, token.pos, strings.Join(predicateOperators, " "))
+	}
+	comparison := predicateComparison{path: path, op: token.text}
+
+	valuePos := p.peek().pos
+	if comparison.value, err = p.parseLiteral(comparison.op == "in"); err != nil {
+		return predicateComparison{}, err
+	}
+	switch comparison.op {
+	case "in":
+		if _, ok := comparison.value.([]interface{}); !ok {
+			return predicateComparison{}, fmt.Errorf("in needs a list at offset %d, got %s", valuePos, describeValue(comparison.value))
+		}
+	case "<", "<=", ">", ">=":
+		if _, ok := comparison.value.(*big.Int); !ok {
+			return predicateComparison{}, fmt.Errorf("%s needs a number at offset %d, got %s", comparison.op, valuePos, describeValue(comparison.value))
+		}
+	}
+	return comparison, nil
+}
+
+// parsePath parses a root field followed by .member and [index] steps and
+// checks the root and, where they are known, its fields
+func (p *predicateParser) parsePath(fields map[string][]string) (predicatePath, error) {
+	token := p.next()
+	if token.kind != tokenIdent {
+		return predicatePath{}, fmt.Errorf("unexpected %q at offset %d, expected a field", token.text, token.pos)
+	}
+	if _, ok := predicateRoots[token.text]; !ok {
+		roots := make([]string, 0, len(predicateRoots))
+		for root := range predicateRoots {
+			roots = append(roots, root)
+		}
+		sort.Strings(roots)
+		return predicatePath{}, fmt.Errorf("unknown field %q at offset %d, expected one of %s", token.text, token.pos, strings.Join(roots, ", "))
+	}
+	path := predicatePath{root: token.text}
+
+	for {
+		var member string
+		switch {
+		case p.accept("."):
+			token := p.next()
+			if token.kind != tokenIdent {
+				return predicatePath{}, fmt.Errorf("expected a field name at offset %d, found %q", token.pos, token.text)
+			}
+			member = token.text
+		case p.accept("["):
+			token := p.next()
+			switch token.kind {
+			case tokenString:
+				member = token.text
+			case tokenNumber:
+				n, ok := parsePredicateNumber(token.text)
+				if !ok || !n.IsInt64() {
+					return predicatePath{}, fmt.Errorf("invalid index %q at offset %d", token.text, token.pos)
+				}
+				path.steps = append(path.steps, int(n.Int64()))
+			default:
+				return predicatePath{}, fmt.Errorf("expected an index or a field name in quotes at offset %d, found %q", token.pos, token.text)
+			}
+			if !p.accept("]") {
+				return predicatePath{}, fmt.Errorf("expected \"]\" at offset %d, found %q", p.peek().pos, p.peek().text)
+			}
+			if token.kind == tokenNumber {
+				continue
+			}
+		default:
+			return path, nil
+		}
+
+		if known, ok := fields[path.root]; ok && len(path.steps) == 0 && !containsString(known, member) {
+			return predicatePath{}, fmt.Errorf("%s has no field %q, it has %s", path.root, member, strings.Join(known, ", "))
+		}
+		path.steps = append(path.steps, member)
+	}
+}
+
+// parseLiteral parses a number, string, true or false and, with list set, a
+// list of those
+func (p *predicateParser) parseLiteral(list bool) (interface{}, error) {
+	token := p.next()
+	switch token.kind {
+	case tokenNumber:
+		n, ok := parsePredicateNumber(token.text)
+		if !ok {
+			return nil, fmt.Errorf("invalid number %q at offset %d", token.text, token.pos)
+		}
+		return n, nil
+	case tokenString:
+		return token.text, nil
+	case tokenIdent:
+		if token.text == "true" || token.text == "false" {
+			return token.text == "true", nil
+		}
+	case tokenOperator:
+		switch {
+		case token.text == "-":
+			number := p.next()
+			n, ok := parsePredicateNumber(number.text)
+			if number.kind != tokenNumber || !ok {
+				return nil, fmt.Errorf("expected a number after '-' at offset %d", token.pos)
+			}
+			return n.Neg(n), nil
+		case token.text == "[" && list:
+			var values []interface{}
+			for !p.accept("]") {
+				if len(values) > 0 && !p.accept(",") {
+					return nil, fmt.Errorf("expected \",\" or \"]\" at offset %d, found %q", p.peek().pos, p.peek().text)
+				}
+				value, err := p.parseLiteral(false)
+				if err != nil {
+					return nil, err
+				}
+				values = append(values, value)
+			}
+			return values, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected %q at offset %d, expected a number, a string, true or false", token.text, token.pos)
+}
+
+// parsePredicateNumber parses a decimal or 0x-prefixed hex integer
+func parsePredicateNumber(text string) (*big.Int, bool) {
+	if strings.HasPrefix(text, "0x") || strings.HasPrefix(text, "0X") {
+		return new(big.Int).SetString(text[2:], 16)
+	}
+	return new(big.Int).SetString(text, 10)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Evaluation
+
+// resolve reads the field at the path from an event's fields
+func (path predicatePath) resolve(env map[string]interface{}) (interface{}, error) {
+	value, ok := env[path.root]
+	if !ok {
+		return nil, fmt.Errorf("%s is not available for this event", path.root)
+	}
+	for _, step := range path.steps {
+		switch step := step.(type) {
+		case string:
+			fields, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("cannot read field %s of %s", step, describeValue(value))
+			}
+			if value, ok = fields[step]; !ok {
+				return nil, fmt.Errorf("no field %s", step)
+			}
+		case int:
+			list, ok := value.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("cannot index %s", describeValue(value))
+			}
+			if step < 0 || step >= len(list) {
+				return nil, fmt.Errorf("index %d out of range for a list of %d", step, len(list))
+			}
+			value = list[step]
+		}
+	}
+	return value, nil
+}
+
+func (c predicateComparison) eval(env map[string]interface{}) (bool, error) {
+	value, err := c.path.resolve(env)
+	if err != nil {
+		return false, err
+	}
+
+	switch c.op {
+	case "==":
+		return predicateEqual(value, c.value), nil
+	case "!=":
+		return !predicateEqual(value, c.value), nil
+	case "in":
+		for _, element := range c.value.([]interface{}) {
+			if predicateEqual(value, element) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	a, ok := predicateNumber(value)
+	if !ok {
+		return false, fmt.Errorf("%s compares %s, expected a number", c.op, describeValue(value))
+	}
+	cmp := a.Cmp(c.value.(*big.Int))
+	switch c.op {
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	default:
+		return cmp >= 0, nil
+	}
+}
+
+// predicateNumber converts decoded values to integers: Go integers, decimal
+// strings as used for wide integers, and hex strings as used for felts
+func predicateNumber(value interface{}) (*big.Int, bool) {
+	switch v := value.(type) {
+	case *big.Int:
+		return v, true
+	case int:
+		return big.NewInt(int64(v)), true
+	case int64:
+		return big.NewInt(v), true
+	case uint64:
+		return new(big.Int).SetUint64(v), true
+	case float64:
+		if v != float64(int64(v)) {
+			return nil, false
+		}
+		return big.NewInt(int64(v)), true
+	case string:
+		if v == "" {
+			return nil, false
+		}
+		if strings.HasPrefix(v, "-") {
+			n, ok := parsePredicateNumber(v[1:])
+			if !ok {
+				return nil, false
+			}
+			return n.Neg(n), true
+		}
+		return parsePredicateNumber(v)
+	}
+	return nil, false
+}
+
+// predicateEqual compares numerically when both sides are numbers and by value
+// otherwise
+func predicateEqual(a, b interface{}) bool {
+	if x, ok := predicateNumber(a); ok {
+		if y, ok := predicateNumber(b); ok {
+			return x.Cmp(y) == 0
+		}
+	}
+	switch x := a.(type) {
+	case string:
+		y, ok := b.(string)
+		return ok && x == y
+	case bool:
+		y, ok := b.(bool)
+		return ok && x == y
+	}
+	return false
+}
+
+// describeValue names a value's type for error messages
+func describeValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "nothing"
+	case bool:
+		return fmt.Sprintf("%t", v)
+	case string:
+		return fmt.Sprintf("the string %q", v)
+	case []interface{}:
+		return "a list"
+	case map[string]interface{}:
+		return "a record"
+	}
+	if n, ok := predicateNumber(value); ok {
+		return "the number " + n.String()
+	}
+	return fmt.Sprintf("%T", value)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParsePredicateErrors(t *testing.T) {
+	fields := map[string][]string{"record": {"troop_amount", "explorer_id"}}
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"", "unexpected \"end of expression\" at offset 0, expected a field"},
+		{"block_number >", "unexpected \"end of expression\" at offset 14, expected a number"},
+		{"block_number > 1)", "unexpected character ')' at offset 16"},
+		{"block_number > 1 || true", "unexpected character '|' at offset 17"},
+		{"block_number > 1 block_number", "unexpected \"block_number\" at offset 17, expected && or the end"},
+		{"tx_hash == 'abc", "unterminated string at offset 11"},
+		{"block_number # 1", "unexpected character '#' at offset 13"},
+		{"blocknumber > 1", "unknown field \"blocknumber\" at offset 0"},
+		{"record.troops > 1", "record has no field \"troops\""},
+		{"record['troops'] > 1", "record has no field \"troops\""},
+		{"record. > 1", "expected a field name at offset 8"},
+		{"keys[x] == 1", "expected an index or a field name in quotes at offset 5"},
+		{"keys[0 == 1", "expected \"]\" at offset 7"},
+		{"0xzz > 1", "expected a field"},
+		{"block_number > 0xzz", "invalid number \"0xzz\""},
+		{"block_number > -x", "expected a number after '-'"},
+		{"block_number", "expected one of == != <= >= < > in"},
+		{"block_number in [1, 2", "expected \",\" or \"]\""},
+		{"block_number in [[1]]", "unexpected \"[\" at offset 17"},
+		{"keys[0] in 5", "in needs a list at offset 11, got the number 5"},
+		{"block_number == [1]", "unexpected \"[\""},
+		{"tx_hash < 'a'", "< needs a number at offset 10, got the string \"a\""},
+		{"block_number > keys", "unexpected \"keys\""},
+		{"in == 1", "unknown field \"in\""},
+	}
+	for _, test := range tests {
+		_, err := parsePredicate(test.source, fields)
+		if err == nil {
+			t.Errorf("parsePredicate(%q) succeeded, want an error containing %q", test.source, test.want)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.want) {
+			t.Errorf("parsePredicate(%q) = %q, want an error containing %q", test.source, err, test.want)
+		}
+	}
+}
+
+// testPredicateEnv is the environment of a StoreSetRecord event decoded with an ABI
+func testPredicateEnv() map[string]interface{} {
+	event := StarknetEvent{
+		BlockNumber:     100,
+		TransactionHash: "0xabc",
+		FromAddress:     "0x0123",
+		Keys:            []string{"0x1", "0x2"},
+		Data:            []string{"0x0a"},
+	}
+	dojoEvent := &DojoEvent{
+		Kind:     DojoStoreSetRecord,
+		Selector: "0x2",
+		EntityID: "0x99",
+		Record: map[string]interface{}{
+			"troop_amount": "300",
+			"explorer_id":  uint64(57),
+			"name":         "bob",
+			"alive":        true,
+		},
+	}
+	decoded := &DecodedEvent{Name: "test::Moved", Fields: map[string]interface{}{"delta": "-5"}}
+	return predicateEnv(event, dojoEvent, decoded)
+}
+
+func TestPredicateEval(t *testing.T) {
+	tests := []struct {
+		source string
+		want   bool
+	}{
+		{"block_number >= 100", true},
+		{"block_number > 100", false},
+		{"record.troop_amount > 0 && record.explorer_id in [12, 57, 0x9a]", true},
+		{"record.explorer_id in [12, 0x9a]", false},
+		{"data[0] == 10", true},
+		{"keys[1] == 0x2 && keys[0] != 2", true},
+		{"record['name'] == 'bob'", true},
+		{"record.name != \"alice\"", true},
+		{"record.alive == true && record.alive != false", true},
+		{"dojo.kind == 'StoreSetRecord' && dojo.entity_id == 0x99", true},
+		{"dojo.keys in [1]", false},
+		{"decoded.delta == -5 && decoded.delta < 0", true},
+		{"contract == 0x123", true},
+		{"tx_hash == '0xabc'", true},
+		// Comparisons after one that does not hold are not evaluated, so the
+		// missing field is no error
+		{"block_number < 0 && record.missing > 1", false},
+	}
+	env := testPredicateEnv()
+	for _, test := range tests {
+		predicate, err := parsePredicate(test.source, nil)
+		if err != nil {
+			t.Errorf("parsePredicate(%q) failed: %v", test.source, err)
+			continue
+		}
+		got, err := predicate.Eval(env)
+		if err != nil {
+			t.Errorf("Eval(%q) failed: %v", test.source, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("Eval(%q) = %t, want %t", test.source, got, test.want)
+		}
+	}
+}
+
+func TestPredicateEvalErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"record.missing > 1", "no field missing"},
+		{"block_number > 0 && record.missing > 1", "no field missing"},
+		{"keys[5] == 1", "index 5 out of range for a list of 2"},
+		{"record[1] == 1", "cannot index a record"},
+		{"record.name > 1", "> compares the string \"bob\", expected a number"},
+		{"record.alive.x == 1", "cannot read field x of true"},
+		{"block_number[0] == 1", "cannot index the number 100"},
+	}
+	env := testPredicateEnv()
+	for _, test := range tests {
+		predicate, err := parsePredicate(test.source, nil)
+		if err != nil {
+			t.Errorf("parsePredicate(%q) failed: %v", test.source, err)
+			continue
+		}
+		_, err = predicate.Eval(env)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("Eval(%q) = %v, want an error containing %q", test.source, err, test.want)
+		}
+	}
+
+	// Plain events have no Dojo parts
+	predicate, err := parsePredicate("dojo.kind == 'EventEmitted'", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := predicate.Eval(predicateEnv(StarknetEvent{}, nil, nil)); err == nil || !strings.Contains(err.Error(), "dojo is not available") {
+		t.Errorf("Eval without a Dojo event = %v, want dojo is not available", err)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// JobQueue decouples event detection from Job creation. The listener queues a
+// task per matched event and rule and moves on to the next block range while
+// --job-workers workers create the Jobs. When the queue is full the listener
+// waits, so a burst of events slows scanning down instead of piling up.
+type JobQueue struct {
+	tasks   chan jobTask
+	workers int
+	wg      sync.WaitGroup
+	// Held for reading while a task is sent and for writing to close tasks
+	mu     sync.RWMutex
+	closed bool
+
+	busy        atomic.Int64
+	enqueued    atomic.Int64
+	completed   atomic.Int64
+	failed      atomic.Int64
+	backpressed atomic.Int64
+	// Nanoseconds the listener spent waiting for room in the queue
+	blockedNanos atomic.Int64
+}
+
+// jobTask is an event handed to one of the rules it matched
+type jobTask struct {
+	event       EventPayload
+	rule        *WatchRule
+	blockNumber int
+	blockHash   string
+	batch       *jobBatch
+	queuedAt    time.Time
+}
+
+var (
+	jobQueue *JobQueue
+	// Paces Job creations to --job-create-rate per second
+	jobCreateLimiter = rate.NewLimiter(rate.Inf, 1)
+	// Nanoseconds Job creations waited for the rate limiter
+	jobCreateThrottledNanos atomic.Int64
+)
+
+// newJobQueue starts workers workers on a queue holding up to size tasks
+func newJobQueue(size, workers int) *JobQueue {
+	q := &JobQueue{tasks: make(chan jobTask, max(size, 0)), workers: max(workers, 1)}
+	for i := 0; i < q.workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+	return q
+}
+
+// newJobCreateLimiter allows perSecond Job creations a second, with bursts of
+// up to burst; 0 or less means no limit
+func newJobCreateLimiter(perSecond float64, burst int) *rate.Limiter {
+	if perSecond <= 0 {
+		return rate.NewLimiter(rate.Inf, 1)
+	}
+	return rate.NewLimiter(rate.Limit(perSecond), max(burst, 1))
+}
+
+// waitForJobCreation blocks until the rate limiter allows another Job
+func waitForJobCreation(ctx context.Context) error {
+	start := time.Now()
+	err := jobCreateLimiter.Wait(ctx)
+	jobCreateThrottledNanos.Add(int64(time.Since(start)))
+	return err
+}
+
+// enqueue adds a task to its batch and the queue, waiting while the queue is
+// full. A task that cannot be queued before ctx is done or after the queue was
+// drained fails its block.
+func (q *JobQueue) enqueue(ctx context.Context, task jobTask) {
+	task.batch.add()
+	task.queuedAt = time.Now()
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		log.Errorf("Job queue is closed, not queueing the Job of event %s for rule %s", task.event.EventID, task.rule)
+		task.batch.finish(nil, task)
+		return
+	}
+	select {
+	case q.tasks <- task:
+	default:
+		q.backpressed.Add(1)
+		log.Debugf("Job queue is full (%d tasks), waiting for a worker", cap(q.tasks))
+		start := time.Now()
+		select {
+		case q.tasks <- task:
+			q.blockedNanos.Add(int64(time.Since(start)))
+		case <-ctx.Done():
+			q.blockedNanos.Add(int64(time.Since(start)))
+			log.Errorf("Gave up queueing the Job of event %s for rule %s: %v", task.event.EventID, task.rule, ctx.Err())
+			task.batch.finish(nil, task)
+			return
+		}
+	}
+	q.enqueued.Add(1)
+}
+
+// work creates the Jobs of queued tasks until the queue is closed
+func (q *JobQueue) work() {
+	defer q.wg.Done()
+	for task := range q.tasks {
+		q.busy.Add(1)
+		log.Debugf("Creating the Job of event %s for rule %s after %s in the queue",
+			task.event.EventID, task.rule, time.Since(task.queuedAt))
+		job := handleEventEmitted(task.event, task.rule)
+		if job != nil {
+			q.completed.Add(1)
+			task.batch.finish(&dispatchedJob{
+				EventID:     task.event.EventID,
+				Rule:        task.rule.Name,
+				JobName:     job.Name,
+				Namespace:   job.Namespace,
+				BlockNumber: task.blockNumber,
+				BlockHash:   task.blockHash,
+			}, task)
+		} else {
+			q.failed.Add(1)
+			task.batch.finish(nil, task)
+		}
+		q.busy.Add(-1)
+	}
+}
+
+// Drain stops taking tasks and waits until ctx is done for the workers to
+// create the Jobs already queued. Listeners that did not stop in time fail
+// the tasks they queue afterwards, so their blocks are scanned again after a
+// restart.
+func (q *JobQueue) Drain(ctx context.Context) bool {
+	if q == nil {
+		return true
+	}
+	// A listener may still be waiting for room in the queue
+	if !waitUntil(ctx, q.close) {
+		return false
+	}
+	return waitUntil(ctx, q.wg.Wait)
+}
+
+// Pending returns the number of Job creations queued or in progress
+func (q *JobQueue) Pending() int {
+	if q == nil {
+		return 0
+	}
+	return len(q.tasks) + int(q.busy.Load())
+}
+
+// close closes the queue once no task is being sent
+func (q *JobQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	q.closed = true
+	if depth := len(q.tasks); depth > 0 {
+		log.Infof("Creating the %d queued Job(s) before stopping", depth)
+	}
+	close(q.tasks)
+}
+
+// writeMetrics reports the queue's depth, the workers' activity and how often
+// the listener had to wait for the queue or the rate limiter
+func (q *JobQueue) writeMetrics(w io.Writer) {
+	writeMetric(w, "chairman_job_queue_depth", "gauge", "Job creations waiting in the queue", float64(len(q.tasks)))
+	writeMetric(w, "chairman_job_queue_capacity", "gauge", "Job creations the queue holds before the listener waits", float64(cap(q.tasks)))
+	writeMetric(w, "chairman_job_queue_workers", "gauge", "Workers creating queued Jobs", float64(q.workers))
+	writeMetric(w, "chairman_job_queue_busy_workers", "gauge", "Workers creating a Job right now", float64(q.busy.Load()))
+	writeMetric(w, "chairman_job_queue_enqueued_total", "counter", "Job creations queued by the listener", float64(q.enqueued.Load()))
+	writeMetric(w, "chairman_job_queue_completed_total", "counter", "Queued events whose Job was created or already existed", float64(q.completed.Load()))
+	writeMetric(w, "chairman_job_queue_failed_total", "counter", "Queued events whose Job could not be created", float64(q.failed.Load()))
+	writeMetric(w, "chairman_job_queue_full_total", "counter", "Times the listener waited for room in a full queue", float64(q.backpressed.Load()))
+	writeMetric(w, "chairman_job_queue_blocked_seconds_total", "counter", "Time the listener spent waiting for room in the queue", time.Duration(q.blockedNanos.Load()).Seconds())
+	writeMetric(w, "chairman_job_create_throttled_seconds_total", "counter", "Time Job creations waited for --job-create-rate", time.Duration(jobCreateThrottledNanos.Load()).Seconds())
+}
+
+// jobBatch collects the outcome of the Jobs queued for one block range
+type jobBatch struct {
+	fromBlock int
+	// Closed once the batch is sealed and all its Jobs are done
+	done chan struct{}
+
+	mu      sync.Mutex
+	pending int
+	sealed  bool
+	// Jobs that exist for the range's events
+	jobs []dispatchedJob
+	// First block with a Job that could not be created, or -1
+	failedBlock int
+}
+
+func newJobBatch(fromBlock int) *jobBatch {
+	return &jobBatch{fromBlock: fromBlock, done: make(chan struct{}), failedBlock: -1}
+}
+
+func (b *jobBatch) add() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pending++
+}
+
+// finish records a task's Job, or its failure when job is nil
+func (b *jobBatch) finish(job *dispatchedJob, task jobTask) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if job != nil {
+		b.jobs = append(b.jobs, *job)
+	} else if b.failedBlock < 0 || task.blockNumber < b.failedBlock {
+		b.failedBlock = task.blockNumber
+	}
+	b.pending--
+	b.closeIfDone()
+}
+
+// seal marks that no more tasks are added to the batch
+func (b *jobBatch) seal() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sealed = true
+	b.closeIfDone()
+}
+
+func (b *jobBatch) closeIfDone() {
+	if b.sealed && b.pending == 0 {
+		close(b.done)
+	}
+}
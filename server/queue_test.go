@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestJobBatch(t *testing.T) {
+	tests := []struct {
+		name string
+		// Block of each task, and whether its Job was created
+		blocks  []int
+		created []bool
+		jobs    int
+		failed  int
+	}{
+		{name: "empty", failed: -1},
+		{name: "all created", blocks: []int{11, 11, 12}, created: []bool{true, true, true}, jobs: 3, failed: -1},
+		// Tasks finish out of order, the lowest failed block counts
+		{name: "some failed", blocks: []int{13, 11, 12}, created: []bool{false, true, false}, jobs: 1, failed: 12},
+	}
+	for _, test := range tests {
+		batch := newJobBatch(11)
+		tasks := make([]jobTask, len(test.blocks))
+		for i, blockNumber := range test.blocks {
+			tasks[i] = jobTask{blockNumber: blockNumber, batch: batch}
+			batch.add()
+		}
+		batch.seal()
+		for i, task := range tasks {
+			select {
+			case <-batch.done:
+				t.Fatalf("%s: batch done with %d task(s) left", test.name, len(tasks)-i)
+			default:
+			}
+			if test.created[i] {
+				batch.finish(&dispatchedJob{BlockNumber: task.blockNumber}, task)
+			} else {
+				batch.finish(nil, task)
+			}
+		}
+		select {
+		case <-batch.done:
+		default:
+			t.Fatalf("%s: batch not done after its tasks finished", test.name)
+		}
+		if len(batch.jobs) != test.jobs || batch.failedBlock != test.failed {
+			t.Errorf("%s: %d Job(s) with failed block %d, want %d with failed block %d",
+				test.name, len(batch.jobs), batch.failedBlock, test.jobs, test.failed)
+		}
+	}
+}
+
+func TestJobQueue(t *testing.T) {
+	clientset := useFakeClientset(t)
+	rules := useTestRules(t, `namespace: agents
+rules:
+  - name: moved
+    contract: "0x1"
+    selector: Moved
+`)
+	rule := rules.Rules[0]
+	newTask := func(batch *jobBatch, blockNumber int) jobTask {
+		event, _, _, err := newEventPayload(defaultStarknetConfig, StarknetEvent{
+			BlockNumber:     blockNumber,
+			BlockHash:       testBlockHash(blockNumber),
+			TransactionHash: "0x9",
+			FromAddress:     "0x1",
+			Keys:            []string{starknetKeccak("Moved")},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return jobTask{event: event.forRule(rule), rule: rule, blockNumber: blockNumber, blockHash: testBlockHash(blockNumber), batch: batch}
+	}
+
+	// A queue of one makes the listener wait for the workers
+	queue := newJobQueue(1, 2)
+	batch := newJobBatch(11)
+	for blockNumber := 11; blockNumber <= 14; blockNumber++ {
+		queue.enqueue(context.Background(), newTask(batch, blockNumber))
+	}
+	batch.seal()
+	<-batch.done
+	if len(batch.jobs) != 4 || batch.failedBlock != -1 {
+		t.Errorf("batch has %d Job(s) and failed block %d, want 4 Jobs and none failed", len(batch.jobs), batch.failedBlock)
+	}
+	jobs, err := clientset.BatchV1().Jobs("agents").List(context.Background(), metav1.ListOptions{})
+	if err != nil || len(jobs.Items) != 4 {
+		t.Errorf("the cluster has %d Job(s), %v, want 4", len(jobs.Items), err)
+	}
+
+	if !queue.Drain(context.Background()) {
+		t.Fatal("Drain timed out")
+	}
+	// A listener that did not stop in time fails its block, so it is scanned again
+	batch = newJobBatch(15)
+	queue.enqueue(context.Background(), newTask(batch, 15))
+	batch.seal()
+	<-batch.done
+	if len(batch.jobs) != 0 || batch.failedBlock != 15 {
+		t.Errorf("after Drain, batch has %d Job(s) and failed block %d, want none and block 15 failed", len(batch.jobs), batch.failedBlock)
+	}
+}
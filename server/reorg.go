@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// dispatchedJob records a Job created for an on-chain event, so it can be
+// reverted if the event's block is reorganised away
+type dispatchedJob struct {
+	EventID     string
+	Rule        string
+	JobName     string
+	Namespace   string
+	BlockNumber int
+	BlockHash   string
+}
+
+// chainHistory remembers the hashes of recently processed blocks and the jobs
+// created in them. It only keeps the last limit blocks; anything older is
+// treated as final.
+type chainHistory struct {
+	limit  int
+	hashes map[int]string
+	jobs   map[int][]dispatchedJob
+}
+
+func newChainHistory(limit int) *chainHistory {
+	return &chainHistory{
+		limit:  limit,
+		hashes: make(map[int]string),
+		jobs:   make(map[int][]dispatchedJob),
+	}
+}
+
+func (h *chainHistory) enabled() bool {
+	return h.limit > 0
+}
+
+// record remembers the hash of a processed block
+func (h *chainHistory) record(blockNumber int, blockHash string) {
+	if h.enabled() && blockHash != "" {
+		h.hashes[blockNumber] = blockHash
+	}
+}
+
+// recordJob remembers a job created for an event in a processed block
+func (h *chainHistory) recordJob(job dispatchedJob) {
+	if h.enabled() {
+		h.jobs[job.BlockNumber] = append(h.jobs[job.BlockNumber], job)
+	}
+}
+
+// numbers returns the recorded block numbers, highest first
+func (h *chainHistory) numbers() []int {
+	numbers := make([]int, 0, len(h.hashes))
+	for blockNumber := range h.hashes {
+		numbers = append(numbers, blockNumber)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(numbers)))
+	return numbers
+}
+
+// trim forgets blocks that are more than limit blocks behind the newest one
+func (h *chainHistory) trim() {
+	numbers := h.numbers()
+	if len(numbers) == 0 {
+		return
+	}
+	oldest := numbers[0] - h.limit
+	for blockNumber := range h.hashes {
+		if blockNumber <= oldest {
+			delete(h.hashes, blockNumber)
+		}
+	}
+	for blockNumber := range h.jobs {
+		if blockNumber <= oldest {
+			delete(h.jobs, blockNumber)
+		}
+	}
+}
+
+// rewind forgets every block above forkBlock and returns the jobs created in
+// them, ordered by block
+func (h *chainHistory) rewind(forkBlock int) []dispatchedJob {
+	for blockNumber := range h.hashes {
+		if blockNumber > forkBlock {
+			delete(h.hashes, blockNumber)
+		}
+	}
+
+	var reverted []dispatchedJob
+	var blockNumbers []int
+	for blockNumber := range h.jobs {
+		if blockNumber > forkBlock {
+			blockNumbers = append(blockNumbers, blockNumber)
+		}
+	}
+	sort.Ints(blockNumbers)
+	for _, blockNumber := range blockNumbers {
+		reverted = append(reverted, h.jobs[blockNumber]...)
+		delete(h.jobs, blockNumber)
+	}
+	return reverted
+}
+
+// verifyAndRecord checks a freshly fetched range against the chain: the first
+// block must build on the last recorded block, and every event must belong to
+// the block the headers report. On success the block hashes are recorded.
+func (h *chainHistory) verifyAndRecord(fromBlock, toBlock int, events []StarknetEvent, headers map[int]StarknetBlockHeader) error {
+	if !h.enabled() {
+		return nil
+	}
+
+	first := headers[fromBlock]
+	if parent, ok := h.hashes[fromBlock-1]; ok && !sameFelt(first.ParentHash, parent) {
+		return fmt.Errorf("block %d has parent %s but block %d was %s", fromBlock, first.ParentHash, fromBlock-1, parent)
+	}
+	for _, event := range events {
+		header, ok := headers[event.BlockNumber]
+		if ok && event.BlockHash != "" && !sameFelt(event.BlockHash, header.BlockHash) {
+			return fmt.Errorf("event in block %d has block hash %s but the block is now %s", event.BlockNumber, event.BlockHash, header.BlockHash)
+		}
+	}
+
+	for blockNumber, header := range headers {
+		if blockNumber >= fromBlock && blockNumber <= toBlock {
+			h.record(blockNumber, header.BlockHash)
+		}
+	}
+	return nil
+}
+
+// rangeHeaders fetches, in one batch, the headers verifyAndRecord needs for a
+// set of ranges: each range's first and last block plus every block with events
+func (s *blockScanner) rangeHeaders(ctx context.Context, ranges [][2]int, results []EventRangeResult) (map[int]StarknetBlockHeader, error) {
+	if !s.history.enabled() {
+		return nil, nil
+	}
+
+	wanted := make(map[int]bool)
+	for i, r := range ranges {
+		wanted[r[0]] = true
+		wanted[r[1]] = true
+		for _, event := range results[i].Events {
+			wanted[event.BlockNumber] = true
+		}
+	}
+	blockNumbers := make([]int, 0, len(wanted))
+	for blockNumber := range wanted {
+		blockNumbers = append(blockNumbers, blockNumber)
+	}
+	sort.Ints(blockNumbers)
+	return getBlockHeaders(ctx, blockNumbers)
+}
+
+// detectReorg checks that the last processed block is still canonical. If it
+// is not, it finds the fork point among the recorded blocks, reverts the jobs
+// created above it and returns the block to resume scanning from.
+func (s *blockScanner) detectReorg(ctx context.Context, nextBlock int) (int, error) {
+	tip := nextBlock - 1
+	recorded, ok := s.history.hashes[tip]
+	if !ok {
+		return nextBlock, nil
+	}
+
+	headers, err := getBlockHeaders(ctx, []int{tip})
+	if err != nil {
+		return nextBlock, err
+	}
+	if sameFelt(headers[tip].BlockHash, recorded) {
+		return nextBlock, nil
+	}
+	log.Warnf("Chain reorganization detected: block %d was %s and is now %s", tip, recorded, headers[tip].BlockHash)
+
+	// Compare every recorded block in one batch and keep the highest one that
+	// is still canonical
+	numbers := s.history.numbers()
+	headers, err = getBlockHeaders(ctx, numbers)
+	if err != nil {
+		return nextBlock, fmt.Errorf("failed to locate fork point: %w", err)
+	}
+	forkBlock := numbers[len(numbers)-1] - 1
+	for _, blockNumber := range numbers {
+		if sameFelt(headers[blockNumber].BlockHash, s.history.hashes[blockNumber]) {
+			forkBlock = blockNumber
+			break
+		}
+	}
+	if forkBlock < numbers[len(numbers)-1] {
+		log.Warnf("Reorg is deeper than the %d remembered blocks, rewinding to block %d", s.history.limit, forkBlock+1)
+	}
+
+	reverted := s.history.rewind(forkBlock)
+	log.Warnf("Rewinding listener from block %d to %d, %d job(s) affected", nextBlock, forkBlock+1, len(reverted))
+	revertJobs(ctx, reverted)
+	return forkBlock + 1, nil
+}
+
+// revertJobs emits the "reverted" lifecycle action for jobs whose events are no
+// longer on the canonical chain: the Job is labelled lifecycle=reverted, or
+// deleted when --delete-reverted-jobs is set
+func revertJobs(ctx context.Context, jobs []dispatchedJob) {
+	for _, job := range jobs {
+		log.Warnf("Event %s in block %d (%s) was reverted, lifecycle action: reverted (job %s)",
+			job.EventID, job.BlockNumber, job.BlockHash, job.JobName)
+		// The event may be included again in the new chain, and should spawn then
+		dedupStore.Forget(dedupKey(job.EventID, job.Rule))
+
+		if *deleteRevertedJobs {
+			deletePolicy := metav1.DeletePropagationBackground
+			err := kubernetesClientset.BatchV1().Jobs(job.Namespace).Delete(ctx, job.JobName, metav1.DeleteOptions{
+				PropagationPolicy: &deletePolicy,
+			})
+			if err != nil && !apierrors.IsNotFound(err) {
+				log.Errorf("Failed to delete reverted Job %s: %v", job.JobName, err)
+			} else {
+				log.Infof("Deleted reverted Job %s", job.JobName)
+			}
+			continue
+		}
+
+		patch, _ := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"labels": map[string]string{"lifecycle": "reverted"},
+				"annotations": map[string]string{
+					"chairman/reverted-at":         time.Now().UTC().Format(time.RFC3339),
+					"chairman/reverted-block-hash": job.BlockHash,
+				},
+			},
+		})
+		_, err := kubernetesClientset.BatchV1().Jobs(job.Namespace).Patch(ctx, job.JobName, types.MergePatchType, patch, metav1.PatchOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			log.Errorf("Failed to label reverted Job %s: %v", job.JobName, err)
+		}
+	}
+}
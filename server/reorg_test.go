@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	batchv1 "k8s.io/api/batch/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func testHeaders(fromBlock, toBlock int) map[int]StarknetBlockHeader {
+	headers := make(map[int]StarknetBlockHeader)
+	for blockNumber := fromBlock; blockNumber <= toBlock; blockNumber++ {
+		headers[blockNumber] = StarknetBlockHeader{
+			BlockNumber: blockNumber,
+			BlockHash:   testBlockHash(blockNumber),
+			ParentHash:  testBlockHash(blockNumber - 1),
+		}
+	}
+	return headers
+}
+
+func TestChainHistoryVerifyAndRecord(t *testing.T) {
+	tests := []struct {
+		name     string
+		limit    int
+		recorded map[int]string
+		events   []StarknetEvent
+		headers  map[int]StarknetBlockHeader
+		err      bool
+		want     map[int]string
+	}{
+		{
+			name:     "extends the recorded chain",
+			limit:    8,
+			recorded: map[int]string{9: testBlockHash(9)},
+			events:   []StarknetEvent{{BlockNumber: 11, BlockHash: testBlockHash(11)}},
+			headers:  testHeaders(10, 12),
+			want:     map[int]string{9: testBlockHash(9), 10: testBlockHash(10), 11: testBlockHash(11), 12: testBlockHash(12)},
+		},
+		{
+			name:     "first block has another parent",
+			limit:    8,
+			recorded: map[int]string{9: "0xdead"},
+			headers:  testHeaders(10, 12),
+			err:      true,
+			want:     map[int]string{9: "0xdead"},
+		},
+		{
+			name:    "event from a replaced block",
+			limit:   8,
+			events:  []StarknetEvent{{BlockNumber: 11, BlockHash: "0xdead"}},
+			headers: testHeaders(10, 12),
+			err:     true,
+			want:    map[int]string{},
+		},
+		{
+			name:    "disabled",
+			headers: testHeaders(10, 12),
+			want:    map[int]string{},
+		},
+	}
+	for _, test := range tests {
+		history := newChainHistory(test.limit)
+		for blockNumber, hash := range test.recorded {
+			history.record(blockNumber, hash)
+		}
+		err := history.verifyAndRecord(10, 12, test.events, test.headers)
+		if (err != nil) != test.err {
+			t.Errorf("%s: verifyAndRecord error = %v, want error %t", test.name, err, test.err)
+		}
+		if !reflect.DeepEqual(history.hashes, test.want) {
+			t.Errorf("%s: recorded %v, want %v", test.name, history.hashes, test.want)
+		}
+	}
+}
+
+func TestChainHistoryRewind(t *testing.T) {
+	history := newChainHistory(8)
+	for blockNumber := 10; blockNumber <= 13; blockNumber++ {
+		history.record(blockNumber, testBlockHash(blockNumber))
+	}
+	for _, job := range []dispatchedJob{
+		{JobName: "job-13", BlockNumber: 13},
+		{JobName: "job-10", BlockNumber: 10},
+		{JobName: "job-11", BlockNumber: 11},
+	} {
+		history.recordJob(job)
+	}
+
+	reverted := history.rewind(10)
+	var names []string
+	for _, job := range reverted {
+		names = append(names, job.JobName)
+	}
+	if want := []string{"job-11", "job-13"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("rewind(10) reverted %v, want %v", names, want)
+	}
+	if want := []int{10}; !reflect.DeepEqual(history.numbers(), want) {
+		t.Errorf("after rewind(10) blocks %v are recorded, want %v", history.numbers(), want)
+	}
+	if len(history.jobs[10]) != 1 {
+		t.Errorf("rewind(10) dropped the Job of block 10")
+	}
+
+	history = newChainHistory(2)
+	for blockNumber := 10; blockNumber <= 13; blockNumber++ {
+		history.record(blockNumber, testBlockHash(blockNumber))
+	}
+	history.trim()
+	if want := []int{13, 12}; !reflect.DeepEqual(history.numbers(), want) {
+		t.Errorf("after trim blocks %v are recorded, want %v", history.numbers(), want)
+	}
+}
+
+func TestRevertJobs(t *testing.T) {
+	tests := []struct {
+		name    string
+		delete  bool
+		exists  bool
+		labeled bool
+	}{
+		{name: "labelled", exists: true, labeled: true},
+		{name: "deleted", delete: true},
+	}
+	for _, test := range tests {
+		clientset := useFakeClientset(t, &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: "agent-1", Namespace: "agents"}})
+		saved := *deleteRevertedJobs
+		*deleteRevertedJobs = test.delete
+
+		revertJobs(context.Background(), []dispatchedJob{
+			{EventID: "starknet-emitted-11-0x9-0", JobName: "agent-1", Namespace: "agents", BlockNumber: 11, BlockHash: "0xb11"},
+			// Jobs deleted in the meantime are skipped
+			{EventID: "starknet-emitted-11-0x9-1", JobName: "agent-2", Namespace: "agents", BlockNumber: 11, BlockHash: "0xb11"},
+		})
+		*deleteRevertedJobs = saved
+
+		job, err := clientset.BatchV1().Jobs("agents").Get(context.Background(), "agent-1", metav1.GetOptions{})
+		if exists := err == nil; exists != test.exists {
+			t.Errorf("%s: Job exists = %t, want %t", test.name, exists, test.exists)
+			continue
+		}
+		if labeled := job != nil && job.Labels["lifecycle"] == "reverted"; test.exists && labeled != test.labeled {
+			t.Errorf("%s: Job labels = %v, want lifecycle=reverted %t", test.name, job.Labels, test.labeled)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// txHashRegex accepts a transaction hash as a hex felt
+var txHashRegex = regexp.MustCompile(`^0[xX][0-9a-fA-F]{1,64}$`)
+
+// replayReceipt holds the receipt fields a replay needs
+type replayReceipt struct {
+	TransactionHash string `json:"transaction_hash"`
+	BlockHash       string `json:"block_hash"`
+	BlockNumber     *int   `json:"block_number"`
+	ExecutionStatus string `json:"execution_status"`
+	RevertReason    string `json:"revert_reason,omitempty"`
+	Events          []struct {
+		FromAddress string   `json:"from_address"`
+		Keys        []string `json:"keys"`
+		Data        []string `json:"data"`
+	} `json:"events"`
+}
+
+// ReplayResult reports what replaying a transaction did with each of its
+// events that a watch rule's contract emitted
+type ReplayResult struct {
+	TransactionHash string `json:"transaction_hash"`
+	BlockNumber     int    `json:"block_number"`
+	BlockHash       string `json:"block_hash"`
+	ExecutionStatus string `json:"execution_status"`
+	RevertReason    string `json:"revert_reason,omitempty"`
+	RulesRevision   string `json:"rules_revision"`
+	// Events of contracts no rule watches, such as fee transfers
+	OtherEvents int             `json:"other_events"`
+	Events      []ReplayedEvent `json:"events"`
+}
+
+// ReplayedEvent is one replayed event with the Jobs it led to and the rules it
+// did not match
+type ReplayedEvent struct {
+	// Position among the transaction's events
+	Index    int           `json:"index"`
+	EventID  string        `json:"event_id"`
+	Contract string        `json:"contract"`
+	Keys     []string      `json:"keys"`
+	Jobs     []ReplayedJob `json:"jobs"`
+	Skipped  []SkippedRule `json:"skipped"`
+}
+
+// ReplayedJob is a Job for a replayed event. Status is created, exists (it
+// was already created, by the listener, a backfill or an earlier replay) or failed.
+type ReplayedJob struct {
+	Rule      string `json:"rule"`
+	JobName   string `json:"job_name"`
+	Namespace string `json:"namespace"`
+	Status    string `json:"status"`
+}
+
+// SkippedRule is a rule on an event's contract that the event did not match
+type SkippedRule struct {
+	Rule   string `json:"rule"`
+	Reason string `json:"reason"`
+}
+
+// replayTransaction fetches a transaction's receipt and runs the events it
+// emitted through the watch rules and Job creation like the listener does.
+// Event IDs are built the same way, so events whose Jobs exist are not spawned twice.
+func replayTransaction(c *gin.Context) {
+	hash := c.Param("hash")
+	if !txHashRegex.MatchString(hash) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid transaction hash %q", hash)})
+		return
+	}
+	ctx := c.Request.Context()
+
+	response, err := callStarknetRPC(ctx, "starknet_getTransactionReceipt", []interface{}{hash})
+	var rpcErr *RPCError
+	if errors.As(err, &rpcErr) && rpcErr.Code == 29 {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("transaction %s not found", hash)})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("failed to get receipt of %s: %v", hash, err)})
+		return
+	}
+	var receipt replayReceipt
+	if err := json.Unmarshal(response.Result, &receipt); err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("failed to unmarshal receipt of %s: %v", hash, err)})
+		return
+	}
+	if receipt.BlockNumber == nil || receipt.BlockHash == "" {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("transaction %s is not in a block yet", hash)})
+		return
+	}
+
+	rules := activeRules.Load()
+	log.Infof("Replaying transaction %s of block %d with rules revision %s", hash, *receipt.BlockNumber, rules.Revision)
+	result := ReplayResult{
+		TransactionHash: receipt.TransactionHash,
+		BlockNumber:     *receipt.BlockNumber,
+		BlockHash:       receipt.BlockHash,
+		ExecutionStatus: receipt.ExecutionStatus,
+		RevertReason:    receipt.RevertReason,
+		RulesRevision:   rules.Revision,
+		Events:          []ReplayedEvent{},
+	}
+
+	// Newest block each confirmation policy of the rules lets Jobs be spawned for
+	safeHeads := make(map[string]int)
+	for i, emitted := range receipt.Events {
+		event := StarknetEvent{
+			BlockNumber:     *receipt.BlockNumber,
+			BlockHash:       receipt.BlockHash,
+			TransactionHash: receipt.TransactionHash,
+			EventIndex:      i,
+			FromAddress:     emitted.FromAddress,
+			Keys:            emitted.Keys,
+			Data:            emitted.Data,
+		}
+		eventPayload, dojoEvent, decoded, payloadErr := newEventPayload(defaultStarknetConfig, event)
+		replayed := ReplayedEvent{
+			Index:    i,
+			EventID:  eventPayload.EventID,
+			Contract: event.FromAddress,
+			Keys:     event.Keys,
+			Jobs:     []ReplayedJob{},
+			Skipped:  []SkippedRule{},
+		}
+
+		var matched []*WatchRule
+		for _, rule := range rules.Rules {
+			if !sameFelt(rule.Contract, event.FromAddress) {
+				continue
+			}
+			if firstBlock := replayFirstBlock(rule); event.BlockNumber < firstBlock {
+				reason := fmt.Sprintf("block %d is before block %d, the first the rule matches events in", event.BlockNumber, firstBlock)
+				replayed.Skipped = append(replayed.Skipped, SkippedRule{Rule: rule.displayName(), Reason: reason})
+				continue
+			}
+			safeHead, ok := safeHeads[rule.confirmation.String()]
+			if !ok {
+				if safeHead, err = replaySafeHead(ctx, rule, event.BlockNumber); err != nil {
+					c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+					return
+				}
+				safeHeads[rule.confirmation.String()] = safeHead
+			}
+			if event.BlockNumber > safeHead {
+				reason := fmt.Sprintf("block %d is not confirmed under %s yet, the newest confirmed block is %d",
+					event.BlockNumber, rule.confirmation, safeHead)
+				replayed.Skipped = append(replayed.Skipped, SkippedRule{Rule: rule.displayName(), Reason: reason})
+				continue
+			}
+			if payloadErr != nil {
+				replayed.Skipped = append(replayed.Skipped, SkippedRule{Rule: rule.displayName(), Reason: payloadErr.Error()})
+				continue
+			}
+			if _, reason := rule.check(event, dojoEvent, decoded); reason != "" {
+				replayed.Skipped = append(replayed.Skipped, SkippedRule{Rule: rule.displayName(), Reason: reason})
+				continue
+			}
+			matched = append(matched, rule)
+		}
+		if len(matched) == 0 && len(replayed.Skipped) == 0 {
+			result.OtherEvents++
+			continue
+		}
+
+		if len(matched) > 0 {
+			enrichEventPayload(ctx, eventPayload, event)
+		}
+		for _, rule := range matched {
+			job := ReplayedJob{
+				Rule:      rule.displayName(),
+				JobName:   agentJobName(eventPayload.EventID, rule.Name),
+				Namespace: agentNamespace(),
+				Status:    "created",
+			}
+			if spawned, ok := dedupStore.Lookup(dedupKey(eventPayload.EventID, rule.Name)); ok {
+				job.Namespace = spawned.Namespace
+				job.Status = "exists"
+			} else if _, err := kubernetesClientset.BatchV1().Jobs(job.Namespace).Get(ctx, job.JobName, metav1.GetOptions{}); err == nil {
+				job.Status = "exists"
+			} else if handleEventEmitted(eventPayload.forRule(rule), rule) == nil {
+				job.Status = "failed"
+			}
+			log.Infof("Replayed event %s for rule %s: Job %s %s", eventPayload.EventID, job.Rule, job.JobName, job.Status)
+			replayed.Jobs = append(replayed.Jobs, job)
+		}
+		result.Events = append(result.Events, replayed)
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// replayFirstBlock returns the first block a rule matches events in, as the
+// listener resolved it, or the rule's start block when no listener runs it here
+func replayFirstBlock(rule *WatchRule) int {
+	if firstBlock, ok := ruleFirstBlocks.Load(rule); ok {
+		return firstBlock.(int)
+	}
+	return *rule.StartBlock
+}
+
+// replaySafeHead returns the newest block the rule's confirmation policy lets
+// Jobs be spawned for, the same bound the listener scans up to
+func replaySafeHead(ctx context.Context, rule *WatchRule, blockNumber int) (int, error) {
+	head, err := headTracker.Latest(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get the chain head: %w", err)
+	}
+	// A copy, since the policy remembers the last block it found on L1
+	policy := rule.confirmation
+	safeHead, err := policy.safeHead(ctx, head.BlockNumber, blockNumber)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get the newest block confirmed under %s: %w", rule.confirmation, err)
+	}
+	return safeHead, nil
+}
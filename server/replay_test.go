@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestReplayTransaction(t *testing.T) {
+	newTestRPCNode(t, &testMoveChain)
+	useFakeClientset(t)
+	useTestRules(t, `namespace: agents
+rules:
+  - name: moved
+    contract: "0x1"
+    selector: Moved
+    start_block: 10
+  - name: deep
+    contract: "0x1"
+    selector: Moved
+    start_block: 10
+    confirmation: depth:10
+`)
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/replay/tx/:hash", replayTransaction)
+
+	tests := []struct {
+		hash        string
+		status      int
+		events      []string
+		jobs        []string
+		skipped     []string
+		otherEvents int
+	}{
+		{hash: "0xzz", status: http.StatusBadRequest},
+		{hash: "0xff", status: http.StatusNotFound},
+		// Block 9 is before the rules' start block
+		{hash: "0xa0", status: http.StatusOK, events: []string{"starknet-emitted-9-0xa0-0"}, skipped: []string{"moved", "deep"}},
+		// Block 11 is not 10 blocks deep yet
+		{hash: "0xa1", status: http.StatusOK, events: []string{"starknet-emitted-11-0xa1-0"}, jobs: []string{"moved created"}, skipped: []string{"deep"}},
+		{hash: "0xa1", status: http.StatusOK, events: []string{"starknet-emitted-11-0xa1-0"}, jobs: []string{"moved exists"}, skipped: []string{"deep"}},
+		{hash: "0xa2", status: http.StatusOK, events: []string{"starknet-emitted-12-0xa2-1"}, jobs: []string{"moved created"}, skipped: []string{"deep"}, otherEvents: 1},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/replay/tx/"+test.hash, nil))
+		if recorder.Code != test.status {
+			t.Errorf("replaying %s answered %d, want %d: %s", test.hash, recorder.Code, test.status, recorder.Body)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+
+		var result ReplayResult
+		if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		events, jobs, skipped := []string{}, []string{}, []string{}
+		for _, event := range result.Events {
+			events = append(events, event.EventID)
+			for _, job := range event.Jobs {
+				jobs = append(jobs, job.Rule+" "+job.Status)
+				if job.Namespace != "agents" {
+					t.Errorf("replaying %s reported Job %s in namespace %s, want agents", test.hash, job.JobName, job.Namespace)
+				}
+			}
+			for _, rule := range event.Skipped {
+				skipped = append(skipped, rule.Rule)
+			}
+		}
+		if test.jobs == nil {
+			test.jobs = []string{}
+		}
+		if !reflect.DeepEqual(events, test.events) || !reflect.DeepEqual(jobs, test.jobs) || !reflect.DeepEqual(skipped, test.skipped) {
+			t.Errorf("replaying %s gave events %v with Jobs %v skipping %v, want events %v with Jobs %v skipping %v",
+				test.hash, events, jobs, skipped, test.events, test.jobs, test.skipped)
+		}
+		if result.OtherEvents != test.otherEvents {
+			t.Errorf("replaying %s counted %d other events, want %d", test.hash, result.OtherEvents, test.otherEvents)
+		}
+	}
+}
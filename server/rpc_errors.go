@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RPCError is a JSON-RPC error object returned by a Starknet node
+type RPCError struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func (e *RPCError) Error() string {
+	if len(e.Data) > 0 {
+		return fmt.Sprintf("RPC error %d: %s (%s)", e.Code, e.Message, string(e.Data))
+	}
+	return fmt.Sprintf("RPC error %d: %s", e.Code, e.Message)
+}
+
+// Retryable reports whether the error is a provider-side condition that may
+// clear up on another attempt or another endpoint. Errors caused by the request
+// itself, such as an invalid filter, are permanent.
+func (e *RPCError) Retryable() bool {
+	switch e.Code {
+	case 24: // BLOCK_NOT_FOUND, the endpoint may be lagging behind the others
+		return true
+	case -32603, -32000, -32005: // internal error, generic server error, limit exceeded
+		return true
+	default:
+		// 31 PAGE_SIZE_TOO_BIG, 33 INVALID_CONTINUATION_TOKEN, 34 TOO_MANY_KEYS_IN_FILTER,
+		// -32600..-32602 malformed requests and everything else are not worth retrying
+		return false
+	}
+}
+
+// HTTPStatusError is returned when an endpoint answers with a non-2xx status
+type HTTPStatusError struct {
+	StatusCode int
+	RetryAfter time.Duration
+	Body       string
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("unexpected HTTP status %d: %s", e.StatusCode, e.Body)
+}
+
+// Retryable reports whether the status indicates rate limiting or a transient
+// provider failure.
+func (e *HTTPStatusError) Retryable() bool {
+	return e.StatusCode == http.StatusTooManyRequests ||
+		e.StatusCode == http.StatusRequestTimeout ||
+		e.StatusCode >= 500
+}
+
+// isRetryableRPCError classifies errors returned by callStarknetRPC. Transport
+// failures are retryable unless the caller's context is done.
+func isRetryableRPCError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var rpcErr *RPCError
+	if errors.As(err, &rpcErr) {
+		return rpcErr.Retryable()
+	}
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Retryable()
+	}
+	return true
+}
+
+// retryAfterFrom extracts the delay an endpoint asked for, if any
+func retryAfterFrom(err error) time.Duration {
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.RetryAfter
+	}
+	return 0
+}
+
+// parseRetryAfter reads a Retry-After header in either delta-seconds or HTTP-date form
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if d := time.Until(at); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// rpcBackoff returns the delay before retry number attempt (starting at 0),
+// using exponential backoff with full jitter. A Retry-After from the provider
+// takes precedence when it asks for a longer wait.
+func rpcBackoff(attempt int, retryAfter time.Duration) time.Duration {
+	ceiling := *rpcRetryBaseDelay << attempt
+	if ceiling <= 0 || ceiling > *rpcRetryMaxDelay {
+		ceiling = *rpcRetryMaxDelay
+	}
+
+	delay := time.Duration(rand.Int64N(int64(ceiling) + 1))
+	if retryAfter > delay {
+		delay = retryAfter
+	}
+	return delay
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		value string
+		min   time.Duration
+		max   time.Duration
+	}{
+		{"", 0, 0},
+		{"0", 0, 0},
+		{"-5", 0, 0},
+		{"garbage", 0, 0},
+		{"1", time.Second, time.Second},
+		{"120", 2 * time.Minute, 2 * time.Minute},
+		{time.Now().Add(time.Hour).UTC().Format(http.TimeFormat), 59 * time.Minute, time.Hour},
+		{time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0, 0},
+	}
+	for _, test := range tests {
+		got := parseRetryAfter(test.value)
+		if got < test.min || got > test.max {
+			t.Errorf("parseRetryAfter(%q) = %s, want between %s and %s", test.value, got, test.min, test.max)
+		}
+	}
+}
+
+func TestRetryAfterFrom(t *testing.T) {
+	statusErr := &HTTPStatusError{StatusCode: http.StatusTooManyRequests, RetryAfter: 3 * time.Second}
+	if got := retryAfterFrom(fmt.Errorf("wrapped: %w", statusErr)); got != 3*time.Second {
+		t.Errorf("retryAfterFrom(wrapped 429) = %s, want 3s", got)
+	}
+	if got := retryAfterFrom(errors.New("connection refused")); got != 0 {
+		t.Errorf("retryAfterFrom(transport error) = %s, want 0", got)
+	}
+}
+
+func TestRPCBackoff(t *testing.T) {
+	for attempt := 0; attempt < 80; attempt++ {
+		ceiling := *rpcRetryMaxDelay
+		if attempt < 10 {
+			ceiling = min(*rpcRetryBaseDelay<<attempt, ceiling)
+		}
+		for i := 0; i < 20; i++ {
+			if got := rpcBackoff(attempt, 0); got < 0 || got > ceiling {
+				t.Fatalf("rpcBackoff(%d, 0) = %s, want between 0 and %s", attempt, got, ceiling)
+			}
+		}
+	}
+	if got := rpcBackoff(0, time.Minute); got != time.Minute {
+		t.Errorf("rpcBackoff(0, 1m) = %s, want the Retry-After of 1m", got)
+	}
+}
+
+func TestIsRetryableRPCError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errors.New("connection reset"), true},
+		{&RPCError{Code: 24}, true},
+		{&RPCError{Code: -32603}, true},
+		{&RPCError{Code: 33}, false},
+		{&RPCError{Code: -32602}, false},
+		{&HTTPStatusError{StatusCode: http.StatusTooManyRequests}, true},
+		{&HTTPStatusError{StatusCode: http.StatusBadGateway}, true},
+		{&HTTPStatusError{StatusCode: http.StatusBadRequest}, false},
+		{fmt.Errorf("call: %w", &RPCError{Code: 24}), true},
+	}
+	for _, test := range tests {
+		if got := isRetryableRPCError(test.err); got != test.want {
+			t.Errorf("isRetryableRPCError(%v) = %t, want %t", test.err, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// Weight of the newest sample in the latency and error-rate moving averages
+	rpcHealthAlpha = 0.2
+	// Consecutive failures after which an endpoint is taken out of rotation
+	rpcCooldownThreshold = 3
+	rpcMaxCooldown       = 60 * time.Second
+	// Latency assumed for endpoints that have not answered a request yet
+	rpcBaselineLatency = 250 * time.Millisecond
+)
+
+// rpcEndpoint tracks the health of a single Starknet RPC provider
+type rpcEndpoint struct {
+	name string
+	url  string
+
+	mu                  sync.Mutex
+	latency             time.Duration // moving average over successful requests
+	errorRate           float64       // moving average of failures, 0..1
+	requests            uint64
+	failures            uint64
+	consecutiveFailures int
+	cooldownUntil       time.Time
+	lastError           string
+	lastErrorAt         time.Time
+	specVersion         string
+	// Set once the endpoint rejected a JSON-RPC batch; batches are then sent
+	// to it as single requests
+	batchesRejected bool
+}
+
+// RPCEndpointHealth is the externally visible health of an RPC endpoint
+type RPCEndpointHealth struct {
+	Name                string     `json:"name"`
+	URL                 string     `json:"url"`
+	Healthy             bool       `json:"healthy"`
+	LatencyMs           float64    `json:"latency_ms"`
+	ErrorRate           float64    `json:"error_rate"`
+	Requests            uint64     `json:"requests"`
+	Failures            uint64     `json:"failures"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	CooldownUntil       *time.Time `json:"cooldown_until,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+	LastErrorAt         *time.Time `json:"last_error_at,omitempty"`
+	SpecVersion         string     `json:"spec_version,omitempty"`
+	BatchesRejected     bool       `json:"batches_rejected,omitempty"`
+}
+
+// RPCPool routes Starknet RPC requests to the healthiest of several endpoints
+// and fails over to the next one when a provider errors out.
+type RPCPool struct {
+	endpoints []*rpcEndpoint
+}
+
+// newRPCPool builds a pool from endpoint specs of the form "url" or "name=url".
+func newRPCPool(specs []string) (*RPCPool, error) {
+	pool := &RPCPool{}
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		name, rawURL := "", spec
+		if i := strings.Index(spec, "="); i > 0 && !strings.Contains(spec[:i], "://") {
+			name, rawURL = spec[:i], spec[i+1:]
+		}
+		parsed, err := url.Parse(rawURL)
+		if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			return nil, fmt.Errorf("invalid RPC endpoint %q", spec)
+		}
+		if name == "" {
+			name = parsed.Host
+		}
+		pool.endpoints = append(pool.endpoints, &rpcEndpoint{name: name, url: rawURL})
+	}
+
+	if len(pool.endpoints) == 0 {
+		return nil, fmt.Errorf("no RPC endpoints configured")
+	}
+	return pool, nil
+}
+
+// score ranks endpoints by latency penalised by their recent error rate. Lower
+// is better; endpoints without latency samples are assumed to be moderately slow.
+func (e *rpcEndpoint) score() float64 {
+	latency := e.latency
+	if latency == 0 {
+		latency = rpcBaselineLatency
+	}
+	return float64(latency.Microseconds()) * (1 + 10*e.errorRate)
+}
+
+// available returns the endpoints that are not cooling down, ordered from
+// healthiest to least healthy.
+func (p *RPCPool) available() []*rpcEndpoint {
+	type candidate struct {
+		endpoint *rpcEndpoint
+		score    float64
+	}
+
+	now := time.Now()
+	candidates := make([]candidate, 0, len(p.endpoints))
+	for _, e := range p.endpoints {
+		e.mu.Lock()
+		if !now.Before(e.cooldownUntil) {
+			candidates = append(candidates, candidate{e, e.score()})
+		}
+		e.mu.Unlock()
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].score < candidates[j].score
+	})
+
+	ranked := make([]*rpcEndpoint, len(candidates))
+	for i, c := range candidates {
+		ranked[i] = c.endpoint
+	}
+	return ranked
+}
+
+// nextAvailableIn returns how long until the first endpoint leaves cooldown
+func (p *RPCPool) nextAvailableIn() time.Duration {
+	now := time.Now()
+	var wait time.Duration
+	for i, e := range p.endpoints {
+		e.mu.Lock()
+		remaining := e.cooldownUntil.Sub(now)
+		e.mu.Unlock()
+		if remaining <= 0 {
+			return 0
+		}
+		if i == 0 || remaining < wait {
+			wait = remaining
+		}
+	}
+	return wait
+}
+
+func (e *rpcEndpoint) recordSuccess(latency time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.requests++
+	if e.latency == 0 {
+		e.latency = latency
+	} else {
+		e.latency = time.Duration(rpcHealthAlpha*float64(latency) + (1-rpcHealthAlpha)*float64(e.latency))
+	}
+	e.errorRate *= 1 - rpcHealthAlpha
+	e.consecutiveFailures = 0
+	e.cooldownUntil = time.Time{}
+}
+
+func (e *rpcEndpoint) recordFailure(err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.requests++
+	e.failures++
+	e.errorRate = rpcHealthAlpha + (1-rpcHealthAlpha)*e.errorRate
+	e.consecutiveFailures++
+	e.lastError = err.Error()
+	e.lastErrorAt = time.Now()
+
+	if e.consecutiveFailures >= rpcCooldownThreshold {
+		// Back off exponentially the longer the endpoint keeps failing
+		cooldown := time.Duration(math.Pow(2, float64(e.consecutiveFailures-rpcCooldownThreshold))) * time.Second
+		if cooldown > rpcMaxCooldown {
+			cooldown = rpcMaxCooldown
+		}
+		e.cooldownUntil = e.lastErrorAt.Add(cooldown)
+	}
+
+	// A rate-limited endpoint is left alone for as long as it asked
+	if retryAfter := retryAfterFrom(err); retryAfter > 0 && e.lastErrorAt.Add(retryAfter).After(e.cooldownUntil) {
+		e.cooldownUntil = e.lastErrorAt.Add(retryAfter)
+	}
+}
+
+func (e *rpcEndpoint) setSpecVersion(version string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.specVersion = version
+}
+
+func (e *rpcEndpoint) getSpecVersion() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.specVersion
+}
+
+func (e *rpcEndpoint) rejectsBatches() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.batchesRejected
+}
+
+// send posts a JSON-RPC request body to this endpoint and returns the raw
+// response body. Transport failures and non-2xx statuses are reported as errors.
+func (e *rpcEndpoint) send(ctx context.Context, requestBody []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(requestBody))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	// Log the response for debugging
+	log.Debugf("Starknet RPC response from %s: %s", e.name, string(body))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		snippet := string(body)
+		if len(snippet) > 200 {
+			snippet = snippet[:200]
+		}
+		return nil, &HTTPStatusError{
+			StatusCode: resp.StatusCode,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+			Body:       snippet,
+		}
+	}
+	return body, nil
+}
+
+// sendBatch posts a JSON-RPC batch to this endpoint. Endpoints that reject
+// batches as a whole get the requests one at a time instead, from then on, and
+// their responses are returned as if they came in one batch.
+func (e *rpcEndpoint) sendBatch(ctx context.Context, batchBody []byte, requests [][]byte) ([]byte, error) {
+	if !e.rejectsBatches() {
+		body, err := e.send(ctx, batchBody)
+		if err != nil || !isBatchRejection(body) {
+			return body, err
+		}
+		log.Warnf("Starknet RPC endpoint %s does not accept batch requests, sending them one at a time", e.name)
+		e.mu.Lock()
+		e.batchesRejected = true
+		e.mu.Unlock()
+	}
+
+	responses := make([]json.RawMessage, 0, len(requests))
+	for _, request := range requests {
+		body, err := e.send(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+		responses = append(responses, body)
+	}
+	return json.Marshal(responses)
+}
+
+// isBatchRejection reports whether a batch was answered with a single
+// invalid-request error instead of a response per request
+func isBatchRejection(body []byte) bool {
+	var single struct {
+		Error *RPCError `json:"error"`
+	}
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 || trimmed[0] != '{' || json.Unmarshal(trimmed, &single) != nil {
+		return false
+	}
+	return single.Error != nil && single.Error.Code == -32600
+}
+
+// call sends the request to the healthiest endpoint and fails over to the
+// others in order of health. decode parses the response body and may reject it
+// with an error, which is classified like a transport error. When every
+// endpoint has failed with a retryable error it backs off and starts another
+// round, up to --rpc-max-retries rounds. Permanent errors, such as an invalid
+// filter, are returned immediately.
+func (p *RPCPool) call(ctx context.Context, method string, requestBody []byte, decode func(body []byte) error) error {
+	return p.do(ctx, method, func(endpoint *rpcEndpoint) ([]byte, error) {
+		return endpoint.send(ctx, requestBody)
+	}, decode)
+}
+
+// callBatch is call for a JSON-RPC batch, whose requests are also passed one
+// by one for endpoints that reject batches
+func (p *RPCPool) callBatch(ctx context.Context, method string, batchBody []byte, requests [][]byte, decode func(body []byte) error) error {
+	return p.do(ctx, method, func(endpoint *rpcEndpoint) ([]byte, error) {
+		return endpoint.sendBatch(ctx, batchBody, requests)
+	}, decode)
+}
+
+// do runs call and callBatch, with send posting the request to one endpoint
+func (p *RPCPool) do(ctx context.Context, method string, send func(endpoint *rpcEndpoint) ([]byte, error), decode func(body []byte) error) error {
+	var lastErr error
+	for attempt := 0; ; attempt++ {
+		for _, endpoint := range p.available() {
+			start := time.Now()
+			body, err := send(endpoint)
+			if err == nil {
+				err = decode(body)
+			}
+			if err == nil {
+				endpoint.recordSuccess(time.Since(start))
+				return nil
+			}
+
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if !isRetryableRPCError(err) {
+				// The endpoint answered properly, the request itself is at fault
+				endpoint.recordSuccess(time.Since(start))
+				return err
+			}
+
+			endpoint.recordFailure(err)
+			log.Warnf("Starknet RPC %s failed on endpoint %s: %v", method, endpoint.name, err)
+			lastErr = err
+		}
+
+		if attempt >= *rpcMaxRetries {
+			break
+		}
+
+		delay := rpcBackoff(attempt, p.nextAvailableIn())
+		log.Debugf("Retrying Starknet RPC %s in %s (attempt %d of %d)", method, delay, attempt+2, *rpcMaxRetries+1)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+
+	if lastErr == nil {
+		lastErr = errors.New("all RPC endpoints are cooling down")
+	}
+	return fmt.Errorf("starknet RPC %s failed after %d attempts: %w", method, *rpcMaxRetries+1, lastErr)
+}
+
+// Health returns a snapshot of every endpoint's health in configuration order.
+func (p *RPCPool) Health() []RPCEndpointHealth {
+	now := time.Now()
+	health := make([]RPCEndpointHealth, 0, len(p.endpoints))
+	for _, e := range p.endpoints {
+		e.mu.Lock()
+		h := RPCEndpointHealth{
+			Name:                e.name,
+			URL:                 redactRPCURL(e.url),
+			Healthy:             !now.Before(e.cooldownUntil),
+			LatencyMs:           float64(e.latency.Microseconds()) / 1000,
+			ErrorRate:           e.errorRate,
+			Requests:            e.requests,
+			Failures:            e.failures,
+			ConsecutiveFailures: e.consecutiveFailures,
+			LastError:           e.lastError,
+			SpecVersion:         e.specVersion,
+			BatchesRejected:     e.batchesRejected,
+		}
+		if !h.Healthy {
+			cooldownUntil := e.cooldownUntil
+			h.CooldownUntil = &cooldownUntil
+		}
+		if !e.lastErrorAt.IsZero() {
+			lastErrorAt := e.lastErrorAt
+			h.LastErrorAt = &lastErrorAt
+		}
+		e.mu.Unlock()
+		health = append(health, h)
+	}
+	return health
+}
+
+// redactRPCURL strips the path and query from an endpoint URL, since hosted
+// providers embed API keys there.
+func redactRPCURL(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return "invalid-url"
+	}
+	return parsed.Scheme + "://" + parsed.Host
+}
+
+func getRPCEndpoints(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"spec_version": rpcSpec.Version,
+		"endpoints":    rpcPool.Health(),
+	})
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RPCSpec is the Starknet JSON-RPC spec version the endpoints implement.
+// Block ids, event filters and emitted events have the same shape from v0.6 to
+// v0.8; the versions differ in the methods they offer.
+type RPCSpec struct {
+	// Version as reported by starknet_specVersion
+	Version string
+	// Whether the WebSocket subscription API exists, from v0.8 on
+	Subscriptions bool
+	// Whether starknet_getBlockWithReceipts exists, from v0.7 on
+	BlockWithReceipts bool
+}
+
+// supportedRPCSpecs maps a spec major.minor version to the methods it offers
+var supportedRPCSpecs = map[string]RPCSpec{
+	"0.6": {},
+	"0.7": {BlockWithReceipts: true},
+	"0.8": {Subscriptions: true, BlockWithReceipts: true},
+}
+
+// emittedEvent is EMITTED_EVENT. Block hash and number are absent for events
+// of the pending block.
+type emittedEvent struct {
+	FromAddress     string   `json:"from_address"`
+	Keys            []string `json:"keys"`
+	Data            []string `json:"data"`
+	BlockHash       string   `json:"block_hash,omitempty"`
+	BlockNumber     *int     `json:"block_number,omitempty"`
+	TransactionHash string   `json:"transaction_hash"`
+}
+
+// toStarknetEvent converts the event, leaving EventIndex -1 for eventIndexes
+// to resolve. ok is false for events of the pending block, which have no
+// block yet and may still change.
+func (e emittedEvent) toStarknetEvent() (StarknetEvent, bool) {
+	if e.BlockNumber == nil || e.BlockHash == "" {
+		return StarknetEvent{}, false
+	}
+	return StarknetEvent{
+		BlockNumber:     *e.BlockNumber,
+		BlockHash:       e.BlockHash,
+		TransactionHash: e.TransactionHash,
+		FromAddress:     e.FromAddress,
+		Keys:            e.Keys,
+		Data:            e.Data,
+		EventIndex:      -1,
+	}, true
+}
+
+// blockID identifies a block by number in request parameters
+func blockID(blockNumber int) interface{} {
+	return map[string]interface{}{"block_number": blockNumber}
+}
+
+// decodeEventsPage parses a starknet_getEvents result, dropping events of the
+// pending block
+func decodeEventsPage(result json.RawMessage) ([]StarknetEvent, string, error) {
+	var page struct {
+		Events            []emittedEvent `json:"events"`
+		ContinuationToken string         `json:"continuation_token,omitempty"`
+	}
+	if err := json.Unmarshal(result, &page); err != nil {
+		return nil, "", err
+	}
+
+	events := make([]StarknetEvent, 0, len(page.Events))
+	for _, emitted := range page.Events {
+		if event, ok := emitted.toStarknetEvent(); ok {
+			events = append(events, event)
+		}
+	}
+	return events, page.ContinuationToken, nil
+}
+
+// decodeEmittedEvent parses a single emitted event, as sent by subscriptions.
+// ok is false for events of the pending block.
+func decodeEmittedEvent(result json.RawMessage) (event StarknetEvent, ok bool, err error) {
+	var emitted emittedEvent
+	if err := json.Unmarshal(result, &emitted); err != nil {
+		return StarknetEvent{}, false, err
+	}
+	event, ok = emitted.toStarknetEvent()
+	return event, ok, nil
+}
+
+// specMinorVersion reduces a spec version such as "0.7.1" to "0.7"
+func specMinorVersion(version string) string {
+	parts := strings.SplitN(strings.TrimPrefix(strings.TrimSpace(version), "v"), ".", 3)
+	if len(parts) < 2 {
+		return version
+	}
+	return parts[0] + "." + parts[1]
+}
+
+// negotiateRPCVersion asks every configured endpoint for its spec version with
+// starknet_specVersion and returns what that version offers. Endpoints must
+// agree on the major.minor version, since requests fail over between them.
+func negotiateRPCVersion(ctx context.Context, pool *RPCPool) (*RPCSpec, error) {
+	request, err := json.Marshal(StarknetRPCRequest{
+		JSONRPC: "2.0",
+		Method:  "starknet_specVersion",
+		Params:  []interface{}{},
+		ID:      nextRPCRequestID(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	versions := make(map[string][]string)
+	var lastErr error
+	for _, endpoint := range pool.endpoints {
+		version, err := endpointSpecVersion(ctx, endpoint, request)
+		if err != nil {
+			log.Warnf("Failed to get RPC spec version from endpoint %s: %v", endpoint.name, err)
+			lastErr = err
+			continue
+		}
+		endpoint.setSpecVersion(version)
+		log.Infof("RPC endpoint %s implements Starknet spec %s", endpoint.name, version)
+		versions[specMinorVersion(version)] = append(versions[specMinorVersion(version)], endpoint.name)
+	}
+
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("no RPC endpoint reported its spec version: %w", lastErr)
+	}
+	if len(versions) > 1 {
+		var found []string
+		for version, names := range versions {
+			found = append(found, fmt.Sprintf("%s (%s)", version, strings.Join(names, ", ")))
+		}
+		sort.Strings(found)
+		return nil, fmt.Errorf("RPC endpoints implement different spec versions: %s", strings.Join(found, "; "))
+	}
+
+	var version string
+	for _, endpoint := range pool.endpoints {
+		if v := endpoint.getSpecVersion(); v != "" {
+			version = v
+			break
+		}
+	}
+	spec, ok := supportedRPCSpecs[specMinorVersion(version)]
+	if !ok {
+		var supported []string
+		for minor := range supportedRPCSpecs {
+			supported = append(supported, minor)
+		}
+		sort.Strings(supported)
+		return nil, fmt.Errorf("unsupported Starknet RPC spec version %s, supported versions are %s",
+			version, strings.Join(supported, ", "))
+	}
+	spec.Version = version
+	return &spec, nil
+}
+
+// endpointSpecVersion queries a single endpoint, bypassing the pool's failover
+func endpointSpecVersion(ctx context.Context, endpoint *rpcEndpoint, request []byte) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+
+	body, err := endpoint.send(ctx, request)
+	if err != nil {
+		return "", err
+	}
+	var response StarknetRPCResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return "", fmt.Errorf("failed to unmarshal response: %v", err)
+	}
+	if response.Error != nil {
+		return "", response.Error
+	}
+	var version string
+	if err := json.Unmarshal(response.Result, &version); err != nil {
+		return "", fmt.Errorf("failed to unmarshal spec version: %v", err)
+	}
+	return version, nil
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// WatchRule is one kind of contract event the listener spawns agents for.
+// Fields a rule leaves out default to the corresponding command line flag.
+type WatchRule struct {
+	Name     string `json:"name"`
+	Contract string `json:"contract,omitempty"`
+	// Hex selector, Dojo tag (namespace-Name) or event name
+	Selector string `json:"selector"`
+	// First block to match events in, 0 means the latest block at startup
+	StartBlock *int `json:"start_block,omitempty"`
+	BatchSize  int  `json:"batch_size,omitempty"`
+	// immediate, depth:N or l1
+	Confirmation string `json:"confirmation,omitempty"`
+	// Path to a Job manifest the rule's agents are created from, relative to
+	// the rules file, or its key in the rules ConfigMap. The built-in agent Job
+	// is used when empty.
+	JobTemplate string `json:"job_template,omitempty"`
+	// Replaces the image of the Job template's first container
+	Image string `json:"image,omitempty"`
+	// Condition on the event's fields, see predicate.go
+	When string `json:"when,omitempty"`
+
+	// Resolved when the rule is loaded
+	selector     string
+	predicate    *Predicate
+	confirmation ConfirmationPolicy
+	template     *batchv1.Job
+	// The selector is the first key of plain Starknet events rather than a
+	// Dojo model or event selector
+	plainEvent bool
+}
+
+// ruleNameRegex keeps rule names usable in Job names and label values
+var ruleNameRegex = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,18}[a-z0-9])?$`)
+
+// flagWatchRule builds the single rule described by --contract, --selector,
+// --block, --batch-size, --confirmation, --job-template and --when. It has no
+// name, so its Jobs keep the names they had before rules existed.
+func flagWatchRule() (*WatchRule, error) {
+	rule := &WatchRule{Selector: *eventSelector, JobTemplate: *jobTemplatePath, When: *whenPredicate}
+	if err := rule.resolve(os.ReadFile, eventABI); err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+// parseWatchRules parses rules in YAML or JSON, either as a list or under a
+// "rules" key next to an optional "namespace" for the agent Jobs. readFile
+// returns the Job templates the rules refer to.
+func parseWatchRules(raw []byte, readFile func(name string) ([]byte, error), abi *ContractABI) (*RuleSet, error) {
+	var file struct {
+		Namespace string       `json:"namespace,omitempty"`
+		Rules     []*WatchRule `json:"rules"`
+	}
+	if err := yaml.UnmarshalStrict(raw, &file); err != nil {
+		if listErr := yaml.UnmarshalStrict(raw, &file.Rules); listErr != nil {
+			return nil, fmt.Errorf("failed to parse rules: %w", err)
+		}
+	}
+	if len(file.Rules) == 0 {
+		return nil, fmt.Errorf("no rules defined")
+	}
+	if file.Namespace == "" {
+		file.Namespace = *namespace
+	}
+
+	names := make(map[string]bool)
+	for i, rule := range file.Rules {
+		if !ruleNameRegex.MatchString(rule.Name) {
+			return nil, fmt.Errorf("rule %d: name %q must be 1-20 lower case letters, digits or '-'", i, rule.Name)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("rule %d: duplicate name %q", i, rule.Name)
+		}
+		names[rule.Name] = true
+		if err := rule.resolve(readFile, abi); err != nil {
+			return nil, fmt.Errorf("rule %s: %w", rule.Name, err)
+		}
+	}
+	return &RuleSet{Namespace: file.Namespace, Rules: file.Rules, groups: groupWatchRules(file.Rules)}, nil
+}
+
+// resolve fills in defaults from the flags and validates the rule
+func (r *WatchRule) resolve(readFile func(name string) ([]byte, error), abi *ContractABI) error {
+	if r.Contract == "" {
+		r.Contract = *contractAddress
+	}
+	if r.Contract == "" {
+		return fmt.Errorf("no contract address")
+	}
+	r.Contract = normalizeFelt(r.Contract)
+	if r.StartBlock == nil {
+		r.StartBlock = startBlockNumber
+	}
+	if r.BatchSize == 0 {
+		r.BatchSize = *batchSize
+	}
+	if r.BatchSize < 1 {
+		return fmt.Errorf("batch size must be positive, got %d", r.BatchSize)
+	}
+	if r.Confirmation == "" {
+		r.Confirmation = *confirmation
+	}
+
+	var err error
+	if r.selector, r.plainEvent, err = resolveSelector(r.Selector, abi); err != nil {
+		return fmt.Errorf("invalid selector: %w", err)
+	}
+	if !r.plainEvent && abi != nil {
+		r.plainEvent = abi.hasEventSelector(r.Contract, r.selector)
+	}
+	if r.confirmation, err = parseConfirmationPolicy(r.Confirmation); err != nil {
+		return err
+	}
+	if r.When != "" {
+		// Check field names against the ABI where it describes the event
+		fields := make(map[string][]string)
+		if abi != nil {
+			if names, ok := abi.eventFieldNames(r.selector); ok {
+				fields["decoded"] = names
+			}
+			if names, ok := abi.recordFieldNames(r.selector); ok {
+				fields["record"] = names
+			}
+		}
+		if r.predicate, err = parsePredicate(r.When, fields); err != nil {
+			return fmt.Errorf("invalid condition %q: %w", r.When, err)
+		}
+	}
+
+	if r.JobTemplate == "" {
+		r.template = defaultJobTemplate()
+	} else {
+		raw, err := readFile(r.JobTemplate)
+		if err != nil {
+			return fmt.Errorf("job template %s: %w", r.JobTemplate, err)
+		}
+		if r.template, err = parseJobTemplate(raw); err != nil {
+			return fmt.Errorf("job template %s: %w", r.JobTemplate, err)
+		}
+	}
+	if r.Image != "" {
+		r.template.Spec.Template.Spec.Containers[0].Image = r.Image
+	}
+	return nil
+}
+
+// displayName is how logs and responses refer to the rule; the rule built
+// from flags has no name
+func (r *WatchRule) displayName() string {
+	if r.Name == "" {
+		return "default"
+	}
+	return r.Name
+}
+
+// String describes the rule for logs
+func (r *WatchRule) String() string {
+	name := r.displayName()
+	if r.predicate != nil {
+		return fmt.Sprintf("%s (contract %s, selector %s, confirmation %s, when %s)", name, r.Contract, r.selector, r.confirmation, r.predicate)
+	}
+	return fmt.Sprintf("%s (contract %s, selector %s, confirmation %s)", name, r.Contract, r.selector, r.confirmation)
+}
+
+// matches reports whether an event is one the rule spawns agents for and which
+// key matched. Dojo world events carry the model or event selector in a fixed
+// position, so it is matched exactly. For other events the selector may be any
+// of the keys. Events that match the selector must also meet the rule's
+// condition; dojoEvent and decoded may be nil.
+func (r *WatchRule) matches(event StarknetEvent, dojoEvent *DojoEvent, decoded *DecodedEvent) (string, bool) {
+	matchedKey, reason := r.check(event, dojoEvent, decoded)
+	return matchedKey, reason == ""
+}
+
+// check returns the key an event matched the rule on, or why it did not match
+func (r *WatchRule) check(event StarknetEvent, dojoEvent *DojoEvent, decoded *DecodedEvent) (string, string) {
+	if !sameFelt(event.FromAddress, r.Contract) {
+		return "", "emitted by another contract"
+	}
+	matchedKey := ""
+	if dojoEvent != nil {
+		if !enabledDojoEvents[dojoEvent.Kind] {
+			return "", fmt.Sprintf("Dojo %s events are not enabled by --dojo-events", dojoEvent.Kind)
+		}
+		if !sameFelt(dojoEvent.Selector, r.selector) {
+			return "", fmt.Sprintf("Dojo selector %s is not the rule's selector", dojoEvent.Selector)
+		}
+		matchedKey = dojoEvent.Selector
+	} else {
+		for _, key := range event.Keys {
+			if sameFelt(key, r.selector) {
+				matchedKey = key
+				break
+			}
+		}
+		if matchedKey == "" {
+			return "", "no key is the rule's selector"
+		}
+	}
+	if r.predicate == nil {
+		return matchedKey, ""
+	}
+
+	ok, err := r.predicate.Eval(predicateEnv(event, dojoEvent, decoded))
+	if err != nil {
+		predicateErrors.Add(1)
+		log.Warnf("Skipping event %s for rule %s, its condition failed: %v", starknetEventID(event), r, err)
+		return "", fmt.Sprintf("condition failed: %v", err)
+	}
+	if !ok {
+		log.Debugf("Skipping event %s for rule %s, its condition is false", starknetEventID(event), r)
+		return "", "condition is false"
+	}
+	return matchedKey, ""
+}
+
+// forRule returns a copy of an event payload that tells the agent which rule
+// and selector it was spawned for
+func (e EventPayload) forRule(rule *WatchRule) EventPayload {
+	payload := make(map[string]any, len(e.Payload)+2)
+	for k, v := range e.Payload {
+		payload[k] = v
+	}
+	payload["selector"] = rule.selector
+
+	environment := make(map[string]string, len(e.Environment)+2)
+	for k, v := range e.Environment {
+		environment[k] = v
+	}
+	environment["EVENT_SELECTOR"] = rule.selector
+	if rule.Name != "" {
+		payload["rule"] = rule.Name
+		environment["WATCH_RULE"] = rule.Name
+	}
+
+	e.Payload = payload
+	e.Environment = environment
+	return e
+}
+
+// watchGroup is a set of rules on one contract with the same confirmation
+// policy. One starknet_getEvents filter whose keys cover the selectors of all
+// its rules fetches the events for the whole group.
+type watchGroup struct {
+	contract     string
+	confirmation ConfirmationPolicy
+	rules        []*WatchRule
+	filter       EventEmittedFilter
+	// Why the node cannot filter the group's events by selector, if it cannot
+	filterErr error
+	// Smallest batch size of the group's rules
+	batchSize int
+}
+
+// groupWatchRules merges rules that can share a filter into groups
+func groupWatchRules(rules []*WatchRule) []*watchGroup {
+	byKey := make(map[string]*watchGroup)
+	var groups []*watchGroup
+	for _, rule := range rules {
+		key := rule.Contract + "/" + rule.confirmation.String()
+		group, ok := byKey[key]
+		if !ok {
+			group = &watchGroup{
+				contract:     rule.Contract,
+				confirmation: rule.confirmation,
+				batchSize:    rule.BatchSize,
+			}
+			byKey[key] = group
+			groups = append(groups, group)
+		}
+		group.rules = append(group.rules, rule)
+		group.batchSize = min(group.batchSize, rule.BatchSize)
+	}
+
+	for _, group := range groups {
+		group.filter = defaultEventEmittedFilter
+		group.filter.ContractAddress = group.contract
+
+		var dojoSelectors, eventSelectors []string
+		seen := make(map[string]bool)
+		for _, rule := range group.rules {
+			if seen[rule.selector] {
+				continue
+			}
+			seen[rule.selector] = true
+			if rule.plainEvent {
+				eventSelectors = append(eventSelectors, rule.selector)
+			} else {
+				dojoSelectors = append(dojoSelectors, rule.selector)
+			}
+		}
+		sort.Strings(dojoSelectors)
+		sort.Strings(eventSelectors)
+		// Let the node filter by selector when it can be expressed as keys;
+		// the rules still check every event they are given
+		group.filter.Keys, group.filterErr = eventKeysFilter(dojoSelectors, eventSelectors)
+	}
+	return groups
+}
+
+// String names the group for logs and metrics
+func (g *watchGroup) String() string {
+	return fmt.Sprintf("%s/%s", g.contract, g.confirmation)
+}
+
+// logFilter reports how the group's events are filtered
+func (g *watchGroup) logFilter() {
+	if len(g.filter.Keys) > 0 {
+		log.Infof("Filtering events of %s for %d rule(s) on the node with keys %v, in batches of %d blocks",
+			g, len(g.rules), g.filter.Keys, g.batchSize)
+	} else {
+		log.Infof("Filtering events of %s for %d rule(s) client-side, in batches of %d blocks: %v",
+			g, len(g.rules), g.batchSize, g.filterErr)
+	}
+}
+
+// defaultJobTemplate is the built-in agent Job: the --agent-image container
+// with the API keys from the agent-api-keys Secret
+func defaultJobTemplate() *batchv1.Job {
+	// **IMPORTANT**: Add API Keys securely. Best practice is using Kubernetes Secrets.
+	// Assumes you have Secrets named 'agent-api-keys' with keys 'anthropic-api-key', 'openai-api-key', etc.
+	var envVars []v1.EnvVar
+	for _, secret := range [][2]string{
+		{"ANTHROPIC_API_KEY", "anthropic-api-key"},
+		{"OPENAI_API_KEY", "openai-api-key"},
+		{"OPENROUTER_API_KEY", "openrouter-api-key"},
+	} {
+		envVars = append(envVars, v1.EnvVar{
+			Name: secret[0],
+			ValueFrom: &v1.EnvVarSource{
+				SecretKeyRef: &v1.SecretKeySelector{
+					LocalObjectReference: v1.LocalObjectReference{Name: "agent-api-keys"}, // CHANGE_ME: Your secret name
+					Key:                  secret[1],
+					Optional:             func(b bool) *bool { return &b }(true), // Make optional if key might not exist
+				},
+			},
+		})
+	}
+
+	return &batchv1.Job{
+		Spec: batchv1.JobSpec{
+			// TTLSecondsAfterFinished: PtrInt32(3600), // Optional: Auto-cleanup finished jobs after 1 hour
+			BackoffLimit: PtrInt32(1), // Optional: Retry once on failure
+			Template: v1.PodTemplateSpec{
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{
+						{
+							Name:  "agent-container",
+							Image: *agentImage, // Use the image specified by flag
+							Env:   envVars,
+						},
+					},
+					RestartPolicy: v1.RestartPolicyNever, // Or OnFailure if container might exit non-zero legitimately
+					// Assign a ServiceAccount if the agent needs specific K8s permissions
+					ServiceAccountName: *agentServiceAccount,
+				},
+			},
+		},
+	}
+}
+
+// parseJobTemplate parses a Job manifest in YAML or JSON. Its name and
+// namespace are ignored: every agent Job gets its own name in the rules'
+// namespace.
+func parseJobTemplate(raw []byte) (*batchv1.Job, error) {
+	var job batchv1.Job
+	if err := yaml.UnmarshalStrict(raw, &job); err != nil {
+		return nil, fmt.Errorf("failed to parse Job: %w", err)
+	}
+	if job.Kind != "" && job.Kind != "Job" {
+		return nil, fmt.Errorf("expected a Job manifest, got %s", job.Kind)
+	}
+	containers := job.Spec.Template.Spec.Containers
+	if len(containers) == 0 {
+		return nil, fmt.Errorf("Job has no containers")
+	}
+	for _, container := range containers {
+		if container.Image == "" {
+			return nil, fmt.Errorf("container %q has no image", container.Name)
+		}
+	}
+	if job.Spec.Template.Spec.RestartPolicy == "" {
+		job.Spec.Template.Spec.RestartPolicy = v1.RestartPolicyNever
+	}
+	return &job, nil
+}
+
+// eventIDAnnotation holds the full ID of the event an agent Job was created
+// for. The event-id label is cut to the 63 characters labels allow, so events
+// of the same transaction can share it.
+const eventIDAnnotation = "chairman.dreams.dev/event-id"
+
+// newAgentJob instantiates a rule's Job template for one event: the Job gets
+// its name, namespace, labels and event ID annotation and every container the
+// event's variables
+func newAgentJob(template *batchv1.Job, namespace, name, eventID string, labels map[string]string, envVars []v1.EnvVar) *batchv1.Job {
+	job := template.DeepCopy()
+	annotations := map[string]string{eventIDAnnotation: eventID}
+	job.ObjectMeta = metav1.ObjectMeta{
+		Name:        name,
+		Namespace:   namespace,
+		Labels:      mergeLabels(template.Labels, labels),
+		Annotations: mergeLabels(template.Annotations, annotations),
+	}
+	podLabels := map[string]string{"app": labels["app"], "event-id": labels["event-id"]}
+	job.Spec.Template.Labels = mergeLabels(job.Spec.Template.Labels, podLabels)
+	job.Spec.Template.Annotations = mergeLabels(job.Spec.Template.Annotations, annotations)
+	for i := range job.Spec.Template.Spec.Containers {
+		container := &job.Spec.Template.Spec.Containers[i]
+		container.Env = append(container.Env, envVars...)
+	}
+	return job
+}
+
+// mergeLabels returns base with overrides applied
+func mergeLabels(base, overrides map[string]string) map[string]string {
+	merged := make(map[string]string, len(base)+len(overrides))
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range overrides {
+		merged[k] = v
+	}
+	return merged
+}
+
+// agentJobName derives a Kubernetes-compatible Job name (DNS-1123 subdomain)
+// from an event ID. Jobs of named rules are called agent-<rule>-<hash>, so
+// several rules can act on the same event.
+func agentJobName(eventID, ruleName string) string {
+	if ruleName != "" {
+		sum := sha256.Sum256([]byte(eventID))
+		return fmt.Sprintf("agent-%s-%s", ruleName, hex.EncodeToString(sum[:])[:16])
+	}
+
+	// Max length 63 chars, lowercase alphanumeric, '-', start/end with alphanumeric
+	jobNameBase := fmt.Sprintf("agent-%s", eventID)
+	// Sanitize and shorten if necessary
+	jobNameBase = strings.ToLower(jobNameBase)
+	jobNameBase = strings.ReplaceAll(jobNameBase, "_", "-") // Replace underscores
+	// Replace any invalid characters (example: keep only a-z, 0-9, -)
+	var sanitizedName strings.Builder
+	for _, r := range jobNameBase {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' {
+			sanitizedName.WriteRune(r)
+		}
+	}
+	jobNameBase = sanitizedName.String()
+	if len(jobNameBase) > 50 { // Leave room for potential suffix
+		// The cut-off tail holds the transaction hash and event index, so a
+		// hash of the whole ID keeps the names of different events apart
+		sum := sha256.Sum256([]byte(eventID))
+		jobNameBase = strings.TrimSuffix(jobNameBase[:33], "-") + "-" + hex.EncodeToString(sum[:])[:16]
+	}
+	// Ensure it doesn't end with '-'
+	return strings.TrimSuffix(jobNameBase, "-")
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// rulesConfigMapKey is the ConfigMap key holding the rules; the Job templates
+// they refer to are other keys of the same ConfigMap
+const rulesConfigMapKey = "rules.yaml"
+
+// RuleSet is one validated revision of the watch rules. A rule set is not
+// changed once it is active; reloading replaces it as a whole.
+type RuleSet struct {
+	// Hash of the rules and the templates they use
+	Revision string    `json:"revision"`
+	Source   string    `json:"source"`
+	LoadedAt time.Time `json:"loaded_at"`
+	// Namespace the agent Jobs are created in
+	Namespace string       `json:"namespace"`
+	Rules     []*WatchRule `json:"rules"`
+
+	// The rules merged into groups that share an event filter
+	groups []*watchGroup
+}
+
+var (
+	// Rule set the listener and the API work with
+	activeRules atomic.Pointer[RuleSet]
+	// Signalled when a new rule set becomes active
+	rulesChanged = make(chan struct{}, 1)
+
+	rulesReloads        atomic.Int64
+	rulesReloadFailures atomic.Int64
+
+	// Outcome of the last failed reload, cleared by the next good one
+	rulesErrorMu sync.Mutex
+	rulesError   string
+	rulesErrorAt time.Time
+)
+
+// agentNamespace is the namespace of the active rule set
+func agentNamespace() string {
+	return activeRules.Load().Namespace
+}
+
+// ruleSource is where rules are loaded from
+type ruleSource interface {
+	// read returns the rules and a function reading the templates they refer to
+	read(ctx context.Context) ([]byte, func(name string) ([]byte, error), error)
+	String() string
+}
+
+// fileRuleSource reads rules from a file. Templates are read relative to it.
+// ConfigMaps mounted as volumes are updated in place, so this also follows a
+// mounted ConfigMap.
+type fileRuleSource struct {
+	path string
+}
+
+func (s fileRuleSource) read(ctx context.Context) ([]byte, func(name string) ([]byte, error), error) {
+	raw, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	readFile := func(name string) ([]byte, error) {
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(filepath.Dir(s.path), name)
+		}
+		return os.ReadFile(name)
+	}
+	return raw, readFile, nil
+}
+
+func (s fileRuleSource) String() string {
+	return "file " + s.path
+}
+
+// configMapRuleSource reads rules from the rules.yaml key of a ConfigMap
+// through the Kubernetes API
+type configMapRuleSource struct {
+	namespace, name string
+}
+
+// parseConfigMapRuleSource parses "[namespace/]name", defaulting to --namespace
+func parseConfigMapRuleSource(value string) configMapRuleSource {
+	if namespace, name, ok := strings.Cut(value, "/"); ok {
+		return configMapRuleSource{namespace: namespace, name: name}
+	}
+	return configMapRuleSource{namespace: *namespace, name: value}
+}
+
+func (s configMapRuleSource) read(ctx context.Context) ([]byte, func(name string) ([]byte, error), error) {
+	configMap, err := kubernetesClientset.CoreV1().ConfigMaps(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+	raw, ok := configMap.Data[rulesConfigMapKey]
+	if !ok {
+		return nil, nil, fmt.Errorf("no %s key", rulesConfigMapKey)
+	}
+	readFile := func(name string) ([]byte, error) {
+		data, ok := configMap.Data[name]
+		if !ok {
+			return nil, fmt.Errorf("no %s key in ConfigMap %s", name, s)
+		}
+		return []byte(data), nil
+	}
+	return []byte(raw), readFile, nil
+}
+
+func (s configMapRuleSource) String() string {
+	return fmt.Sprintf("ConfigMap %s/%s", s.namespace, s.name)
+}
+
+// loadRuleSet reads and validates the rules of a source. The revision covers
+// the rules and every template they use, so editing a template is a change.
+func loadRuleSet(ctx context.Context, source ruleSource, abi *ContractABI) (*RuleSet, error) {
+	raw, readFile, err := source.read(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.New()
+	hash.Write(raw)
+	trackedReadFile := func(name string) ([]byte, error) {
+		data, err := readFile(name)
+		if err == nil {
+			fmt.Fprintf(hash, "\x00%s\x00", name)
+			hash.Write(data)
+		}
+		return data, err
+	}
+
+	set, err := parseWatchRules(raw, trackedReadFile, abi)
+	if err != nil {
+		return nil, err
+	}
+	set.Revision = hex.EncodeToString(hash.Sum(nil))[:12]
+	set.Source = source.String()
+	set.LoadedAt = time.Now()
+	return set, nil
+}
+
+// flagRuleSet wraps the rule built from flags; it is never reloaded
+func flagRuleSet(rule *WatchRule) *RuleSet {
+	return &RuleSet{
+		Revision:  "flags",
+		Source:    "command line flags",
+		LoadedAt:  time.Now(),
+		Namespace: *namespace,
+		Rules:     []*WatchRule{rule},
+		groups:    groupWatchRules([]*WatchRule{rule}),
+	}
+}
+
+// activateRules makes a rule set active and tells the listener
+func activateRules(set *RuleSet) {
+	activeRules.Store(set)
+	select {
+	case rulesChanged <- struct{}{}:
+	default:
+		// The listener has not picked up the previous change yet and will
+		// read the newest rule set when it does
+	}
+}
+
+// watchRuleSource reloads the rules every interval. Rules that fail to load or
+// validate are reported and the active rules stay in place.
+func watchRuleSource(ctx context.Context, source ruleSource, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloadRules(ctx, source)
+		}
+	}
+}
+
+// reloadRules loads the rules again and activates them if they changed
+func reloadRules(ctx context.Context, source ruleSource) {
+	set, err := loadRuleSet(ctx, source, eventABI)
+	if err != nil {
+		rulesErrorMu.Lock()
+		repeated := rulesError == err.Error()
+		rulesError, rulesErrorAt = err.Error(), time.Now()
+		rulesErrorMu.Unlock()
+		if !repeated {
+			rulesReloadFailures.Add(1)
+			log.Errorf("Failed to reload watch rules from %s, keeping revision %s: %v", source, activeRules.Load().Revision, err)
+		}
+		return
+	}
+
+	rulesErrorMu.Lock()
+	rulesError, rulesErrorAt = "", time.Time{}
+	rulesErrorMu.Unlock()
+
+	current := activeRules.Load()
+	if set.Revision == current.Revision {
+		return
+	}
+	log.Infof("Watch rules changed in %s: revision %s replaces %s", source, set.Revision, current.Revision)
+	for _, rule := range set.Rules {
+		log.Infof("Watching rule %s", rule)
+	}
+	if set.Namespace != current.Namespace {
+		log.Infof("Agent Jobs are now created in namespace %s", set.Namespace)
+	}
+	rulesReloads.Add(1)
+	activateRules(set)
+}
+
+// ruleStatus shows a rule with its resolved selector
+type ruleStatus struct {
+	*WatchRule
+	ResolvedSelector string `json:"resolved_selector"`
+}
+
+// getRules reports the active rule revision and the last failed reload
+func getRules(c *gin.Context) {
+	set := activeRules.Load()
+	rules := make([]ruleStatus, len(set.Rules))
+	for i, rule := range set.Rules {
+		rules[i] = ruleStatus{WatchRule: rule, ResolvedSelector: rule.selector}
+	}
+	response := gin.H{
+		"revision":  set.Revision,
+		"source":    set.Source,
+		"loaded_at": set.LoadedAt,
+		"namespace": set.Namespace,
+		"rules":     rules,
+	}
+
+	rulesErrorMu.Lock()
+	if rulesError != "" {
+		response["reload_error"] = rulesError
+		response["reload_error_at"] = rulesErrorAt
+	}
+	rulesErrorMu.Unlock()
+	c.JSON(http.StatusOK, response)
+}
+
+// writeRulesMetrics reports rule reloads
+func writeRulesMetrics(w io.Writer) {
+	writeMetric(w, "chairman_rules_reloads_total", "counter", "Times a changed watch rules revision was activated", float64(rulesReloads.Load()))
+	writeMetric(w, "chairman_rules_reload_failures_total", "counter", "Times changed watch rules failed to load or validate", float64(rulesReloadFailures.Load()))
+	writeMetric(w, "chairman_rules_loaded_timestamp_seconds", "gauge", "Time the active watch rules revision was loaded", float64(activeRules.Load().LoadedAt.Unix()))
+}
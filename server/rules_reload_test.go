@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const testRules = `namespace: agents
+rules:
+  - name: moved
+    contract: "0x1"
+    selector: "0x2"
+    start_block: 10
+    confirmation: %s
+    job_template: mover.yaml
+`
+
+const testJobTemplate = `apiVersion: batch/v1
+kind: Job
+spec:
+  template:
+    spec:
+      containers:
+        - name: agent
+          image: %s
+`
+
+func TestReloadRules(t *testing.T) {
+	clientset := useFakeClientset(t)
+	configMaps := clientset.CoreV1().ConfigMaps("default")
+	source := configMapRuleSource{namespace: "default", name: "chairman-rules"}
+	saved := activeRules.Load()
+	defer activeRules.Store(saved)
+	activeRules.Store(&RuleSet{Revision: "flags", Namespace: "default"})
+
+	tests := []struct {
+		name                string
+		confirmation, image string
+		changed             bool
+		reloadError         bool
+	}{
+		{name: "first load", confirmation: "immediate", image: "mover:v1", changed: true},
+		{name: "unchanged", confirmation: "immediate", image: "mover:v1"},
+		{name: "template changed", confirmation: "immediate", image: "mover:v2", changed: true},
+		{name: "invalid rules", confirmation: "eventually", image: "mover:v2", reloadError: true},
+		{name: "fixed", confirmation: "depth:3", image: "mover:v2", changed: true},
+	}
+	for i, test := range tests {
+		configMap := &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "chairman-rules", Namespace: "default"},
+			Data: map[string]string{
+				rulesConfigMapKey: fmt.Sprintf(testRules, test.confirmation),
+				"mover.yaml":      fmt.Sprintf(testJobTemplate, test.image),
+			},
+		}
+		var err error
+		if i == 0 {
+			_, err = configMaps.Create(context.Background(), configMap, metav1.CreateOptions{})
+		} else {
+			_, err = configMaps.Update(context.Background(), configMap, metav1.UpdateOptions{})
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		before := activeRules.Load()
+		reloadRules(context.Background(), source)
+		after := activeRules.Load()
+		if changed := after != before; changed != test.changed {
+			t.Errorf("%s: rules changed = %t, want %t", test.name, changed, test.changed)
+		}
+		select {
+		case <-rulesChanged:
+			if !test.changed {
+				t.Errorf("%s: the listener was told about unchanged rules", test.name)
+			}
+		default:
+			if test.changed {
+				t.Errorf("%s: the listener was not told about changed rules", test.name)
+			}
+		}
+		rulesErrorMu.Lock()
+		reloadError := rulesError
+		rulesErrorMu.Unlock()
+		if (reloadError != "") != test.reloadError {
+			t.Errorf("%s: reload error = %q, want an error %t", test.name, reloadError, test.reloadError)
+		}
+
+		if test.changed {
+			rule := after.Rules[0]
+			if after.Namespace != "agents" || rule.confirmation.String() != test.confirmation ||
+				rule.template.Spec.Template.Spec.Containers[0].Image != test.image {
+				t.Errorf("%s: active rules are %s in namespace %s with image %s", test.name, rule, after.Namespace,
+					rule.template.Spec.Template.Spec.Containers[0].Image)
+			}
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	// Running listener goroutines, waited for on shutdown
+	listeners sync.WaitGroup
+
+	// Open WebSocket log streams, closed on shutdown
+	logStreamsMu sync.Mutex
+	logStreams   = make(map[*logStream]bool)
+	logStreamsWG sync.WaitGroup
+)
+
+// logStream is a WebSocket streaming a Pod's logs and the cancel function of
+// the log request feeding it
+type logStream struct {
+	ws     *websocket.Conn
+	cancel context.CancelFunc
+}
+
+// trackLogStream registers a log stream until the returned function is called
+func trackLogStream(ws *websocket.Conn, cancel context.CancelFunc) func() {
+	stream := &logStream{ws: ws, cancel: cancel}
+	logStreamsMu.Lock()
+	logStreams[stream] = true
+	logStreamsWG.Add(1)
+	logStreamsMu.Unlock()
+	return func() {
+		logStreamsMu.Lock()
+		delete(logStreams, stream)
+		logStreamsMu.Unlock()
+		logStreamsWG.Done()
+	}
+}
+
+// closeLogStreams ends the log streams with a going-away close frame and waits
+// for the clients to answer it until ctx is done, then drops the rest
+func closeLogStreams(ctx context.Context) {
+	logStreamsMu.Lock()
+	streams := make([]*logStream, 0, len(logStreams))
+	for stream := range logStreams {
+		streams = append(streams, stream)
+	}
+	logStreamsMu.Unlock()
+	if len(streams) == 0 {
+		return
+	}
+
+	log.Infof("Closing %d WebSocket log stream(s)", len(streams))
+	for _, stream := range streams {
+		stream.cancel()
+		stream.ws.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"), time.Now().Add(time.Second))
+	}
+	if !waitUntil(ctx, logStreamsWG.Wait) {
+		for _, stream := range streams {
+			stream.ws.Close()
+		}
+	}
+}
+
+// waitUntil runs wait and reports whether it returned before ctx was done
+func waitUntil(ctx context.Context, wait func()) bool {
+	done := make(chan struct{})
+	go func() {
+		wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// shutdown stops the server within --shutdown-grace-period. The listener
+// finishes the block range it is processing, the queued Jobs are created and
+// its position is checkpointed before the leader Lease is handed over; then
+// the HTTP server stops taking requests and waits for running ones, and log
+// streams are closed.
+func shutdown(server *http.Server, stopElection context.CancelFunc, electionDone <-chan struct{}) {
+	log.Infof("Shutting down, waiting up to %s", *shutdownGracePeriod)
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownGracePeriod)
+	defer cancel()
+
+	if !waitUntil(ctx, listeners.Wait) {
+		log.Warnf("Event listener did not stop within %s, its last block range may be scanned again after a restart", *shutdownGracePeriod)
+	}
+	if !jobQueue.Drain(ctx) {
+		log.Warnf("Queued Jobs were not all created within %s, their blocks are scanned again after a restart", *shutdownGracePeriod)
+	}
+	if err := checkpoints.Flush(ctx); err != nil {
+		log.Errorf("%v", err)
+	}
+
+	stopElection()
+	select {
+	case <-electionDone:
+	case <-ctx.Done():
+	}
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Warnf("HTTP server did not shut down cleanly: %v", err)
+	}
+	closeLogStreams(ctx)
+
+	if err := dedupStore.Close(); err != nil {
+		log.Errorf("Failed to close the dedup store: %v", err)
+	}
+	log.Info("Shutdown complete")
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// orderedCheckpointStore notes in order when the checkpoint is saved
+type orderedCheckpointStore struct {
+	fakeCheckpointStore
+	note func(string)
+}
+
+func (s *orderedCheckpointStore) save(ctx context.Context, checkpoint Checkpoint) error {
+	s.note("checkpoint")
+	return s.fakeCheckpointStore.save(ctx, checkpoint)
+}
+
+func TestShutdownOrder(t *testing.T) {
+	tests := []struct {
+		name string
+		// How long the listener takes to finish its block range
+		listener time.Duration
+		want     []string
+		drained  bool
+	}{
+		{name: "listener stops", listener: 20 * time.Millisecond, want: []string{"listener", "checkpoint", "election", "http"}, drained: true},
+		// The rest is still stopped, without waiting any longer. Last, since
+		// shutdown's wait for the listener only returns once it is released.
+		{name: "listener stuck", listener: time.Second, want: []string{"checkpoint", "election", "http"}},
+	}
+	savedGracePeriod, savedCheckpoints, savedQueue := *shutdownGracePeriod, checkpoints, jobQueue
+	defer func() { *shutdownGracePeriod, checkpoints, jobQueue = savedGracePeriod, savedCheckpoints, savedQueue }()
+	*shutdownGracePeriod = 200 * time.Millisecond
+
+	for _, test := range tests {
+		var mu sync.Mutex
+		var order []string
+		note := func(step string) {
+			mu.Lock()
+			defer mu.Unlock()
+			order = append(order, step)
+		}
+
+		release := make(chan struct{})
+		listeners.Add(1)
+		go func() {
+			defer listeners.Done()
+			select {
+			case <-time.After(test.listener):
+				note("listener")
+			case <-release:
+			}
+		}()
+		jobQueue = newJobQueue(1, 1)
+		checkpoints = &Checkpointer{store: &orderedCheckpointStore{note: note}, checkpoint: Checkpoint{Blocks: map[string]int{"0x1/immediate": 10}}, dirty: true}
+		electionDone := make(chan struct{})
+		stopElection := func() {
+			note("election")
+			close(electionDone)
+		}
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := &http.Server{}
+		served := make(chan struct{})
+		go func() {
+			defer close(served)
+			server.Serve(listener)
+			note("http")
+		}()
+
+		shutdown(server, stopElection, electionDone)
+		close(release)
+		listeners.Wait()
+		<-served
+
+		mu.Lock()
+		if !reflect.DeepEqual(order, test.want) {
+			t.Errorf("%s: shut down in order %v, want %v", test.name, order, test.want)
+		}
+		mu.Unlock()
+		if jobQueue.closed != test.drained {
+			t.Errorf("%s: Job queue drained = %t, want %t", test.name, jobQueue.closed, test.drained)
+		}
+	}
+}
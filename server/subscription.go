@@ -0,0 +1,543 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// How often the subscription connection is pinged to detect dead peers
+	subscriptionPingInterval = 30 * time.Second
+	// How long the connection may stay silent, pongs included, before reconnecting
+	subscriptionReadTimeout = 90 * time.Second
+)
+
+// subscriptionMessage covers the JSON-RPC responses and notifications received
+// over a Starknet WebSocket connection
+type subscriptionMessage struct {
+	ID     *int            `json:"id,omitempty"`
+	Method string          `json:"method,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  *RPCError       `json:"error,omitempty"`
+	Params struct {
+		SubscriptionID json.RawMessage `json:"subscription_id"`
+		Result         json.RawMessage `json:"result"`
+	} `json:"params"`
+}
+
+// eventStream holds the state of the subscription listener across reconnects
+type eventStream struct {
+	config  StarknetConfig
+	group   *watchGroup
+	filter  EventEmittedFilter
+	scanner *blockScanner
+
+	// First block not known to be fully processed. Gap filling resumes here.
+	nextBlock int
+	// Block through which the current connection's gap fill already processed events
+	filledThrough int
+	// Event IDs processed from the stream, by block number, so the gap fill
+	// after a reconnect does not hand them out a second time
+	seen map[string]int
+	// Streamed events waiting for the confirmation policy to release them
+	pending []StarknetEvent
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// subscriptionURL returns the WebSocket endpoint to subscribe on, deriving it
+// from the first RPC endpoint when --ws-url is not set
+func subscriptionURL() (string, error) {
+	rawURL := *wsURL
+	if rawURL == "" {
+		rawURL = rpcPool.endpoints[0].url
+	}
+
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid WebSocket URL %q: %w", rawURL, err)
+	}
+	switch parsed.Scheme {
+	case "ws", "wss":
+	case "http":
+		parsed.Scheme = "ws"
+	case "https":
+		parsed.Scheme = "wss"
+	default:
+		return "", fmt.Errorf("unsupported WebSocket URL scheme %q", parsed.Scheme)
+	}
+	return parsed.String(), nil
+}
+
+// startEventSubscriptionListener streams EventEmitted events over Starknet RPC
+// v0.8 WebSocket subscriptions instead of polling, one stream per watch group.
+// When the rules change, streams of changed groups are restarted and resume
+// where they left off, new groups get a stream and removed groups lose theirs.
+func startEventSubscriptionListener(ctx context.Context, config StarknetConfig) {
+	endpoint, err := subscriptionURL()
+	if err != nil {
+		log.Errorf("Cannot start Starknet event subscription: %v", err)
+		return
+	}
+
+	streams := make(map[string]*eventStream)
+	var applied *RuleSet
+	paused := false
+	for {
+		if set := activeRules.Load(); set != applied {
+			reconcileEventStreams(ctx, config, endpoint, streams, set, !paused)
+			applied = set
+		}
+
+		// Streams are stopped while the listener is paused and restarted at
+		// the requested block after a seek
+		seekBlock, seek := listenerControl.takeSeek()
+		if seek || listenerControl.Paused() != paused {
+			paused = listenerControl.Paused()
+			if paused {
+				log.Warn("Event listener is paused, stopping its subscriptions")
+			}
+			for _, stream := range streams {
+				stream.stop()
+				if seek {
+					stream.seek(seekBlock)
+				}
+				if !paused {
+					stream.start(ctx, endpoint)
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			for _, stream := range streams {
+				stream.stop()
+			}
+			return
+		case <-rulesChanged:
+		case <-listenerControl.changed:
+		}
+	}
+}
+
+// reconcileEventStreams matches the streams to a rule set, starting them if run is set
+func reconcileEventStreams(ctx context.Context, config StarknetConfig, endpoint string, streams map[string]*eventStream, set *RuleSet, run bool) {
+	wanted := make(map[string]bool, len(set.groups))
+	for _, group := range set.groups {
+		group.logFilter()
+		wanted[group.String()] = true
+		stream, ok := streams[group.String()]
+		if ok {
+			// The stream reads its rules while it runs, so swap them while it is stopped
+			stream.stop()
+			stream.setGroup(group)
+		} else {
+			stream = newEventStream(config, group)
+			streams[group.String()] = stream
+		}
+		if run {
+			stream.start(ctx, endpoint)
+		}
+	}
+	for key, stream := range streams {
+		if !wanted[key] {
+			log.Infof("No rules left for %s, stopping its subscription", key)
+			stream.stop()
+			delete(streams, key)
+			headTracker.ForgetProcessed(key)
+		}
+	}
+}
+
+func newEventStream(config StarknetConfig, group *watchGroup) *eventStream {
+	stream := &eventStream{
+		config:    config,
+		group:     group,
+		filter:    group.filter,
+		scanner:   newBlockScanner(config, group),
+		nextBlock: -1,
+		seen:      make(map[string]int),
+	}
+	stream.scanner.skip = stream.alreadyProcessed
+	return stream
+}
+
+// setGroup switches a stopped stream to a group's new rules
+func (s *eventStream) setGroup(group *watchGroup) {
+	s.group = group
+	s.filter = group.filter
+	s.scanner.setGroup(group)
+	if s.nextBlock >= 0 {
+		s.scanner.continueFrom(s.nextBlock)
+	}
+}
+
+// start runs the stream in the background until stop is called
+func (s *eventStream) start(ctx context.Context, endpoint string) {
+	ctx, s.cancel = context.WithCancel(ctx)
+	s.done = make(chan struct{})
+	go func() {
+		defer close(s.done)
+		s.follow(ctx, endpoint)
+	}()
+}
+
+// stop stops the stream, if it runs, and waits for it to return and for the
+// Jobs it queued, checkpointing its position
+func (s *eventStream) stop() {
+	if s.cancel == nil {
+		return
+	}
+	s.cancel()
+	<-s.done
+	s.cancel = nil
+	s.scanner.collect(true)
+	if s.nextBlock >= 0 {
+		s.scanner.commit(s.nextBlock)
+	}
+}
+
+// seek makes a stopped stream resume at blockNumber
+func (s *eventStream) seek(blockNumber int) {
+	log.Warnf("Moving %s from block %d to block %d", s.group, s.nextBlock, blockNumber)
+	s.dropPending(0)
+	s.seen = make(map[string]int)
+	s.nextBlock = blockNumber
+	s.filledThrough = blockNumber - 1
+	s.scanner.seek(blockNumber)
+}
+
+// follow fills the gap since the last processed block with starknet_getEvents
+// and subscribes, again after every reconnect, until ctx is done
+func (s *eventStream) follow(ctx context.Context, endpoint string) {
+	log.Infof("Starting Starknet EventEmitted subscription for %s via %s",
+		s.group, redactRPCURL(endpoint))
+
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			delay := rpcBackoff(attempt-1, 0)
+			log.Infof("Reconnecting Starknet event subscription in %s", delay)
+			select {
+			case <-ctx.Done():
+				log.Info("Stopping Starknet EventEmitted subscription")
+				return
+			case <-time.After(delay):
+			}
+		}
+
+		// Fill the gap between the last processed block and the newest block the
+		// confirmation policy allows. Unconfirmed events are replayed by the
+		// subscription and held back until they are confirmed.
+		s.dropPending(0)
+		if s.nextBlock < 0 {
+			nextBlock, err := s.scanner.resolveStartBlock(ctx)
+			if err != nil {
+				log.Errorf("Failed to determine the starting block of %s: %v", s.group, err)
+				listenerControl.recordError("failed to determine the starting block of %s: %v", s.group, err)
+				continue
+			}
+			s.nextBlock = nextBlock
+		}
+		latestBlockNumber, err := getLatestBlockNumber(ctx, s.config)
+		if err != nil {
+			log.Errorf("Failed to get latest block number before subscribing: %v", err)
+			continue
+		}
+		safeBlockNumber, err := s.scanner.confirmation.safeHead(ctx, latestBlockNumber, s.nextBlock)
+		if err != nil {
+			log.Errorf("Failed to apply confirmation policy %s: %v", s.scanner.confirmation, err)
+			continue
+		}
+		if s.nextBlock <= safeBlockNumber {
+			log.Infof("Filling gap from block %d to %d before subscribing", s.nextBlock, safeBlockNumber)
+			s.nextBlock = s.scanner.scan(ctx, s.nextBlock, safeBlockNumber)
+			s.scanner.commit(s.nextBlock)
+			if s.nextBlock <= safeBlockNumber {
+				log.Errorf("Gap fill stopped at block %d, retrying", s.nextBlock)
+				continue
+			}
+		}
+		s.filledThrough = s.nextBlock - 1
+		s.prune()
+
+		err = s.run(ctx, endpoint, func() { attempt = 0 })
+		if ctx.Err() != nil {
+			log.Info("Stopping Starknet EventEmitted subscription")
+			return
+		}
+		log.Warnf("Starknet event subscription dropped: %v", err)
+		listenerControl.recordError("event subscription of %s dropped: %v", s.group, err)
+	}
+}
+
+// alreadyProcessed reports whether the stream already handed out an event
+func (s *eventStream) alreadyProcessed(event StarknetEvent) bool {
+	_, ok := s.seen[starknetEventID(event)]
+	return ok
+}
+
+// prune forgets streamed events in blocks that gap filling will not revisit
+func (s *eventStream) prune() {
+	for id, blockNumber := range s.seen {
+		if blockNumber < s.nextBlock {
+			delete(s.seen, id)
+		}
+	}
+}
+
+// run subscribes to new heads and events on one WebSocket connection and
+// processes notifications until the connection fails or ctx is done.
+// connected is called once both subscriptions are confirmed.
+func (s *eventStream) run(ctx context.Context, endpoint string, connected func()) error {
+	dialCtx, cancelDial := context.WithTimeout(ctx, 30*time.Second)
+	conn, _, err := websocket.DefaultDialer.DialContext(dialCtx, endpoint, nil)
+	cancelDial()
+	if err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	defer conn.Close()
+
+	// Close the connection when ctx is done so the blocking read returns
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(subscriptionPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseNormalClosure, "shutting down"), time.Now().Add(time.Second))
+				conn.Close()
+				return
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+					conn.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(subscriptionReadTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(subscriptionReadTimeout))
+	})
+
+	// Subscribe from the last gap-filled block; its events are skipped below
+	eventParams := map[string]interface{}{
+		"from_address": s.filter.ContractAddress,
+		"block_id":     blockID(s.filledThrough),
+	}
+	if len(s.filter.Keys) > 0 {
+		eventParams["keys"] = s.filter.Keys
+	}
+
+	subscriptions := []struct {
+		method string
+		params interface{}
+	}{
+		{"starknet_subscribeNewHeads", map[string]interface{}{}},
+		{"starknet_subscribeEvents", eventParams},
+	}
+	requests := map[int]string{}
+	for _, subscription := range subscriptions {
+		id := nextRPCRequestID()
+		if err := conn.WriteJSON(map[string]interface{}{
+			"jsonrpc": "2.0",
+			"method":  subscription.method,
+			"params":  subscription.params,
+			"id":      id,
+		}); err != nil {
+			return fmt.Errorf("failed to send %s: %w", subscription.method, err)
+		}
+		requests[id] = subscription.method
+	}
+
+	for {
+		_, raw, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(subscriptionReadTimeout))
+
+		var message subscriptionMessage
+		if err := json.Unmarshal(raw, &message); err != nil {
+			log.Warnf("Ignoring unparseable subscription message: %v", err)
+			continue
+		}
+
+		if message.ID != nil {
+			method := requests[*message.ID]
+			if message.Error != nil {
+				return fmt.Errorf("%s rejected: %w", method, message.Error)
+			}
+			log.Infof("Subscribed with %s (subscription %s)", method, string(message.Result))
+			delete(requests, *message.ID)
+			if len(requests) == 0 {
+				connected()
+			}
+			continue
+		}
+
+		switch message.Method {
+		case "starknet_subscriptionEvents":
+			eventTraffic.record(EventPageStats{Events: 1, Bytes: len(message.Params.Result)})
+			event, ok, err := decodeEmittedEvent(message.Params.Result)
+			if err != nil {
+				log.Warnf("Ignoring unparseable event notification: %v", err)
+				continue
+			}
+			if !ok {
+				// Only events of accepted blocks are acted on
+				log.Debugf("Ignoring event notification for the pending block")
+				continue
+			}
+			if err := s.handleEvent(ctx, event); err != nil {
+				return err
+			}
+		case "starknet_subscriptionNewHeads":
+			var header struct {
+				BlockNumber int    `json:"block_number"`
+				BlockHash   string `json:"block_hash"`
+			}
+			if err := json.Unmarshal(message.Params.Result, &header); err != nil {
+				log.Warnf("Ignoring unparseable new head notification: %v", err)
+				continue
+			}
+			s.handleNewHead(ctx, header.BlockNumber, header.BlockHash)
+		case "starknet_subscriptionReorg":
+			var reorg struct {
+				StartingBlockNumber int    `json:"starting_block_number"`
+				StartingBlockHash   string `json:"starting_block_hash"`
+				EndingBlockNumber   int    `json:"ending_block_number"`
+			}
+			if err := json.Unmarshal(message.Params.Result, &reorg); err != nil {
+				log.Warnf("Ignoring unparseable reorg notification: %v", err)
+				continue
+			}
+			s.handleReorg(ctx, reorg.StartingBlockNumber, reorg.EndingBlockNumber)
+		default:
+			log.Debugf("Ignoring subscription message %s", strings.TrimSpace(string(raw)))
+		}
+	}
+}
+
+// handleEvent processes one streamed event unless gap filling or an earlier
+// notification already covered it. Under a non-immediate confirmation policy
+// the event is held until a new head confirms its block. An event that cannot
+// be numbered fails the connection, so gap filling picks it up after the
+// reconnect.
+func (s *eventStream) handleEvent(ctx context.Context, event StarknetEvent) error {
+	if event.BlockNumber <= s.filledThrough {
+		return nil
+	}
+	// Identical events of a transaction get the positions in turn
+	events := []StarknetEvent{event}
+	if err := eventIndexes.resolve(ctx, events, s.alreadyProcessed); err != nil {
+		return fmt.Errorf("failed to number event of transaction %s: %w", event.TransactionHash, err)
+	}
+	event = events[0]
+	if event.EventIndex < 0 || s.alreadyProcessed(event) {
+		return nil
+	}
+	s.seen[starknetEventID(event)] = event.BlockNumber
+	if s.scanner.confirmation.Mode != ConfirmImmediate {
+		s.pending = append(s.pending, event)
+		return nil
+	}
+	s.dispatch(ctx, event)
+	return nil
+}
+
+// dispatch spawns the agent for a streamed event
+func (s *eventStream) dispatch(ctx context.Context, event StarknetEvent) {
+	s.scanner.process(context.WithoutCancel(ctx), event.BlockNumber, event.BlockNumber, []StarknetEvent{event})
+}
+
+// handleNewHead releases held events that are now confirmed and advances the
+// resume point. Events of the block before the new head may still be in
+// flight, so that block is revisited after a reconnect, as is every block with
+// events still held back.
+func (s *eventStream) handleNewHead(ctx context.Context, blockNumber int, blockHash string) {
+	headTracker.Observe(blockNumber, blockHash)
+	s.scanner.history.record(blockNumber, blockHash)
+	s.scanner.trim()
+
+	resumeFrom := blockNumber - 1
+	if len(s.pending) > 0 {
+		safeBlockNumber, err := s.scanner.confirmation.safeHead(ctx, blockNumber, s.pending[0].BlockNumber)
+		if err != nil {
+			log.Errorf("Failed to apply confirmation policy %s: %v", s.scanner.confirmation, err)
+			safeBlockNumber = s.pending[0].BlockNumber - 1
+		}
+
+		held := s.pending[:0]
+		for _, event := range s.pending {
+			if event.BlockNumber <= safeBlockNumber {
+				s.dispatch(ctx, event)
+			} else {
+				held = append(held, event)
+			}
+		}
+		s.pending = held
+		for _, event := range s.pending {
+			resumeFrom = min(resumeFrom, event.BlockNumber)
+		}
+	}
+
+	if len(s.pending) > 0 {
+		headTracker.RecordProcessed(s.group.String(), s.pending[0].BlockNumber-1)
+	} else {
+		headTracker.RecordProcessed(s.group.String(), blockNumber)
+	}
+
+	if resumeFrom > s.nextBlock {
+		s.nextBlock = resumeFrom
+		s.prune()
+		s.scanner.commit(s.nextBlock)
+	}
+}
+
+// dropPending discards held events from fromBlock on, so gap filling or the
+// subscription can deliver them again
+func (s *eventStream) dropPending(fromBlock int) {
+	held := s.pending[:0]
+	for _, event := range s.pending {
+		if event.BlockNumber < fromBlock {
+			held = append(held, event)
+		} else {
+			delete(s.seen, starknetEventID(event))
+		}
+	}
+	s.pending = held
+}
+
+// handleReorg reverts the jobs created for events in the reorganised blocks
+// and lets events from the replacing blocks through again
+func (s *eventStream) handleReorg(ctx context.Context, startingBlock, endingBlock int) {
+	// Queued Jobs may be for events in the reorganised blocks
+	s.scanner.collect(true)
+	reverted := s.scanner.history.rewind(startingBlock - 1)
+	log.Warnf("Chain reorganization reported for blocks %d to %d, %d job(s) affected", startingBlock, endingBlock, len(reverted))
+	revertJobs(ctx, reverted)
+
+	for id, blockNumber := range s.seen {
+		if blockNumber >= startingBlock {
+			delete(s.seen, id)
+		}
+	}
+	s.dropPending(startingBlock)
+	s.nextBlock = min(s.nextBlock, startingBlock)
+	s.filledThrough = min(s.filledThrough, startingBlock-1)
+	s.scanner.commit(s.nextBlock)
+}
@@ -0,0 +1,62 @@
+package main
+
+import "testing"
+
+func TestSubscriptionURL(t *testing.T) {
+	tests := []struct {
+		wsURL, rpcURL string
+		want          string
+		err           bool
+	}{
+		{rpcURL: "https://node.example/rpc/v0_8", want: "wss://node.example/rpc/v0_8"},
+		{rpcURL: "http://localhost:9545", want: "ws://localhost:9545"},
+		{wsURL: "wss://ws.example/v0_8", rpcURL: "https://node.example/rpc", want: "wss://ws.example/v0_8"},
+		{wsURL: "ftp://node.example", err: true},
+	}
+	savedPool, savedWSURL := rpcPool, *wsURL
+	defer func() { rpcPool, *wsURL = savedPool, savedWSURL }()
+	for _, test := range tests {
+		rpcURL := test.rpcURL
+		if rpcURL == "" {
+			rpcURL = "https://node.example/rpc"
+		}
+		pool, err := newRPCPool([]string{rpcURL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rpcPool, *wsURL = pool, test.wsURL
+
+		got, err := subscriptionURL()
+		if test.err {
+			if err == nil {
+				t.Errorf("subscriptionURL() with --ws-url %q = %s, want an error", test.wsURL, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("subscriptionURL() with --ws-url %q and endpoint %s = %s, %v, want %s", test.wsURL, test.rpcURL, got, err, test.want)
+		}
+	}
+}
+
+func TestEventStreamPrune(t *testing.T) {
+	event := func(blockNumber int) StarknetEvent {
+		return StarknetEvent{BlockNumber: blockNumber, TransactionHash: "0x9", EventIndex: 0}
+	}
+	stream := &eventStream{nextBlock: 11, seen: map[string]int{
+		starknetEventID(event(10)): 10,
+		starknetEventID(event(11)): 11,
+		starknetEventID(event(12)): 12,
+	}}
+	stream.prune()
+
+	// Gap filling resumes at block 11, so events of block 10 are not seen again
+	for _, test := range []struct {
+		blockNumber int
+		seen        bool
+	}{{10, false}, {11, true}, {12, true}} {
+		if seen := stream.alreadyProcessed(event(test.blockNumber)); seen != test.seen {
+			t.Errorf("after prune, event in block %d already processed = %t, want %t", test.blockNumber, seen, test.seen)
+		}
+	}
+}